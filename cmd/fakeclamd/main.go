@@ -0,0 +1,125 @@
+// fakeclamd is a stand-in for clamd to try the scan stages locally. It answers PING and
+// INSTREAM, and reports streams containing the EICAR test string as infected.
+//
+//	go run ./cmd/fakeclamd -listen tcp://127.0.0.1:3310
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"file-management-service/pkg/clamd"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// the standard antivirus test string, harmless but detected by every scanner
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func main() {
+	listen := flag.String("listen", "tcp://127.0.0.1:3310", "address to listen on, tcp://host:port or unix:///path")
+	maxLength := flag.Int64("max-length", 25*1024*1024, "largest stream accepted, like StreamMaxLength")
+	fail := flag.Bool("fail", false, "answer every scan with an error")
+	flag.Parse()
+
+	network, address, err := clamd.ParseAddress(*listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if network == "unix" {
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("fake clamd listening on %s", *listen)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serve(conn, *maxLength, *fail)
+	}
+}
+
+func serve(conn net.Conn, maxLength int64, fail bool) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	command, err := readCommand(reader)
+	if err != nil {
+		return
+	}
+
+	// z prefixed commands end with \0, n prefixed ones with a newline
+	terminator := "\n"
+	if strings.HasPrefix(command, "z") {
+		terminator = "\x00"
+	}
+
+	switch strings.TrimLeft(command, "zn") {
+	case "PING":
+		fmt.Fprint(conn, "PONG"+terminator)
+	case "INSTREAM":
+		fmt.Fprint(conn, "stream: "+scan(reader, maxLength, fail)+terminator)
+	default:
+		fmt.Fprint(conn, "UNKNOWN COMMAND"+terminator)
+	}
+}
+
+func readCommand(reader *bufio.Reader) (string, error) {
+	prefix, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	delimiter := byte('\n')
+	if prefix[0] == 'z' {
+		delimiter = 0
+	}
+
+	command, err := reader.ReadString(delimiter)
+	return strings.TrimRight(command, "\x00\n"), err
+}
+
+// scan reads the length prefixed chunks of a stream and returns the verdict
+func scan(reader *bufio.Reader, maxLength int64, fail bool) string {
+	var stream bytes.Buffer
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return "read error ERROR"
+		}
+		if length == 0 {
+			break
+		}
+
+		if int64(stream.Len())+int64(length) > maxLength {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+
+		if _, err := io.CopyN(&stream, reader, int64(length)); err != nil {
+			return "read error ERROR"
+		}
+	}
+
+	switch {
+	case fail:
+		return "Can't allocate memory ERROR"
+	case bytes.Contains(stream.Bytes(), []byte(eicar)):
+		log.Printf("stream of %d bytes: Eicar-Test-Signature FOUND", stream.Len())
+		return "Eicar-Test-Signature FOUND"
+	}
+
+	log.Printf("stream of %d bytes: OK", stream.Len())
+	return "OK"
+}
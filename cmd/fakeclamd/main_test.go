@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file-management-service/pkg/clamd"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen serves the fake scanner on a free port and returns a client for it
+func listen(t *testing.T, maxLength int64, fail bool) *clamd.Client {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, maxLength, fail)
+		}
+	}()
+
+	client, err := clamd.New("tcp://"+listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestScan(t *testing.T) {
+	client := listen(t, 1<<20, false)
+
+	result, err := client.Scan(context.Background(), strings.NewReader("harmless content"))
+	if err != nil || result.Infected {
+		t.Errorf("clean file: got %+v, %v", result, err)
+	}
+
+	// spread over several chunks
+	infected := append(bytes.Repeat([]byte("x"), 100_000), eicar...)
+	result, err = client.Scan(context.Background(), bytes.NewReader(infected))
+	if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("EICAR file: got %+v, %v", result, err)
+	}
+
+	result, err = client.Scan(context.Background(), strings.NewReader(""))
+	if err != nil || result.Infected {
+		t.Errorf("empty file: got %+v, %v", result, err)
+	}
+}
+
+func TestScanTooLarge(t *testing.T) {
+	client := listen(t, 1000, false)
+
+	_, err := client.Scan(context.Background(), bytes.NewReader(make([]byte, 200_000)))
+	if !errors.Is(err, clamd.ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestScanFailure(t *testing.T) {
+	client := listen(t, 1<<20, true)
+
+	_, err := client.Scan(context.Background(), strings.NewReader("harmless content"))
+	if err == nil || errors.Is(err, clamd.ErrTooLarge) {
+		t.Errorf("got %v, want a scan error", err)
+	}
+}
@@ -1,55 +1,174 @@
 package config
 
-import (
-	"fmt"
-	"os"
-	"strconv"
-)
-
+// Config is built in layers: defaults, then the config file, then environment variables,
+// then command line flags. File keys use the json names in JSON, YAML and TOML alike,
+// flags are the env names in lower case with dashes, e.g. --bucket-name.
 type Config struct {
-	BucketName           string `json:"bucketName"`
-	Region               string `json:"region"`
-	DownloadURLTimeLimit int    `json:"downloadURLTimeLimit"`
-	PaginationPageSize   int    `json:"paginationPageSize"`
-	AwsAccessKeyID       string `json:"awsAccessKeyId"`
-	AwsSecretAccessKey   string `json:"awsSecretAccessKey"`
+	Port                    int      `json:"port" env:"PORT"`
+	BucketName              string   `json:"bucketName" env:"BUCKET_NAME"`
+	Region                  string   `json:"region" env:"REGION"`
+	DownloadURLTimeLimit    int      `json:"downloadURLTimeLimit" env:"DOWNLOAD_URL_TIME_LIMIT"`       // in minutes, upper bound for signed URLs
+	DownloadURLMinRemaining int      `json:"downloadURLMinRemaining" env:"DOWNLOAD_URL_MIN_REMAINING"` // in seconds, minimum lifetime left on a cached URL
+	PaginationPageSize      int      `json:"paginationPageSize" env:"PAGINATION_PAGE_SIZE"`
+	CacheBackend            string   `json:"cacheBackend" env:"CACHE_BACKEND"`                 // memory or file
+	CacheMaxEntries         int      `json:"cacheMaxEntries" env:"CACHE_MAX_ENTRIES"`          // only used by the memory backend
+	CacheDir                string   `json:"cacheDir" env:"CACHE_DIR"`                         // only used by the file backend
+	ListCacheTTL            int      `json:"listCacheTTL" env:"LIST_CACHE_TTL"`                // in seconds, zero disables the listing cache
+	ListCacheStaleTTL       int      `json:"listCacheStaleTTL" env:"LIST_CACHE_STALE_TTL"`     // in seconds, how long stale pages are served while refreshing
+	ListCacheMaxEntries     int      `json:"listCacheMaxEntries" env:"LIST_CACHE_MAX_ENTRIES"` // only used by the memory backend
+	AuditLogPath            string   `json:"auditLogPath" env:"AUDIT_LOG_PATH"`
+	AuditLogMaxSize         int      `json:"auditLogMaxSize" env:"AUDIT_LOG_MAX_SIZE"` // in megabytes, the log is also rotated daily
+	TracingExporter         string   `json:"tracingExporter" env:"TRACING_EXPORTER"`   // none, otlp or file
+	TracingFile             string   `json:"tracingFile" env:"TRACING_FILE"`           // only used by the file exporter
+	LogLevel                string   `json:"logLevel" env:"LOG_LEVEL"`                 // debug, info, warn or error
+	LogOutput               string   `json:"logOutput" env:"LOG_OUTPUT"`               // stdout or file
+	LogFile                 string   `json:"logFile" env:"LOG_FILE"`                   // only used for file output
+	LogMaxSize              int      `json:"logMaxSize" env:"LOG_MAX_SIZE"`            // in megabytes, the file is also rotated daily
+	ShutdownTimeout         int      `json:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`   // in seconds, how long in-flight requests may take on shutdown
+	ShutdownDelay           int      `json:"shutdownDelay" env:"SHUTDOWN_DELAY"`       // in seconds, how long /readyz fails before the server stops accepting connections
+	RateLimit               float64  `json:"rateLimit" env:"RATE_LIMIT"`               // requests per second per client IP
+	RateLimitBurst          int      `json:"rateLimitBurst" env:"RATE_LIMIT_BURST"`
+	RateLimitExpiry         int      `json:"rateLimitExpiry" env:"RATE_LIMIT_EXPIRY"`        // in seconds, idle clients are forgotten after this
+	CORSOrigins             []string `json:"corsOrigins" env:"CORS_ORIGINS"`                 // comma separated in env and flags
+	MaxUploadSize           int      `json:"maxUploadSize" env:"MAX_UPLOAD_SIZE"`            // in megabytes per request, zero means unlimited
+	MaxUploadFiles          int      `json:"maxUploadFiles" env:"MAX_UPLOAD_FILES"`          // files per /upload-multiple request, zero means unlimited
+	APIKeys                 []string `json:"apiKeys" env:"API_KEYS" secret:"true"`           // name:key pairs, empty disables authentication
+	Endpoint                string   `json:"endpoint" env:"S3_ENDPOINT"`                     // S3 compatible endpoint URL, e.g. MinIO, empty for AWS
+	ForcePathStyle          bool     `json:"forcePathStyle" env:"S3_FORCE_PATH_STYLE"`       // bucket in the path instead of the host name
+	DisableSSL              bool     `json:"disableSSL" env:"S3_DISABLE_SSL"`                // plain http for endpoints given without a scheme
+	CredentialsProvider     string   `json:"credentialsProvider" env:"CREDENTIALS_PROVIDER"` // static keys, or chain for env, shared profile, web identity and instance role
+	AwsProfile              string   `json:"awsProfile" env:"AWS_PROFILE"`                   // shared config profile used by the chain
+	AwsAccessKeyID          string   `json:"awsAccessKeyId" env:"AWS_ACCESS_KEY_ID"`
+	AwsSecretAccessKey      string   `json:"awsSecretAccessKey" env:"AWS_SECRET_ACCESS_KEY" secret:"true"`
+
+	// named storage targets next to the default one, JSON in env and flags
+	Targets map[string]Target `json:"targets" env:"TARGETS"`
+
+	// receivers of file events, JSON in env and flags
+	Webhooks           []Webhook `json:"webhooks" env:"WEBHOOKS"`
+	WebhookOutboxDir   string    `json:"webhookOutboxDir" env:"WEBHOOK_OUTBOX_DIR"` // pending deliveries, kept across restarts
+	WebhookLogPath     string    `json:"webhookLogPath" env:"WEBHOOK_LOG_PATH"`
+	WebhookLogMaxSize  int       `json:"webhookLogMaxSize" env:"WEBHOOK_LOG_MAX_SIZE"`  // in megabytes, the log is also rotated daily
+	WebhookMaxAttempts int       `json:"webhookMaxAttempts" env:"WEBHOOK_MAX_ATTEMPTS"` // attempts before a delivery is given up
+	WebhookTimeout     int       `json:"webhookTimeout" env:"WEBHOOK_TIMEOUT"`          // in seconds per attempt
+
+	// image thumbnails, generated on first request unless ThumbnailOnUpload is set
+	ThumbnailSizes        []string `json:"thumbnailSizes" env:"THUMBNAIL_SIZES"`                // WIDTHxHEIGHT, comma separated in env and flags
+	ThumbnailOnUpload     bool     `json:"thumbnailOnUpload" env:"THUMBNAIL_ON_UPLOAD"`         // generate the configured sizes right after an upload
+	ThumbnailPrefix       string   `json:"thumbnailPrefix" env:"THUMBNAIL_PREFIX"`              // hidden from listings
+	ThumbnailMaxDimension int      `json:"thumbnailMaxDimension" env:"THUMBNAIL_MAX_DIMENSION"` // largest width or height /thumbnail generates
+	ThumbnailMaxSource    int      `json:"thumbnailMaxSource" env:"THUMBNAIL_MAX_SOURCE"`       // in megabytes, larger images get no thumbnails
+
+	// stages run on uploads by key prefix, the longest matching prefix applies, JSON in env and flags
+	UploadPipelines []UploadPipeline `json:"uploadPipelines" env:"UPLOAD_PIPELINES"`
+
+	// size and type limits for uploads by key prefix, the longest matching prefix applies, JSON in env and flags
+	UploadPolicies []UploadPolicy `json:"uploadPolicies" env:"UPLOAD_POLICIES"`
+
+	// images uploaded below these key prefixes lose their Exif, XMP and IPTC metadata, * for all uploads.
+	// Short for a pipeline starting with the strip-metadata stage.
+	StripMetadataPrefixes []string `json:"stripMetadataPrefixes" env:"STRIP_METADATA_PREFIXES"`
+	StripMetadataMaxSize  int      `json:"stripMetadataMaxSize" env:"STRIP_METADATA_MAX_SIZE"` // in megabytes, larger images are rejected by the stage
+
+	// malware scanning for the scan and scan-after-store stages
+	ClamdAddress     string `json:"clamdAddress" env:"CLAMD_ADDRESS"`         // tcp://host:port or unix:///path/to/clamd.sock
+	ClamdTimeout     int    `json:"clamdTimeout" env:"CLAMD_TIMEOUT"`         // in seconds per file
+	QuarantinePrefix string `json:"quarantinePrefix" env:"QUARANTINE_PREFIX"` // infected files are moved here, hidden from listings
+	StagingPrefix    string `json:"stagingPrefix" env:"STAGING_PREFIX"`       // files wait here for scan-after-store, hidden from listings
+
+	// uploads with the same content are stored once and referenced by the other keys
+	DedupEnabled   bool   `json:"dedupEnabled" env:"DEDUP_ENABLED"`
+	DedupPrefix    string `json:"dedupPrefix" env:"DEDUP_PREFIX"`        // shared content is stored here, hidden from listings
+	DedupIndexPath string `json:"dedupIndexPath" env:"DEDUP_INDEX_PATH"` // local file recording the references
 }
 
-func LoadConfig() (*Config, error) {
-	// Create a new Config instance
-	config := &Config{}
+// Options are command line settings that are not part of the configuration itself
+type Options struct {
+	File        string // config file, also read from CONFIG_FILE
+	PrintConfig bool   // print the redacted configuration and exit
+}
 
-	// Retrieve and assign the values from environment variables
-	config.BucketName = os.Getenv("BUCKET_NAME")
-	config.Region = os.Getenv("REGION")
-	config.DownloadURLTimeLimit, _ = strconv.Atoi(os.Getenv("DOWNLOAD_URL_TIME_LIMIT"))
-	config.PaginationPageSize, _ = strconv.Atoi(os.Getenv("PAGINATION_PAGE_SIZE"))
-	config.AwsAccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
-	config.AwsSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+// defaults returns the configuration before any layer is applied
+func defaults() *Config {
+	return &Config{
+		Port:                    8080,
+		DownloadURLTimeLimit:    15,
+		DownloadURLMinRemaining: 60,
+		PaginationPageSize:      100,
+		CacheBackend:            "memory",
+		CacheMaxEntries:         10000,
+		CacheDir:                "cache",
+		ListCacheMaxEntries:     1000,
+		AuditLogPath:            "logs/audit.log",
+		AuditLogMaxSize:         100,
+		TracingExporter:         "none",
+		TracingFile:             "logs/traces.json",
+		LogLevel:                "info",
+		LogOutput:               "stdout",
+		LogFile:                 "logs/app.log",
+		LogMaxSize:              100,
+		ShutdownTimeout:         30,
+		ShutdownDelay:           5,
+		RateLimit:               10,
+		RateLimitBurst:          30,
+		RateLimitExpiry:         180,
+		CORSOrigins:             []string{"*"},
+		CredentialsProvider:     CredentialsStatic,
+		WebhookOutboxDir:        "data/webhooks",
+		WebhookLogPath:          "logs/webhooks.log",
+		WebhookLogMaxSize:       100,
+		WebhookMaxAttempts:      10,
+		WebhookTimeout:          10,
+		ThumbnailSizes:          []string{"200x200", "800x800"},
+		ThumbnailPrefix:         ".thumbnails/",
+		ThumbnailMaxDimension:   2000,
+		ThumbnailMaxSource:      50,
+		StripMetadataMaxSize:    50,
+		ClamdTimeout:            60,
+		QuarantinePrefix:        ".quarantine/",
+		StagingPrefix:           ".staging/",
+		DedupPrefix:             ".blobs/",
+		DedupIndexPath:          "data/dedup.json",
+	}
+}
 
-	if config.BucketName == "" {
-		return nil, fmt.Errorf("BUCKET_NAME must be set")
+// LoadConfig builds the configuration from the layers and validates it.
+// args are the command line arguments without the program name.
+func LoadConfig(args []string) (*Config, Options, error) {
+	config, options, err := load(args)
+	if err != nil {
+		return nil, options, err
 	}
 
-	if config.Region == "" {
-		return nil, fmt.Errorf("REGION must be set")
+	if err := config.Validate(); err != nil {
+		return nil, options, err
 	}
 
-	if config.DownloadURLTimeLimit == 0 {
-		config.DownloadURLTimeLimit = 15
+	return config, options, nil
+}
+
+// load applies the layers without validating the result
+func load(args []string) (*Config, Options, error) {
+	config := defaults()
+
+	options, flags, err := parseFlags(args, config)
+	if err != nil {
+		return nil, options, err
 	}
 
-	if config.PaginationPageSize == 0 {
-		config.PaginationPageSize = 100
+	if options.File != "" {
+		if err := loadFile(options.File, config); err != nil {
+			return nil, options, err
+		}
 	}
 
-	if config.AwsAccessKeyID == "" {
-		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID must be set")
+	if err := loadEnv(config); err != nil {
+		return nil, options, err
 	}
 
-	if config.AwsSecretAccessKey == "" {
-		return nil, fmt.Errorf("AWS_SECRET_ACCESS_KEY must be set")
+	if err := flags.apply(config); err != nil {
+		return nil, options, err
 	}
 
-	return config, nil
+	return config, options, nil
 }
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a config file named name into a temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"bucketName": "file", "region": "file", "port": 1000, "paginationPageSize": 10}`,
+		"config.yaml": "bucketName: file\nregion: file\nport: 1000\npaginationPageSize: 10\n",
+		"config.toml": "bucketName = \"file\"\nregion = \"file\"\nport = 1000\npaginationPageSize = 10\n",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("BUCKET_NAME", "") // empty variables are ignored
+			t.Setenv("REGION", "env")
+			t.Setenv("PORT", "2000")
+
+			config, _, err := load([]string{"--config=" + writeFile(t, name, content), "--port=3000"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// defaults < file < env < flags
+			if config.BucketName != "file" || config.Region != "env" || config.Port != 3000 || config.PaginationPageSize != 10 {
+				t.Errorf("bucket %q, region %q, port %d, page size %d, want file, env, 3000 and 10",
+					config.BucketName, config.Region, config.Port, config.PaginationPageSize)
+			}
+			if config.DownloadURLTimeLimit != defaults().DownloadURLTimeLimit {
+				t.Errorf("unset download URL time limit is %d, not the default", config.DownloadURLTimeLimit)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.json", `{"bucketName": "file"}`))
+	t.Setenv("BUCKET_NAME", "")
+
+	config, options, err := load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.BucketName != "file" || options.File == "" {
+		t.Errorf("bucket %q from %q", config.BucketName, options.File)
+	}
+}
+
+func TestLoadRejectsInvalidSettings(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+
+	for name, test := range map[string]struct {
+		args  []string
+		env   map[string]string
+		error string
+	}{
+		"unknown json key": {args: []string{"--config=" + writeFile(t, "config.json", `{"bukcetName": "b"}`)}, error: "bukcetName"},
+		"unknown yaml key": {args: []string{"--config=" + writeFile(t, "config.yaml", "bukcetName: b\n")}, error: "bukcetName"},
+		"unknown toml key": {args: []string{"--config=" + writeFile(t, "config.toml", "bukcetName = \"b\"\n")}, error: "bukcetName"},
+		"unknown format":   {args: []string{"--config=" + writeFile(t, "config.ini", "bucketName=b\n")}, error: "unsupported format"},
+		"missing file":     {args: []string{"--config=" + filepath.Join(t.TempDir(), "missing.json")}, error: "config file"},
+		"unknown flag":     {args: []string{"--bukcet-name=b"}, error: "bukcet-name"},
+		"bad flag value":   {args: []string{"--port=http"}, error: "--port"},
+		"bad env value":    {env: map[string]string{"PORT": "http"}, error: "PORT"},
+		"bad env json":     {env: map[string]string{"TARGETS": "{"}, error: "TARGETS"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			_, _, err := load(test.args)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want an error about %s", err, test.error)
+			}
+		})
+	}
+}
+
+func TestLoadEnvParsesLists(t *testing.T) {
+	var config Config
+	for env, value := range map[string]string{
+		"CORS_ORIGINS":  " https://a.test, ,https://b.test",
+		"RATE_LIMIT":    "2.5",
+		"DEDUP_ENABLED": "true",
+		"WEBHOOKS":      `[{"url": "https://hooks.test", "target": "archive"}]`,
+	} {
+		t.Setenv(env, value)
+	}
+
+	if err := loadEnv(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(config.CORSOrigins, ",") != "https://a.test,https://b.test" || config.RateLimit != 2.5 || !config.DedupEnabled ||
+		len(config.Webhooks) != 1 || config.Webhooks[0].Target != "archive" {
+		t.Errorf("parsed %v, %v, %v and %+v", config.CORSOrigins, config.RateLimit, config.DedupEnabled, config.Webhooks)
+	}
+}
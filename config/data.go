@@ -0,0 +1,51 @@
+package config
+
+import "time"
+
+// settings that are only read on start, a reload keeps their current value and asks for a restart
+var restartFields = map[string]bool{
+	"port":                true,
+	"cacheBackend":        true,
+	"cacheMaxEntries":     true,
+	"cacheDir":            true,
+	"listCacheTTL":        true,
+	"listCacheStaleTTL":   true,
+	"listCacheMaxEntries": true,
+	"auditLogPath":        true,
+	"auditLogMaxSize":     true,
+	"tracingExporter":     true,
+	"tracingFile":         true,
+	"logLevel":            true,
+	"logOutput":           true,
+	"logFile":             true,
+	"logMaxSize":          true,
+	"webhookOutboxDir":    true,
+	"webhookLogPath":      true,
+	"webhookLogMaxSize":   true,
+	"thumbnailPrefix":     true,
+	"thumbnailMaxSource":  true,
+	"quarantinePrefix":    true,
+	"stagingPrefix":       true,
+	"dedupPrefix":         true,
+	"dedupIndexPath":      true,
+}
+
+// event types a webhook can subscribe to, see pkg/events
+var webhookEvents = map[string]bool{
+	"object.created": true,
+	"object.deleted": true,
+	"object.moved":   true,
+	"object.updated": true,
+	"folder.created": true,
+	"folder.deleted": true,
+}
+
+// upload pipeline stages, see pkg/pipeline
+var uploadStages = map[string]bool{
+	StageStripMetadata:  true,
+	StageScan:           true,
+	StageScanAfterStore: true,
+}
+
+// editors write a file in several steps, changes are reloaded once the file is quiet for this long
+const reloadDelay = 500 * time.Millisecond
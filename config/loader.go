@@ -0,0 +1,185 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// flagValues holds the flags that were set on the command line, keyed by field index
+type flagValues map[int]string
+
+// parseFlags registers a flag per field plus --config and --print-config.
+// Only flags given on the command line override the other layers.
+func parseFlags(args []string, config *Config) (Options, flagValues, error) {
+	options := Options{File: os.Getenv("CONFIG_FILE")}
+
+	set := flag.NewFlagSet("file-management-service", flag.ContinueOnError)
+	set.StringVar(&options.File, "config", options.File, "path to a JSON, YAML or TOML config file")
+	set.BoolVar(&options.PrintConfig, "print-config", false, "print the configuration with secrets redacted and exit")
+
+	raw := map[string]*string{}
+	fields := reflect.TypeOf(config).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		name := flagName(field)
+		raw[name] = set.String(name, "", fmt.Sprintf("%s, overrides %s", jsonName(field), field.Tag.Get("env")))
+	}
+
+	if err := set.Parse(args); err != nil {
+		return options, nil, err
+	}
+
+	values := flagValues{}
+	set.Visit(func(f *flag.Flag) {
+		for i := 0; i < fields.NumField(); i++ {
+			if flagName(fields.Field(i)) == f.Name {
+				values[i] = *raw[f.Name]
+			}
+		}
+	})
+
+	return options, values, nil
+}
+
+// apply sets the fields given on the command line
+func (values flagValues) apply(config *Config) error {
+	target := reflect.ValueOf(config).Elem()
+	for i, value := range values {
+		field := target.Type().Field(i)
+		if err := setField(target.Field(i), value); err != nil {
+			return fmt.Errorf("flag --%s: %w", flagName(field), err)
+		}
+	}
+
+	return nil
+}
+
+// loadFile reads a config file, the format is picked by its extension. Unknown keys are an error.
+func loadFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	// YAML and TOML are converted to JSON so all formats share the json field names
+	var values map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config file %s: unsupported format, use .json, .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	if values != nil {
+		if data, err = json.Marshal(values); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// loadEnv applies every environment variable that is set and not empty
+func loadEnv(config *Config) error {
+	target := reflect.ValueOf(config).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		name := target.Type().Field(i).Tag.Get("env")
+
+		value, found := os.LookupEnv(name)
+		if !found || value == "" {
+			continue
+		}
+
+		if err := setField(target.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setField parses a string into a field, lists of strings are comma separated, other lists and maps are JSON
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		field.SetInt(int64(number))
+	case reflect.Float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(number)
+	case reflect.Bool:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		field.SetBool(boolean)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return setJSON(field, value)
+		}
+
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		return setJSON(field, value)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+func setJSON(field reflect.Value, value string) error {
+	values := reflect.New(field.Type())
+	if err := json.Unmarshal([]byte(value), values.Interface()); err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	field.Set(values.Elem())
+
+	return nil
+}
+
+func jsonName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+func flagName(field reflect.StructField) string {
+	return strings.ReplaceAll(strings.ToLower(field.Tag.Get("env")), "_", "-")
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Store holds the current configuration. Handlers call Get on every request,
+// so a reload applies from the next request on.
+type Store struct {
+	current atomic.Pointer[Config]
+	args    []string
+	options Options
+	mu      sync.Mutex // one reload at a time
+}
+
+// NewStore wraps a loaded configuration, args and options are used again on every reload
+func NewStore(config *Config, options Options, args []string) *Store {
+	store := &Store{args: args, options: options}
+	store.current.Store(config)
+
+	return store
+}
+
+// Get returns the current configuration, it must not be modified
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+// Reload loads the layers again and swaps the result in when it is valid.
+// Changes are logged, an invalid configuration is rejected and the current one is kept.
+func (s *Store) Reload(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.Get()
+
+	next, _, err := load(s.args)
+	if err != nil {
+		slog.Error("Configuration reload rejected", "reason", reason, "error", err)
+		return err
+	}
+
+	changes, restart := diff(current, next)
+	if err := next.Validate(); err != nil {
+		slog.Error("Configuration reload rejected", "reason", reason, "changes", changes, "error", err)
+		return err
+	}
+
+	if len(changes) == 0 && len(restart) == 0 {
+		slog.Info("Configuration unchanged", "reason", reason)
+		return nil
+	}
+
+	// settings read on start keep their value so Get reports what is in effect
+	keepRestartFields(current, next)
+	s.current.Store(next)
+
+	slog.Info("Configuration reloaded", "reason", reason, "changes", changes)
+	if len(restart) > 0 {
+		slog.Warn("Some changes only apply after a restart", "changes", restart)
+	}
+
+	return nil
+}
+
+// diff lists the changed settings as "name: old -> new", secrets are not printed.
+// Changes to settings that need a restart are listed separately.
+func diff(current, next *Config) (changes []string, restart []string) {
+	before, after := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	printedBefore, printedAfter := reflect.ValueOf(current.redacted()).Elem(), reflect.ValueOf(next.redacted()).Elem()
+	for i := 0; i < before.NumField(); i++ {
+		field := before.Type().Field(i)
+		if reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			continue
+		}
+
+		name := jsonName(field)
+		oldValue, newValue := printable(printedBefore.Field(i)), printable(printedAfter.Field(i))
+		change := fmt.Sprintf("%s: %s -> %s", name, oldValue, newValue)
+		if field.Tag.Get("secret") == "true" || oldValue == newValue {
+			change = name + ": changed"
+		}
+
+		if restartFields[name] {
+			restart = append(restart, change)
+		} else {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, restart
+}
+
+// printable formats a setting for the log, lists and maps as JSON
+func printable(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		encoded, err := json.Marshal(value.Interface())
+		if err == nil {
+			return string(encoded)
+		}
+	}
+
+	return fmt.Sprint(value.Interface())
+}
+
+func keepRestartFields(current, next *Config) {
+	before, after := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < before.NumField(); i++ {
+		if restartFields[jsonName(before.Type().Field(i))] {
+			after.Field(i).Set(before.Field(i))
+		}
+	}
+}
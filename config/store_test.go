@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// newStore loads the configuration from a JSON file holding settings, which the test can rewrite before a reload
+func newStore(t *testing.T, settings string) (*Store, string) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+
+	path := writeFile(t, "config.json", settings)
+	args := []string{"--config=" + path}
+
+	config, options, err := LoadConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewStore(config, options, args), path
+}
+
+func TestReloadKeepsRestartFields(t *testing.T) {
+	store, path := newStore(t, `{"bucketName": "b", "region": "us-east-1", "credentialsProvider": "chain", "port": 8080, "paginationPageSize": 10}`)
+	before := store.Get()
+
+	err := os.WriteFile(path, []byte(`{"bucketName": "b", "region": "us-east-1", "credentialsProvider": "chain", "port": 9090, "paginationPageSize": 50, "logLevel": "debug"}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart-only settings report what is in effect, the others apply at once
+	config := store.Get()
+	if config.Port != 8080 || config.LogLevel != before.LogLevel || config.PaginationPageSize != 50 {
+		t.Errorf("port %d, log level %s, page size %d after the reload, want 8080, %s and 50",
+			config.Port, config.LogLevel, config.PaginationPageSize, before.LogLevel)
+	}
+	if before.PaginationPageSize != 10 {
+		t.Errorf("the previous configuration was changed to page size %d", before.PaginationPageSize)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	store, path := newStore(t, `{"bucketName": "b", "region": "us-east-1", "credentialsProvider": "chain", "paginationPageSize": 10}`)
+	before := store.Get()
+
+	for name, settings := range map[string]string{
+		"invalid":     `{"bucketName": "b", "region": "us-east-1", "credentialsProvider": "chain", "paginationPageSize": -1}`,
+		"unknown key": `{"bucketName": "b", "region": "us-east-1", "credentialsProvider": "chain", "pageSize": 50}`,
+	} {
+		if err := os.WriteFile(path, []byte(settings), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Reload("test"); err == nil {
+			t.Errorf("%s: configuration was reloaded", name)
+		}
+		if store.Get() != before {
+			t.Errorf("%s: the current configuration was replaced", name)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	current := defaults()
+	current.AwsSecretAccessKey = "old"
+
+	next := defaults()
+	next.AwsSecretAccessKey = "new"
+	next.PaginationPageSize = 50
+	next.CORSOrigins = []string{"https://a.test"}
+	next.Port = 9090
+
+	changes, restart := diff(current, next)
+
+	want := []string{"paginationPageSize: 100 -> 50", `corsOrigins: ["*"] -> ["https://a.test"]`, "awsSecretAccessKey: changed"}
+	if strings.Join(changes, "|") != strings.Join(want, "|") {
+		t.Errorf("changes %q, want %q", changes, want)
+	}
+	if strings.Join(restart, "|") != "port: 8080 -> 9090" {
+		t.Errorf("restart %q", restart)
+	}
+
+	for _, change := range changes {
+		if strings.Contains(change, "old") || strings.Contains(change, "new") {
+			t.Errorf("secret printed in %q", change)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultTarget is the name of the target built from the top level bucket settings
+const DefaultTarget = "default"
+
+// credential providers
+const (
+	CredentialsStatic = "static" // AwsAccessKeyID and AwsSecretAccessKey
+	CredentialsChain  = "chain"  // the AWS default chain: env, shared profile, web identity, instance role
+)
+
+// Target is a named storage location, requests pick one with the target parameter.
+// Region, endpoint and credentials fall back to the top level settings when empty,
+// the path style and SSL settings come with the endpoint.
+type Target struct {
+	Name                string   `json:"-"`
+	BucketName          string   `json:"bucketName"`
+	Region              string   `json:"region,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	ForcePathStyle      bool     `json:"forcePathStyle,omitempty"`
+	DisableSSL          bool     `json:"disableSSL,omitempty"`
+	CredentialsProvider string   `json:"credentialsProvider,omitempty"` // static when keys are given
+	AwsProfile          string   `json:"awsProfile,omitempty"`
+	AwsAccessKeyID      string   `json:"awsAccessKeyId,omitempty"`
+	AwsSecretAccessKey  string   `json:"awsSecretAccessKey,omitempty" secret:"true"`
+	Permissions         []string `json:"permissions,omitempty"` // read, write and delete, empty allows all of them
+	Actors              []string `json:"actors,omitempty"`      // API key names that may use the target, empty allows everyone
+}
+
+// Target resolves a target by name, an empty name is the default target
+func (c *Config) Target(name string) (Target, error) {
+	if name == "" {
+		name = DefaultTarget
+	}
+
+	target, found := c.Targets[name]
+	if name == DefaultTarget {
+		target, found = Target{BucketName: c.BucketName}, c.BucketName != ""
+	}
+
+	if !found {
+		return Target{}, fmt.Errorf("unknown target %q", name)
+	}
+
+	target.Name = name
+	if target.Region == "" {
+		target.Region = c.Region
+	}
+
+	if target.Endpoint == "" {
+		target.Endpoint = c.Endpoint
+		target.ForcePathStyle = c.ForcePathStyle
+		target.DisableSSL = c.DisableSSL
+	}
+
+	switch {
+	case target.AwsAccessKeyID != "":
+		target.CredentialsProvider = CredentialsStatic
+	case target.CredentialsProvider == "":
+		target.CredentialsProvider = c.CredentialsProvider
+		target.AwsProfile = c.AwsProfile
+		target.AwsAccessKeyID = c.AwsAccessKeyID
+		target.AwsSecretAccessKey = c.AwsSecretAccessKey
+	}
+
+	return target, nil
+}
+
+// TargetNames lists all configured targets, the default target first
+func (c *Config) TargetNames() []string {
+	var names []string
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if c.BucketName != "" {
+		names = append([]string{DefaultTarget}, names...)
+	}
+
+	return names
+}
+
+// Allows reports whether actor may perform an operation that needs permission
+func (t Target) Allows(permission, actor string) bool {
+	return (len(t.Permissions) == 0 || contains(t.Permissions, permission)) &&
+		(len(t.Actors) == 0 || contains(t.Actors, actor))
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ThumbnailSize is a bounding box in pixels, e.g. 200x200
+type ThumbnailSize struct {
+	Width  int
+	Height int
+}
+
+func (s ThumbnailSize) String() string {
+	return fmt.Sprintf("%dx%d", s.Width, s.Height)
+}
+
+// ParseThumbnailSize parses a WIDTHxHEIGHT size
+func ParseThumbnailSize(value string) (ThumbnailSize, error) {
+	width, height, found := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "x")
+	w, wErr := strconv.Atoi(width)
+	h, hErr := strconv.Atoi(height)
+	if !found || wErr != nil || hErr != nil || w <= 0 || h <= 0 {
+		return ThumbnailSize{}, fmt.Errorf("invalid size %q, use WIDTHxHEIGHT", value)
+	}
+
+	return ThumbnailSize{Width: w, Height: h}, nil
+}
+
+// Thumbnails returns the configured thumbnail sizes, invalid entries are left out
+func (c *Config) Thumbnails() []ThumbnailSize {
+	sizes := make([]ThumbnailSize, 0, len(c.ThumbnailSizes))
+	for _, value := range c.ThumbnailSizes {
+		if size, err := ParseThumbnailSize(value); err == nil {
+			sizes = append(sizes, size)
+		}
+	}
+
+	return sizes
+}
@@ -0,0 +1,122 @@
+package config
+
+import "strings"
+
+// upload pipeline stages, see pkg/pipeline
+const (
+	StageStripMetadata  = "strip-metadata"   // removes image metadata, see StripMetadataPrefixes
+	StageScan           = "scan"             // scans with clamd before the file is stored
+	StageScanAfterStore = "scan-after-store" // scans with clamd once the file is stored
+)
+
+// UploadPipeline lists the stages run on uploads below a key prefix, in order
+type UploadPipeline struct {
+	Prefix string   `json:"prefix"` // empty for all uploads without a more specific pipeline
+	Stages []string `json:"stages"`
+}
+
+// UploadPolicy limits the files uploaded below a key prefix. Extensions are given without the dot,
+// types are MIME types like application/pdf or image/* for a whole family.
+type UploadPolicy struct {
+	Prefix            string   `json:"prefix"`            // empty for all uploads without a more specific policy
+	MaxFileSize       int      `json:"maxFileSize"`       // in megabytes per file, zero means unlimited
+	MaxRequestSize    int      `json:"maxRequestSize"`    // in megabytes per request, zero means unlimited
+	AllowedExtensions []string `json:"allowedExtensions"` // empty allows all extensions that are not denied
+	DeniedExtensions  []string `json:"deniedExtensions"`
+	AllowedTypes      []string `json:"allowedTypes"` // checked against the type sniffed from the content, empty allows all
+}
+
+// UploadStages returns the stages of the pipeline with the longest prefix matching objectKey,
+// led by strip-metadata for keys below StripMetadataPrefixes
+func (c *Config) UploadStages(objectKey string) []string {
+	var stages []string
+	longest := -1
+	for _, pipeline := range c.UploadPipelines {
+		if strings.HasPrefix(objectKey, pipeline.Prefix) && len(pipeline.Prefix) > longest {
+			stages, longest = pipeline.Stages, len(pipeline.Prefix)
+		}
+	}
+
+	if c.StripsMetadata(objectKey) && !contains(stages, StageStripMetadata) {
+		stages = append([]string{StageStripMetadata}, stages...)
+	}
+
+	return stages
+}
+
+// StripsMetadata reports whether images uploaded to objectKey are cleaned of their metadata
+func (c *Config) StripsMetadata(objectKey string) bool {
+	for _, prefix := range c.StripMetadataPrefixes {
+		if prefix == "*" || strings.HasPrefix(objectKey, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScansUploads reports whether any pipeline scans for malware
+func (c *Config) ScansUploads() bool {
+	for _, pipeline := range c.UploadPipelines {
+		if contains(pipeline.Stages, StageScan) || contains(pipeline.Stages, StageScanAfterStore) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PolicyFor returns the upload policy with the longest prefix matching objectKey
+func (c *Config) PolicyFor(objectKey string) (UploadPolicy, bool) {
+	var policy UploadPolicy
+	longest := -1
+	for _, candidate := range c.UploadPolicies {
+		if strings.HasPrefix(objectKey, candidate.Prefix) && len(candidate.Prefix) > longest {
+			policy, longest = candidate, len(candidate.Prefix)
+		}
+	}
+
+	return policy, longest >= 0
+}
+
+// UploadLimit returns the largest request size in bytes an upload of files below folderPath may have,
+// the smaller of MaxUploadSize and the largest request limit of the policies that may apply to one of
+// the keys. Zero means unlimited.
+func (c *Config) UploadLimit(folderPath string) int64 {
+	// keys matching no policy, or one without a request limit, are only limited by MaxUploadSize
+	largest := int64(0)
+	if policy, found := c.PolicyFor(folderPath); found {
+		largest = policy.RequestLimit()
+	}
+
+	// a longer prefix may apply to some of the keys
+	for _, policy := range c.UploadPolicies {
+		if len(policy.Prefix) > len(folderPath) && strings.HasPrefix(policy.Prefix, folderPath) {
+			if limit := policy.RequestLimit(); limit == 0 || largest == 0 {
+				largest = 0
+			} else {
+				largest = max(largest, limit)
+			}
+		}
+	}
+
+	global := int64(c.MaxUploadSize) << 20
+	switch {
+	case largest == 0:
+		return global
+	case global == 0:
+		return largest
+	}
+
+	return min(largest, global)
+}
+
+// FileLimit returns the largest file size in bytes, zero means unlimited
+func (p UploadPolicy) FileLimit() int64 {
+	return int64(p.MaxFileSize) << 20
+}
+
+// RequestLimit returns the largest request size in bytes, zero means unlimited
+func (p UploadPolicy) RequestLimit() int64 {
+	return int64(p.MaxRequestSize) << 20
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUploadLimit(t *testing.T) {
+	const mb = 1 << 20
+	policies := []UploadPolicy{
+		{Prefix: "photos/", MaxRequestSize: 10},
+		{Prefix: "photos/raw/", MaxRequestSize: 40},
+		{Prefix: "docs/", MaxRequestSize: 5},
+		{Prefix: "docs/scans/"},
+	}
+
+	for _, test := range []struct {
+		maxUploadSize int
+		folder        string
+		want          int64
+	}{
+		{0, "photos/", 40 * mb},     // a key below photos/raw/ may be 40 MB
+		{0, "photos/raw/", 40 * mb}, // only the longest prefix applies
+		{0, "photos/small/", 10 * mb},
+		{20, "photos/", 20 * mb}, // MAX_UPLOAD_SIZE caps every policy
+		{0, "docs/", 0},          // docs/scans/ has no request limit
+		{100, "docs/", 100 * mb},
+		{0, "", 0},   // keys outside every policy are unlimited
+		{0, "ph", 0}, // and so are keys like "ph/a.txt"
+	} {
+		config := &Config{MaxUploadSize: test.maxUploadSize, UploadPolicies: policies}
+		if got := config.UploadLimit(test.folder); got != test.want {
+			t.Errorf("MAX_UPLOAD_SIZE %d, folder %q: got %d, want %d", test.maxUploadSize, test.folder, got, test.want)
+		}
+	}
+
+	// with an empty prefix every key has a limit
+	config := &Config{UploadPolicies: []UploadPolicy{{Prefix: "", MaxRequestSize: 2}, {Prefix: "photos/", MaxRequestSize: 10}}}
+	if got := config.UploadLimit(""); got != 10*mb {
+		t.Errorf("root folder: got %d, want %d", got, 10*mb)
+	}
+}
+
+func TestUploadStages(t *testing.T) {
+	config := &Config{
+		UploadPipelines: []UploadPipeline{
+			{Prefix: "", Stages: []string{StageScan}},
+			{Prefix: "photos/", Stages: []string{StageScanAfterStore}},
+			{Prefix: "photos/raw/", Stages: []string{}},
+		},
+		StripMetadataPrefixes: []string{"photos/", "avatars/"},
+	}
+
+	for key, want := range map[string]string{
+		"a.txt":             StageScan,
+		"photos2/a.png":     StageScan, // prefixes are not folders
+		"photos/a.png":      StageStripMetadata + "," + StageScanAfterStore,
+		"photos/raw/a.png":  StageStripMetadata, // the longest prefix applies even without stages
+		"avatars/a.png":     StageStripMetadata + "," + StageScan,
+		"photos/2026/a.png": StageStripMetadata + "," + StageScanAfterStore,
+	} {
+		if got := strings.Join(config.UploadStages(key), ","); got != want {
+			t.Errorf("%s: stages %s, want %s", key, got, want)
+		}
+	}
+
+	// strip-metadata listed in a pipeline runs where it is listed, once
+	config.UploadPipelines = []UploadPipeline{{Prefix: "photos/", Stages: []string{StageScan, StageStripMetadata}}}
+	if got := strings.Join(config.UploadStages("photos/a.png"), ","); got != StageScan+","+StageStripMetadata {
+		t.Errorf("stages %s, want strip-metadata after scan", got)
+	}
+
+	// no pipeline and no strip prefix leaves uploads as they are
+	if stages := (&Config{}).UploadStages("a.txt"); len(stages) != 0 {
+		t.Errorf("stages %v without pipelines", stages)
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	config := &Config{UploadPolicies: []UploadPolicy{
+		{Prefix: "", MaxFileSize: 1},
+		{Prefix: "docs/", MaxFileSize: 2},
+		{Prefix: "docs/scans/", MaxFileSize: 3},
+	}}
+
+	for key, want := range map[string]int{"a.txt": 1, "docs/a.txt": 2, "docs/scans/a.pdf": 3, "docs/scans2/a.pdf": 2} {
+		if policy, found := config.PolicyFor(key); !found || policy.MaxFileSize != want {
+			t.Errorf("%s: policy %+v, want the one of size %d", key, policy, want)
+		}
+	}
+
+	config.UploadPolicies = config.UploadPolicies[1:]
+	if policy, found := config.PolicyFor("a.txt"); found {
+		t.Errorf("a.txt matched %+v", policy)
+	}
+}
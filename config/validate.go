@@ -0,0 +1,286 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// longest lifetime S3 accepts for a presigned URL, in minutes
+const maxPresignMinutes = 7 * 24 * 60
+
+// target names end up in cache keys and query parameters
+var targetName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate checks the whole configuration and reports every problem at once.
+// Settings are named by their environment variable, the file key and flag map to it.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port < 65536, "PORT must be between 1 and 65535")
+	check(c.BucketName != "" || len(c.Targets) > 0, "BUCKET_NAME must be set unless TARGETS are configured")
+	check(c.BucketName == "" || c.Region != "", "REGION must be set")
+	check(c.DownloadURLTimeLimit > 0 && c.DownloadURLTimeLimit <= maxPresignMinutes,
+		"DOWNLOAD_URL_TIME_LIMIT must be between 1 and %d minutes", maxPresignMinutes)
+	check(c.DownloadURLMinRemaining >= 0 && c.DownloadURLMinRemaining < c.DownloadURLTimeLimit*60,
+		"DOWNLOAD_URL_MIN_REMAINING must be at least 0 and less than DOWNLOAD_URL_TIME_LIMIT")
+	check(c.PaginationPageSize > 0 && c.PaginationPageSize <= 1000, "PAGINATION_PAGE_SIZE must be between 1 and 1000")
+	check(oneOf(c.CacheBackend, "memory", "file"), "CACHE_BACKEND must be either memory or file")
+	check(c.CacheMaxEntries >= 0, "CACHE_MAX_ENTRIES must not be negative")
+	check(c.CacheBackend != "file" || c.CacheDir != "", "CACHE_DIR must be set for the file cache backend")
+	check(c.ListCacheTTL >= 0, "LIST_CACHE_TTL must not be negative")
+	check(c.ListCacheStaleTTL >= 0, "LIST_CACHE_STALE_TTL must not be negative")
+	check(c.ListCacheMaxEntries >= 0, "LIST_CACHE_MAX_ENTRIES must not be negative")
+	check(c.AuditLogPath != "", "AUDIT_LOG_PATH must be set")
+	check(c.AuditLogMaxSize > 0, "AUDIT_LOG_MAX_SIZE must be positive")
+	check(oneOf(c.TracingExporter, "none", "otlp", "file"), "TRACING_EXPORTER must be one of none, otlp or file")
+	check(c.TracingExporter != "file" || c.TracingFile != "", "TRACING_FILE must be set for the file exporter")
+	check(validLogLevel(c.LogLevel), "LOG_LEVEL must be one of debug, info, warn or error")
+	check(oneOf(c.LogOutput, "stdout", "file"), "LOG_OUTPUT must be either stdout or file")
+	check(c.LogOutput != "file" || c.LogFile != "", "LOG_FILE must be set for file output")
+	check(c.LogMaxSize > 0, "LOG_MAX_SIZE must be positive")
+	check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.ShutdownDelay >= 0, "SHUTDOWN_DELAY must not be negative")
+	check(c.RateLimit > 0, "RATE_LIMIT must be positive")
+	check(c.RateLimitBurst > 0, "RATE_LIMIT_BURST must be positive")
+	check(c.RateLimitExpiry > 0, "RATE_LIMIT_EXPIRY must be positive")
+	check(len(c.CORSOrigins) > 0, "CORS_ORIGINS must list at least one origin, use * to allow all")
+	check(c.MaxUploadSize >= 0, "MAX_UPLOAD_SIZE must not be negative")
+	check(c.MaxUploadFiles >= 0, "MAX_UPLOAD_FILES must not be negative")
+	check(oneOf(c.CredentialsProvider, CredentialsStatic, CredentialsChain), "CREDENTIALS_PROVIDER must be either static or chain")
+	check(validEndpoint(c.Endpoint), "S3_ENDPOINT must be a http or https URL, or a host name")
+
+	// targets are checked with the settings they inherit
+	for _, name := range c.TargetNames() {
+		target, _ := c.Target(name)
+		if target.CredentialsProvider == CredentialsStatic {
+			check(target.AwsAccessKeyID != "" && target.AwsSecretAccessKey != "",
+				"target %q: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for static credentials, or CREDENTIALS_PROVIDER=chain", name)
+		}
+	}
+
+	check(c.WebhookOutboxDir != "", "WEBHOOK_OUTBOX_DIR must be set")
+	check(c.WebhookLogPath != "", "WEBHOOK_LOG_PATH must be set")
+	check(c.WebhookLogMaxSize > 0, "WEBHOOK_LOG_MAX_SIZE must be positive")
+	check(c.WebhookMaxAttempts > 0, "WEBHOOK_MAX_ATTEMPTS must be positive")
+	check(c.WebhookTimeout > 0, "WEBHOOK_TIMEOUT must be positive")
+
+	check(c.ThumbnailPrefix != "" && strings.HasSuffix(c.ThumbnailPrefix, "/"), "THUMBNAIL_PREFIX must be set and end with /")
+	check(c.ThumbnailMaxDimension > 0, "THUMBNAIL_MAX_DIMENSION must be positive")
+	check(c.ThumbnailMaxSource > 0, "THUMBNAIL_MAX_SOURCE must be positive")
+	for _, value := range c.ThumbnailSizes {
+		size, err := ParseThumbnailSize(value)
+		check(err == nil, "THUMBNAIL_SIZES: %v", err)
+		check(err != nil || (size.Width <= c.ThumbnailMaxDimension && size.Height <= c.ThumbnailMaxDimension),
+			"THUMBNAIL_SIZES: %s is larger than THUMBNAIL_MAX_DIMENSION", value)
+	}
+
+	check(c.StripMetadataMaxSize > 0, "STRIP_METADATA_MAX_SIZE must be positive")
+	for _, prefix := range c.StripMetadataPrefixes {
+		check(prefix != "", "STRIP_METADATA_PREFIXES must not contain empty prefixes, use * for all uploads")
+	}
+
+	prefixes := map[string]bool{}
+	for i, pipeline := range c.UploadPipelines {
+		check(!prefixes[pipeline.Prefix], "upload pipeline %d: prefix %q is configured twice", i+1, pipeline.Prefix)
+		prefixes[pipeline.Prefix] = true
+
+		for _, stage := range pipeline.Stages {
+			check(uploadStages[stage], "upload pipeline %d: unknown stage %q", i+1, stage)
+		}
+	}
+
+	policyPrefixes := map[string]bool{}
+	for i, policy := range c.UploadPolicies {
+		check(!policyPrefixes[policy.Prefix], "upload policy %d: prefix %q is configured twice", i+1, policy.Prefix)
+		policyPrefixes[policy.Prefix] = true
+
+		check(policy.MaxFileSize >= 0, "upload policy %d: maxFileSize must not be negative", i+1)
+		check(policy.MaxRequestSize >= 0, "upload policy %d: maxRequestSize must not be negative", i+1)
+		for _, extension := range append(policy.AllowedExtensions, policy.DeniedExtensions...) {
+			check(strings.Trim(extension, ".") != "", "upload policy %d: extensions must not be empty", i+1)
+		}
+		for _, contentType := range policy.AllowedTypes {
+			major, minor, found := strings.Cut(contentType, "/")
+			check(found && major != "" && minor != "", "upload policy %d: %q is not a MIME type like image/png or image/*", i+1, contentType)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, webhook := range c.Webhooks {
+		parsed, err := url.Parse(webhook.URL)
+		check(err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "",
+			"webhook %d: url must be a http or https URL", i+1)
+		check(!seen[webhook.URL], "webhook %d: %s is configured twice", i+1, webhook.URL)
+		seen[webhook.URL] = true
+
+		for _, event := range webhook.Events {
+			check(webhookEvents[event], "webhook %d: unknown event %q", i+1, event)
+		}
+
+		if webhook.Target != "" {
+			_, err := c.Target(webhook.Target)
+			check(err == nil, "webhook %d: %v", i+1, err)
+		}
+	}
+
+	check(!c.ScansUploads() || c.ClamdAddress != "", "CLAMD_ADDRESS must be set for the scan stages")
+	check(validScannerAddress(c.ClamdAddress), "CLAMD_ADDRESS must be tcp://host:port, unix:///path or host:port")
+	check(c.ClamdTimeout > 0, "CLAMD_TIMEOUT must be positive")
+	check(c.QuarantinePrefix != "" && strings.HasSuffix(c.QuarantinePrefix, "/"), "QUARANTINE_PREFIX must be set and end with /")
+	check(!overlaps(c.QuarantinePrefix, c.ThumbnailPrefix), "QUARANTINE_PREFIX and THUMBNAIL_PREFIX must not overlap")
+	check(c.StagingPrefix != "" && strings.HasSuffix(c.StagingPrefix, "/"), "STAGING_PREFIX must be set and end with /")
+	check(!overlaps(c.StagingPrefix, c.ThumbnailPrefix) && !overlaps(c.StagingPrefix, c.QuarantinePrefix) && !overlaps(c.StagingPrefix, c.DedupPrefix),
+		"STAGING_PREFIX must not overlap THUMBNAIL_PREFIX, QUARANTINE_PREFIX or DEDUP_PREFIX")
+
+	check(c.DedupPrefix != "" && strings.HasSuffix(c.DedupPrefix, "/"), "DEDUP_PREFIX must be set and end with /")
+	check(!overlaps(c.DedupPrefix, c.ThumbnailPrefix) && !overlaps(c.DedupPrefix, c.QuarantinePrefix),
+		"DEDUP_PREFIX must not overlap THUMBNAIL_PREFIX or QUARANTINE_PREFIX")
+	check(c.DedupIndexPath != "", "DEDUP_INDEX_PATH must be set")
+
+	keyNames := map[string]bool{}
+	for i, entry := range c.APIKeys {
+		name, key, found := strings.Cut(entry, ":")
+		check(found && name != "" && key != "", "API_KEYS entry %d must be in the form name:key", i+1)
+		keyNames[name] = true
+	}
+
+	for name, target := range c.Targets {
+		check(targetName.MatchString(name), "target %q: names may only contain letters, digits, - and _", name)
+		check(name != DefaultTarget, "target %q: the name is used by BUCKET_NAME", name)
+		check(target.BucketName != "", "target %q: bucketName must be set", name)
+		check(target.Region != "" || c.Region != "", "target %q: region must be set, or REGION for all targets", name)
+		check(target.CredentialsProvider == "" || oneOf(target.CredentialsProvider, CredentialsStatic, CredentialsChain),
+			"target %q: credentialsProvider must be either static or chain", name)
+		check(validEndpoint(target.Endpoint), "target %q: endpoint must be a http or https URL, or a host name", name)
+		check((target.AwsAccessKeyID == "") == (target.AwsSecretAccessKey == ""),
+			"target %q: awsAccessKeyId and awsSecretAccessKey must be set together", name)
+
+		for _, permission := range target.Permissions {
+			check(oneOf(permission, "read", "write", "delete"), "target %q: unknown permission %q, use read, write or delete", name, permission)
+		}
+
+		for _, actor := range target.Actors {
+			check(keyNames[actor], "target %q: actor %q is not an API key name", name, actor)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns the configuration as indented JSON with secrets masked
+func (c *Config) Redacted() ([]byte, error) {
+	return json.MarshalIndent(c.redacted(), "", "  ")
+}
+
+// redacted returns a copy of the configuration with secrets masked
+func (c *Config) redacted() *Config {
+	redacted := *c
+	redactFields(reflect.ValueOf(&redacted).Elem())
+
+	return &redacted
+}
+
+// redactFields masks the secret fields of a struct, maps and lists of structs are redacted entry by entry
+func redactFields(target reflect.Value) {
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Field(i)
+
+		switch {
+		case target.Type().Field(i).Tag.Get("secret") == "true":
+			redact(field)
+		case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.Struct && !field.IsNil():
+			masked := reflect.MakeMap(field.Type())
+			for _, key := range field.MapKeys() {
+				entry := reflect.New(field.Type().Elem()).Elem()
+				entry.Set(field.MapIndex(key))
+				redactFields(entry)
+				masked.SetMapIndex(key, entry)
+			}
+			field.Set(masked)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct && !field.IsNil():
+			masked := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			reflect.Copy(masked, field)
+			for j := 0; j < masked.Len(); j++ {
+				redactFields(masked.Index(j))
+			}
+			field.Set(masked)
+		}
+	}
+}
+
+// redact masks a secret value, only the names of API keys are kept
+func redact(field reflect.Value) {
+	switch field.Kind() {
+	case reflect.String:
+		if field.String() != "" {
+			field.SetString("REDACTED")
+		}
+	case reflect.Slice:
+		masked := make([]string, field.Len())
+		for i := range masked {
+			name, _, _ := strings.Cut(field.Index(i).String(), ":")
+			masked[i] = name + ":REDACTED"
+		}
+		field.Set(reflect.ValueOf(masked))
+	}
+}
+
+// validEndpoint accepts an empty endpoint, a http(s) URL or a bare host with an optional port
+func validEndpoint(endpoint string) bool {
+	if endpoint == "" {
+		return true
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	parsed, err := url.Parse(endpoint)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// validScannerAddress accepts an empty address, a unix socket path or a tcp host and port
+func validScannerAddress(address string) bool {
+	if address == "" {
+		return true
+	}
+
+	if path, found := strings.CutPrefix(address, "unix://"); found {
+		return path != ""
+	}
+
+	_, _, err := net.SplitHostPort(strings.TrimPrefix(address, "tcp://"))
+	return err == nil
+}
+
+// overlaps reports whether one key prefix contains the other
+func overlaps(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validLogLevel(level string) bool {
+	var slogLevel slog.Level
+	return slogLevel.UnmarshalText([]byte(strings.ToUpper(level))) == nil
+}
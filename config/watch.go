@@ -0,0 +1,65 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch reloads the configuration whenever the config file changes, until ctx is done.
+// The directory is watched rather than the file, so editors that replace the file are picked up too.
+func (s *Store) Watch(ctx context.Context) error {
+	if s.options.File == "" {
+		return nil
+	}
+
+	path, err := filepath.Abs(s.options.File)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// fires once the file has been quiet for reloadDelay
+		timer := time.NewTimer(reloadDelay)
+		timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					timer.Reset(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Config file watcher failed", "error", err)
+			case <-timer.C:
+				s.Reload("file changed")
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import "strings"
+
+// Webhook receives file events as signed POST requests
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty" secret:"true"` // HMAC key for the X-Webhook-Signature header
+	Events []string `json:"events,omitempty"`               // event types to send, empty sends all of them
+	Prefix string   `json:"prefix,omitempty"`               // only events for keys below this prefix
+	Target string   `json:"target,omitempty"`               // only events of this storage target, empty sends those of all targets
+}
+
+// Webhook finds a configured webhook by its URL
+func (c *Config) Webhook(url string) (Webhook, bool) {
+	for _, webhook := range c.Webhooks {
+		if webhook.URL == url {
+			return webhook, true
+		}
+	}
+
+	return Webhook{}, false
+}
+
+// Matches reports whether the webhook wants an event of eventType in target for one of keys
+func (w Webhook) Matches(eventType, target string, keys ...string) bool {
+	if len(w.Events) > 0 && !contains(w.Events, eventType) {
+		return false
+	}
+
+	if w.Target != "" && w.Target != target {
+		return false
+	}
+
+	for _, key := range keys {
+		if key != "" && strings.HasPrefix(key, w.Prefix) {
+			return true
+		}
+	}
+
+	return false
+}
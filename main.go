@@ -1,91 +1,279 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"file-management-service/config"
+	"file-management-service/pkg/audit"
 	"file-management-service/pkg/cache"
+	"file-management-service/pkg/dedup"
+	"file-management-service/pkg/duplicates"
+	"file-management-service/pkg/events"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/metrics"
+	"file-management-service/pkg/s3"
+	"file-management-service/pkg/thumbnail"
+	"file-management-service/pkg/tracing"
 	"file-management-service/routes"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 )
 
-// Global variable to hold the configuration
-var AppConfig *config.Config
+// Global variable to hold the configuration, reloaded on SIGHUP and config file changes
+var AppConfig *config.Store
 
-func getPort() string {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = ":8080"
-	} else {
-		port = ":" + port
-	}
-
-	return port
+// fatal logs err and exits, deferred functions do not run
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
 }
 
 func main() {
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
 
 	// load .env file
-	err := godotenv.Load(".env")
+	envErr := godotenv.Load(".env")
 
+	settings, options, err := config.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		fmt.Println("Error loading environment variables")
-	}
-
-	log.SetOutput(os.Stderr)
-	// Apply rate limiter middleware
-	rateLimiterConfig := middleware.RateLimiterConfig{
-		Skipper: middleware.DefaultSkipper,
-		Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-			middleware.RateLimiterMemoryStoreConfig{Rate: 10, Burst: 30, ExpiresIn: 3 * time.Minute},
-		),
-		IdentifierExtractor: func(ctx echo.Context) (string, error) {
-			id := ctx.RealIP()
-			return id, nil
-		},
-		ErrorHandler: func(context echo.Context, err error) error {
-			return context.JSON(http.StatusForbidden, nil)
-		},
-		DenyHandler: func(context echo.Context, identifier string, err error) error {
-			return context.JSON(http.StatusTooManyRequests, nil)
-		},
-	}
-
-	// Apply rate limiter middleware
-	e.Use(middleware.RateLimiterWithConfig(rateLimiterConfig))
+		fatal("Failed to load configuration", err)
+	}
+
+	if options.PrintConfig {
+		redacted, err := settings.Redacted()
+		if err != nil {
+			fatal("Failed to print configuration", err)
+		}
+		fmt.Println(string(redacted))
+		return
+	}
+
+	// Assign the configuration to the global variable
+	AppConfig = config.NewStore(settings, options, os.Args[1:])
+
+	// Structured JSON logs, the standard log package goes through the same logger
+	appLogger, logCloser, err := logger.New(settings.LogOutput, settings.LogFile, int64(settings.LogMaxSize)*1024*1024, settings.LogLevel)
+	if err != nil {
+		fatal("Failed to set up logging", err)
+	}
+	defer logCloser.Close()
+	slog.SetDefault(appLogger)
+
+	if envErr != nil {
+		slog.Warn("Error loading environment variables", "error", envErr)
+	}
+
+	// Every response carries an X-Request-ID, errors are sent in the same format as the handlers
+	e.Use(middleware.RequestID())
+	e.HTTPErrorHandler = routes.ErrorHandler
+
+	// Log every request with its request ID, handlers log through the same request logger
+	e.Use(logger.Middleware(appLogger))
+
+	// Start a span for every request, continuing the trace from incoming W3C headers
+	e.Use(otelecho.Middleware(tracing.ServiceName))
+
+	// Count requests and latency per route, before the rate limiter so rejections are counted too
+	e.Use(metrics.Middleware())
+
+	// Apply rate limiter middleware, the limits follow config reloads
+	e.Use(routes.RateLimiter(AppConfig))
 
 	// Apply CORS middleware
-	e.Use(middleware.CORS())
+	e.Use(routes.CORS(AppConfig))
+
+	// Reject oversized request bodies before they are read, with the limit of the current configuration
+	e.Use(routes.BodyLimit(AppConfig))
 
-	config, err := config.LoadConfig()
+	// Export spans to an OTLP collector or a local file
+	shutdownTracing, err := tracing.Setup(context.Background(), settings.TracingExporter, settings.TracingFile)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %s", err)
+		fatal("Failed to set up tracing", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	// Assign the configuration to the global variable
-	AppConfig = config
+	// expired entries are cleared every 5 minutes, the LRU bound keeps the memory in check
+	urlCache, err := cache.New(settings.CacheBackend, settings.CacheMaxEntries, settings.CacheDir, 5*time.Minute)
+	if err != nil {
+		fatal("Failed to create cache", err)
+	}
+	defer urlCache.Close()
+	metrics.RegisterCache("urls", urlCache.Stats)
+
+	// listing pages are only cached when a ttl is configured
+	var listCache *s3.ListingCache
+	if settings.ListCacheTTL > 0 {
+		listStore, err := cache.New(settings.CacheBackend, settings.ListCacheMaxEntries, filepath.Join(settings.CacheDir, "listings"), 5*time.Minute)
+		if err != nil {
+			fatal("Failed to create listing cache", err)
+		}
+		defer listStore.Close()
 
-	cache := cache.NewURLCache()
+		metrics.RegisterCache("listings", listStore.Stats)
+		listCache = s3.NewListingCache(listStore,
+			time.Duration(settings.ListCacheTTL)*time.Second,
+			time.Duration(settings.ListCacheStaleTTL)*time.Second,
+		)
+		defer listCache.Close()
+	}
+
+	// Record every file operation in the audit trail
+	auditLog, err := audit.NewLogger(settings.AuditLogPath, int64(settings.AuditLogMaxSize)*1024*1024)
+	if err != nil {
+		fatal("Failed to open audit log", err)
+	}
+	defer auditLog.Close()
+
+	e.Use(audit.Middleware(auditLog))
+
+	// Check API keys after the audit middleware so rejected requests are audited too
+	e.Use(routes.APIKeyAuth(AppConfig))
+
+	// File events go to the configured webhooks, pending deliveries survive restarts in the outbox
+	deliveryLog, err := events.NewDeliveryLog(settings.WebhookLogPath, int64(settings.WebhookLogMaxSize)*1024*1024)
+	if err != nil {
+		fatal("Failed to open webhook delivery log", err)
+	}
+	defer deliveryLog.Close()
+
+	webhooks, err := events.NewDispatcher(AppConfig, settings.WebhookOutboxDir, deliveryLog)
+	if err != nil {
+		fatal("Failed to open webhook outbox", err)
+	}
+	defer webhooks.Close()
+
+	// Live subscribers of /events get the same events
+	feed := events.NewFeed()
+
+	bus := events.NewBus()
+	bus.Subscribe(webhooks.Enqueue)
+	bus.Subscribe(feed.Publish)
+
+	// Thumbnails are stored next to the originals below a hidden prefix
+	thumbnails := thumbnail.New(settings.ThumbnailPrefix, int64(settings.ThumbnailMaxSource)<<20)
+	defer thumbnails.Close()
+
+	// References of deduplicated uploads, read even with deduplication off so existing references resolve
+	dedupIndex, err := dedup.Open(settings.DedupIndexPath)
+	if err != nil {
+		fatal("Failed to open the dedup index", err)
+	}
+	defer dedupIndex.Close()
+
+	// Only one index may count the references to the shared content of a bucket, a second instance stops here
+	if settings.DedupEnabled {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		for _, name := range settings.TargetNames() {
+			target, err := settings.Target(name)
+			if err != nil {
+				fatal("Failed to resolve storage target", err)
+			}
+
+			client, err := s3.NewClient(settings, target)
+			if err != nil {
+				fatal("Failed to create S3 client", err)
+			}
+
+			client.UseDedup(dedupIndex)
+			if err := client.ClaimDedup(ctx); err != nil {
+				fatal("Failed to claim the shared content of "+name, err)
+			}
+		}
+		cancel()
+	}
+
+	// Duplicate scans run in the background and are stopped on shutdown
+	finder := duplicates.New()
+	defer finder.Close()
+
+	// Readiness is cleared as soon as shutdown starts
+	var ready atomic.Bool
+	ready.Store(true)
+
+	// Register routes
+	routes.RegisterRoutes(e, routes.Services{
+		Config:     AppConfig,
+		Cache:      urlCache,
+		ListCache:  listCache,
+		AuditLog:   auditLog,
+		Events:     bus,
+		Webhooks:   webhooks,
+		Feed:       feed,
+		Thumbnails: thumbnails,
+		Dedup:      dedupIndex,
+		Duplicates: finder,
+		Ready:      &ready,
+	})
+
+	// Stop on SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Reload the configuration when the config file changes or on SIGHUP
+	if err := AppConfig.Watch(ctx); err != nil {
+		slog.Warn("Failed to watch the config file, reload with SIGHUP instead", "error", err)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
 
-	// spawn a goroutine to clear the cache every 5 minutes
 	go func() {
-		for {
-			time.Sleep(5 * time.Minute)
-			cache.Clear()
+		for range hangup {
+			AppConfig.Reload("SIGHUP")
 		}
 	}()
 
-	// Register routes
-	routes.RegisterRoutes(e, AppConfig, cache)
+	// Start the server, Start blocks until the server stops
+	serverErr := make(chan error, 1)
+	address := fmt.Sprintf(":%d", settings.Port)
+	go func() {
+		slog.Info("Server starting", "address", address)
+		serverErr <- e.Start(address)
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server stopped", "error", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	// Fail readiness first and keep serving while load balancers take the instance out of rotation
+	slog.Info("Shutting down", "delay", AppConfig.Get().ShutdownDelay, "timeout", AppConfig.Get().ShutdownTimeout)
+	ready.Store(false)
+	time.Sleep(time.Duration(AppConfig.Get().ShutdownDelay) * time.Second)
+
+	// Drain in-flight requests, background workers are stopped by the deferred calls above.
+	// Event streams never end on their own, close them so they do not hold up the shutdown
+	feed.Close()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(AppConfig.Get().ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain connections", "error", err)
+	}
 
-	// Start the server
-	e.Start(getPort())
-	log.Println("Server Started!!!")
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,130 @@
+package apperror
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates an error with the given status and code
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// BadRequest is returned for invalid input from the client
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, CodeValidationFailed, message)
+}
+
+// Unauthorized is returned when the client did not authenticate
+func Unauthorized(message string) *Error {
+	return New(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+// Forbidden is returned when the client may not perform the operation
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, CodeAccessDenied, message)
+}
+
+// NotFound is returned when the requested object does not exist
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, CodeObjectNotFound, message)
+}
+
+// Conflict is returned when the operation clashes with the current state, e.g. an existing key
+func Conflict(message string) *Error {
+	return New(http.StatusConflict, CodeConflict, message)
+}
+
+// TooLarge is returned when the content exceeds a size limit
+func TooLarge(message string) *Error {
+	return New(http.StatusRequestEntityTooLarge, CodeTooLarge, message)
+}
+
+// UnsupportedMedia is returned when the content is not of a type the operation handles
+func UnsupportedMedia(message string) *Error {
+	return New(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, message)
+}
+
+// Internal wraps an unexpected error, its message is appended to the given one
+func Internal(message string, err error) *Error {
+	if err != nil {
+		message = message + ": " + err.Error()
+	}
+
+	return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: message, Err: err}
+}
+
+// From converts any error into an *Error. Errors that already are one are returned as is,
+// AWS errors anywhere in the chain are mapped to a matching status, everything else is a 500.
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+
+	status, code := http.StatusInternalServerError, CodeInternal
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		status, code = fromAWSCode(awsErr.Code())
+
+		// unknown codes fall back to the HTTP status S3 answered with
+		var failure awserr.RequestFailure
+		if code == CodeInternal && errors.As(err, &failure) {
+			status, code = fromAWSStatus(failure.StatusCode())
+		}
+	}
+
+	return &Error{Status: status, Code: code, Message: err.Error(), Err: err}
+}
+
+func fromAWSCode(code string) (int, string) {
+	switch code {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return http.StatusNotFound, CodeObjectNotFound
+	case s3.ErrCodeNoSuchBucket:
+		return http.StatusNotFound, CodeBucketNotFound
+	case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return http.StatusForbidden, CodeAccessDenied
+	case "SlowDown", "Throttling", "TooManyRequests":
+		return http.StatusTooManyRequests, CodeRateLimited
+	case "PreconditionFailed", "OperationAborted", s3.ErrCodeBucketAlreadyOwnedByYou:
+		return http.StatusConflict, CodeConflict
+	case "InvalidArgument", "InvalidRequest", "KeyTooLongError", "EntityTooLarge":
+		return http.StatusBadRequest, CodeValidationFailed
+	case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, request.ErrCodeRead,
+		"ServiceUnavailable", "RequestTimeout", "InternalError":
+		return http.StatusServiceUnavailable, CodeUnavailable
+	}
+
+	return http.StatusInternalServerError, CodeInternal
+}
+
+func fromAWSStatus(status int) (int, string) {
+	switch {
+	case status == http.StatusNotFound:
+		return http.StatusNotFound, CodeNotFound
+	case status == http.StatusForbidden:
+		return http.StatusForbidden, CodeAccessDenied
+	case status == http.StatusConflict || status == http.StatusPreconditionFailed:
+		return http.StatusConflict, CodeConflict
+	case status == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests, CodeRateLimited
+	case status >= 500:
+		return http.StatusServiceUnavailable, CodeUnavailable
+	}
+
+	return http.StatusInternalServerError, CodeInternal
+}
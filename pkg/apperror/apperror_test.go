@@ -0,0 +1,71 @@
+package apperror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestFrom(t *testing.T) {
+	failure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "request-id")
+	}
+
+	for name, test := range map[string]struct {
+		err    error
+		status int
+		code   string
+	}{
+		"no such key":        {failure(s3.ErrCodeNoSuchKey, 404), http.StatusNotFound, CodeObjectNotFound},
+		"head not found":     {failure("NotFound", 404), http.StatusNotFound, CodeObjectNotFound},
+		"no such bucket":     {failure(s3.ErrCodeNoSuchBucket, 404), http.StatusNotFound, CodeBucketNotFound},
+		"access denied":      {failure("AccessDenied", 403), http.StatusForbidden, CodeAccessDenied},
+		"bad signature":      {failure("SignatureDoesNotMatch", 403), http.StatusForbidden, CodeAccessDenied},
+		"slow down":          {failure("SlowDown", 503), http.StatusTooManyRequests, CodeRateLimited},
+		"precondition":       {failure("PreconditionFailed", 412), http.StatusConflict, CodeConflict},
+		"invalid argument":   {failure("InvalidArgument", 400), http.StatusBadRequest, CodeValidationFailed},
+		"too large":          {failure("EntityTooLarge", 400), http.StatusBadRequest, CodeValidationFailed},
+		"internal error":     {failure("InternalError", 500), http.StatusServiceUnavailable, CodeUnavailable},
+		"connection refused": {awserr.New(request.ErrCodeRequestError, "send request failed", nil), http.StatusServiceUnavailable, CodeUnavailable},
+
+		// codes without a mapping fall back to the status S3 answered with
+		"unknown 404":     {failure("Gone", 404), http.StatusNotFound, CodeNotFound},
+		"unknown 403":     {failure("Nope", 403), http.StatusForbidden, CodeAccessDenied},
+		"unknown 412":     {failure("Nope", 412), http.StatusConflict, CodeConflict},
+		"unknown 429":     {failure("Nope", 429), http.StatusTooManyRequests, CodeRateLimited},
+		"unknown 502":     {failure("Nope", 502), http.StatusServiceUnavailable, CodeUnavailable},
+		"unknown 400":     {failure("Nope", 400), http.StatusInternalServerError, CodeInternal},
+		"unknown no body": {awserr.New("Nope", "message", nil), http.StatusInternalServerError, CodeInternal},
+
+		"wrapped aws error": {fmt.Errorf("upload: %w", failure(s3.ErrCodeNoSuchKey, 404)), http.StatusNotFound, CodeObjectNotFound},
+		"app error":         {Conflict("exists"), http.StatusConflict, CodeConflict},
+		"wrapped app error": {fmt.Errorf("move: %w", TooLarge("too big")), http.StatusRequestEntityTooLarge, CodeTooLarge},
+		"plain error":       {errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	} {
+		err := From(test.err)
+		if err.Status != test.status || err.Code != test.code {
+			t.Errorf("%s: got %d %s, want %d %s", name, err.Status, err.Code, test.status, test.code)
+		}
+		if !errors.Is(err, test.err) && !errors.Is(test.err, err) {
+			t.Errorf("%s: the original error is lost", name)
+		}
+	}
+}
+
+func TestInternal(t *testing.T) {
+	cause := errors.New("disk full")
+	err := Internal("Failed to save", cause)
+
+	if err.Status != http.StatusInternalServerError || err.Message != "Failed to save: disk full" || !errors.Is(err, cause) {
+		t.Errorf("got %d %q", err.Status, err.Message)
+	}
+
+	if err := Internal("Failed to save", nil); err.Message != "Failed to save" {
+		t.Errorf("without a cause: %q", err.Message)
+	}
+}
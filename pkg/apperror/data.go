@@ -0,0 +1,20 @@
+package apperror
+
+// machine readable error codes returned in FailureResponse.ErrorCode
+const (
+	CodeValidationFailed = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeAccessDenied     = "access_denied"
+	CodeObjectNotFound   = "object_not_found"
+	CodeBucketNotFound   = "bucket_not_found"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeChecksumMismatch = "checksum_mismatch"
+	CodeTooLarge         = "too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeMalwareDetected  = "malware_detected"
+	CodeRateLimited      = "rate_limited"
+	CodeUnavailable      = "storage_unavailable"
+	CodeScanUnavailable  = "scanner_unavailable"
+	CodeInternal         = "internal_error"
+)
@@ -0,0 +1,9 @@
+package apperror
+
+// Error is an error with the HTTP status and machine readable code sent to the client
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
@@ -0,0 +1,220 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"file-management-service/pkg/rotate"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewLogger opens the audit log at path, it is rotated after maxSize bytes and every day
+func NewLogger(path string, maxSize int64) (*Logger, error) {
+	writer, err := rotate.New(path, maxSize, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{path: path, writer: writer}, nil
+}
+
+// Log appends an entry to the audit trail
+func (l *Logger) Log(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (l *Logger) Close() error {
+	return l.writer.Close()
+}
+
+// Search returns the entries matching query, newest first. Rotated files are searched too.
+func (l *Logger) Search(query Query) ([]Entry, error) {
+	files, err := rotate.Files(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+
+	// walk the files newest first so the limit keeps the latest entries
+	for i := len(files) - 1; i >= 0; i-- {
+		matches, err := searchFile(files[i], query)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := len(matches) - 1; j >= 0; j-- {
+			entries = append(entries, matches[j])
+			if query.Limit > 0 && len(entries) >= query.Limit {
+				return entries, nil
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// Middleware records an entry for every audited route once the handler has answered
+func Middleware(logger *Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			operation, audited := operations[c.Path()]
+			if !audited {
+				return next(c)
+			}
+
+			start := time.Now()
+
+			// let echo write the error response first so the final status is known
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+				SetError(c, err)
+			}
+
+			entry := Entry{
+				Time:      start.UTC(),
+				RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+				Actor:     Actor(c),
+				Claimed:   ClaimedActor(c),
+				IP:        c.RealIP(),
+				Operation: operation,
+				Keys:      keys(c),
+				Result:    ResultSuccess,
+				Status:    c.Response().Status,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+
+			entry.Target, _ = c.Get(targetKey).(string)
+
+			if bytes, ok := c.Get(bytesKey).(int64); ok {
+				entry.Bytes = bytes
+			}
+
+			if entry.Status >= 400 {
+				entry.Result = ResultFailure
+				entry.Error, _ = c.Get(errorKey).(string)
+			}
+
+			if logErr := logger.Log(entry); logErr != nil {
+				c.Logger().Error("Failed to write audit log: ", logErr)
+			}
+
+			return nil
+		}
+	}
+}
+
+// SetTarget records the storage target an operation used
+func SetTarget(c echo.Context, target string) {
+	c.Set(targetKey, target)
+}
+
+// SetKeys records the object keys an operation touched, by default the path query parameter is used
+func SetKeys(c echo.Context, keys ...string) {
+	c.Set(keysKey, keys)
+}
+
+// AddBytes adds to the number of bytes transferred by an operation
+func AddBytes(c echo.Context, bytes int64) {
+	total, _ := c.Get(bytesKey).(int64)
+	c.Set(bytesKey, total+bytes)
+}
+
+// SetError records why an operation failed
+func SetError(c echo.Context, err error) {
+	c.Set(errorKey, err.Error())
+}
+
+// Actor returns who made the request: the name of the API key it was authenticated with, or anonymous
+func Actor(c echo.Context) string {
+	if actor, ok := c.Get(ActorKey).(string); ok && actor != "" {
+		return actor
+	}
+
+	return "anonymous"
+}
+
+// ClaimedActor returns the caller named in the X-Actor header. Clients set it freely, so it is
+// recorded next to the actor and never in its place.
+func ClaimedActor(c echo.Context) string {
+	return c.Request().Header.Get(ActorHeader)
+}
+
+func keys(c echo.Context) []string {
+	if keys, ok := c.Get(keysKey).([]string); ok {
+		return keys
+	}
+
+	var keys []string
+	for _, param := range []string{"path", "from", "to"} {
+		if value := c.QueryParam(param); value != "" {
+			keys = append(keys, value)
+		}
+	}
+
+	return keys
+}
+
+func searchFile(path string, query Query) ([]Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matches []Entry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // skip partially written lines
+		}
+
+		if query.matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+
+	return matches, scanner.Err()
+}
+
+func (q Query) matches(entry Entry) bool {
+	if q.Actor != "" && entry.Actor != q.Actor {
+		return false
+	}
+
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && entry.Time.After(q.To) {
+		return false
+	}
+
+	if q.Prefix == "" {
+		return true
+	}
+
+	for _, key := range entry.Keys {
+		if strings.HasPrefix(key, q.Prefix) {
+			return true
+		}
+	}
+
+	return false
+}
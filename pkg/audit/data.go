@@ -0,0 +1,33 @@
+package audit
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// keys used to pass audit details from the handlers to the middleware
+const (
+	ActorKey  = "audit.actor"
+	keysKey   = "audit.keys"
+	targetKey = "audit.target"
+	bytesKey  = "audit.bytes"
+	errorKey  = "audit.error"
+)
+
+// ActorHeader names the caller as the client claims it, recorded apart from the authenticated actor
+const ActorHeader = "X-Actor"
+
+// operations maps the audited routes to their operation name, other routes are not audited
+var operations = map[string]string{
+	"/upload":            "upload",
+	"/upload-multiple":   "upload",
+	"/download":          "download_link",
+	"/thumbnail":         "thumbnail",
+	"/delete":            "delete",
+	"/delete-folder":     "delete_folder",
+	"/create-folder":     "create_folder",
+	"/move":              "move",
+	"/list":              "list",
+	"/duplicates/delete": "delete_duplicates",
+	"/metadata/update":   "update_metadata",
+}
@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"file-management-service/pkg/rotate"
+	"time"
+)
+
+// Entry is a single line of the audit trail
+type Entry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Actor     string    `json:"actor"`                  // name of the API key, anonymous without one
+	Claimed   string    `json:"claimedActor,omitempty"` // X-Actor header, unverified
+	IP        string    `json:"ip"`
+	Operation string    `json:"operation"`
+	Target    string    `json:"target,omitempty"`
+	Keys      []string  `json:"keys,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Result    string    `json:"result"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latencyMs"`
+}
+
+// Logger appends entries as JSON lines to a rotating file
+type Logger struct {
+	path   string
+	writer *rotate.Writer
+}
+
+// Query filters the audit trail, zero values match everything
+type Query struct {
+	Actor  string
+	Prefix string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
@@ -1,46 +1,80 @@
 package cache
 
 import (
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
-func NewURLCache() *URLCache {
-	return &URLCache{
-		cache: make(map[string]CacheEntry),
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+)
+
+// New creates a cache for the given backend, expired entries are removed every cleanupInterval
+func New(backend string, maxEntries int, dir string, cleanupInterval time.Duration) (Cache, error) {
+	switch backend {
+	case "", BackendMemory:
+		return NewLRUCache(maxEntries, cleanupInterval), nil
+	case BackendFile:
+		return NewFileCache(dir, cleanupInterval)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", backend)
 	}
 }
 
-func (c *URLCache) Get(key string) (string, bool) {
-	c.mutex.RLock()
-	entry, found := c.cache[key]
-	c.mutex.RUnlock()
+// GetJSON decodes a cached JSON value into v, entries that fail to decode count as a miss
+func GetJSON(c Cache, key string, v interface{}) (CacheEntry, bool) {
+	entry, found := c.Get(key)
+	if !found {
+		return CacheEntry{}, false
+	}
 
-	if found && time.Now().Before(entry.ExpiryTime) {
-		return entry.URL, true
+	if err := json.Unmarshal(entry.Value, v); err != nil {
+		c.Delete(key)
+		return CacheEntry{}, false
 	}
 
-	return "", false
+	return entry, true
 }
 
-func (c *URLCache) Set(key string, url string, expiry time.Time) {
-	c.mutex.Lock()
-	c.cache[key] = CacheEntry{
-		URL:        url,
-		ExpiryTime: expiry,
+// SetJSON encodes v as JSON and caches it until expiry
+func SetJSON(c Cache, key string, v interface{}, expiry time.Time) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
 
-	c.mutex.Unlock()
+	c.Set(key, value, expiry)
+	return nil
 }
 
-// run a cron job to clear the cache every 5 minutes
-func (c *URLCache) Clear() {
-	c.mutex.Lock()
-	for key, entry := range c.cache {
-		if time.Now().After(entry.ExpiryTime) {
-			delete(c.cache, key)
-		}
+// start runs clear every interval until the janitor is stopped
+func (j *janitor) start(interval time.Duration, clear func()) {
+	j.stop = make(chan struct{})
+	if interval <= 0 {
+		return
 	}
-	c.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				clear()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
 }
 
-// Path: pkg\cache\types.go
+func (j *janitor) close() {
+	j.once.Do(func() {
+		if j.stop != nil {
+			close(j.stop)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backends returns a cache of every backend, closed when the test ends
+func backends(t *testing.T) map[string]Cache {
+	file, err := NewFileCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caches := map[string]Cache{BackendMemory: NewLRUCache(0, 0), BackendFile: file}
+	for _, c := range caches {
+		c := c
+		t.Cleanup(func() { c.Close() })
+	}
+
+	return caches
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(2, 0)
+	defer c.Close()
+
+	expiry := time.Now().Add(time.Hour)
+	c.Set("a", []byte("1"), expiry)
+	c.Set("b", []byte("2"), expiry)
+	c.Get("a")
+	c.Set("c", []byte("3"), expiry)
+
+	if _, found := c.Get("b"); found {
+		t.Error("b was kept although it was used least recently")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := c.Get(key); !found {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	if stats := c.Stats(); stats.Size != 2 || stats.Evictions != 1 || stats.MaxEntries != 2 {
+		t.Errorf("stats %+v, want 2 entries of at most 2 and 1 eviction", stats)
+	}
+}
+
+func TestExpiredEntriesAreEvicted(t *testing.T) {
+	for backend, c := range backends(t) {
+		c.Set("expired", []byte("1"), time.Now().Add(-time.Second))
+		c.Set("cleared", []byte("2"), time.Now().Add(-time.Second))
+		c.Set("fresh", []byte("3"), time.Now().Add(time.Hour))
+
+		if _, found := c.Get("expired"); found {
+			t.Errorf("%s: an expired entry was found", backend)
+		}
+
+		c.Clear()
+		if stats := c.Stats(); stats.Size != 1 || stats.Evictions != 2 || stats.Hits != 0 || stats.Misses != 1 {
+			t.Errorf("%s: stats %+v, want 1 entry, 2 evictions and 1 miss", backend, stats)
+		}
+
+		if entry, found := c.Get("fresh"); !found || string(entry.Value) != "3" {
+			t.Errorf("%s: fresh entry %q, %v", backend, entry.Value, found)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	for backend, c := range backends(t) {
+		expiry := time.Now().Add(time.Hour)
+		for _, key := range []string{"default:docs/a.txt", "default:docs/b.txt", "default:docs2/c.txt", "archive:docs/a.txt"} {
+			c.Set(key, []byte(key), expiry)
+		}
+
+		c.DeletePrefix("default:docs/")
+
+		var kept []string
+		for _, key := range []string{"default:docs/a.txt", "default:docs/b.txt", "default:docs2/c.txt", "archive:docs/a.txt"} {
+			if _, found := c.Get(key); found {
+				kept = append(kept, key)
+			}
+		}
+		sort.Strings(kept)
+
+		if strings.Join(kept, ",") != "archive:docs/a.txt,default:docs2/c.txt" {
+			t.Errorf("%s: kept %v", backend, kept)
+		}
+		if size := c.Stats().Size; size != 2 {
+			t.Errorf("%s: %d entries left, want 2", backend, size)
+		}
+	}
+}
+
+func TestFileCacheSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewFileCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("default:a.txt", []byte("url"), time.Now().Add(time.Hour))
+	c.Set("default:b.txt", []byte("url"), time.Now().Add(time.Hour))
+	c.Close()
+
+	reopened, err := NewFileCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if entry, found := reopened.Get("default:a.txt"); !found || string(entry.Value) != "url" {
+		t.Errorf("entry after reopening: %q, %v", entry.Value, found)
+	}
+
+	// the index was built from the files, so entries written before are found by prefix too
+	reopened.DeletePrefix("default:b")
+	if _, found := reopened.Get("default:b.txt"); found {
+		t.Error("entry written before reopening was not deleted by prefix")
+	}
+	if size := reopened.Stats().Size; size != 1 {
+		t.Errorf("%d entries, want 1", size)
+	}
+}
+
+// entries written by another replica sharing the directory are picked up
+func TestFileCacheSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewFileCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	other, err := NewFileCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	other.Set("default:a.txt", []byte("url"), time.Now().Add(time.Hour))
+	c.DeletePrefix("default:")
+
+	if _, found := other.Get("default:a.txt"); found {
+		t.Error("entry of the other replica was not deleted")
+	}
+
+	// files that cannot be read are cleared
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.Clear()
+	if _, err := os.Stat(filepath.Join(dir, "broken.json")); !os.IsNotExist(err) {
+		t.Errorf("broken entry file was kept: %v", err)
+	}
+}
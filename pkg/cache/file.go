@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NewFileCache creates a cache that keeps one file per entry inside dir. The entries already
+// in dir are read once to index their keys.
+func NewFileCache(dir string, cleanupInterval time.Duration) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	c := &FileCache{dir: dir, index: map[string]fileIndexEntry{}}
+	c.sync()
+
+	c.janitor.start(cleanupInterval, c.Clear)
+	return c, nil
+}
+
+func (c *FileCache) Get(key string) (CacheEntry, bool) {
+	name := c.name(key)
+	item, err := c.read(name)
+
+	// a hash collision shows up as a different key stored in the file
+	if err != nil || item.Key != key {
+		c.misses.Add(1)
+		return CacheEntry{}, false
+	}
+
+	if !time.Now().Before(item.ExpiryTime) {
+		c.remove(name)
+		c.evictions.Add(1)
+		c.misses.Add(1)
+		return CacheEntry{}, false
+	}
+
+	c.hits.Add(1)
+	return item.CacheEntry, true
+}
+
+func (c *FileCache) Set(key string, value []byte, expiry time.Time) {
+	data, err := json.Marshal(fileItem{
+		Key:        key,
+		CacheEntry: CacheEntry{Value: value, ExpiryTime: expiry},
+	})
+	if err != nil {
+		return
+	}
+
+	// write to a temporary file and rename it so readers never see a partial entry
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	name := c.name(key)
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.mutex.Lock()
+	c.index[name] = fileIndexEntry{key: key, expiry: expiry}
+	c.mutex.Unlock()
+}
+
+func (c *FileCache) Delete(key string) {
+	c.remove(c.name(key))
+}
+
+// DeletePrefix removes every entry whose key starts with prefix. Keys come from the index, the
+// directory is only listed to pick up entries other replicas wrote.
+func (c *FileCache) DeletePrefix(prefix string) {
+	c.sync()
+
+	var names []string
+	c.mutex.Lock()
+	for name, entry := range c.index {
+		if strings.HasPrefix(entry.key, prefix) {
+			names = append(names, name)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, name := range names {
+		c.remove(name)
+	}
+}
+
+// Clear removes all expired entries, it runs periodically when a cleanup interval is set.
+// Entries the index holds as expired are read again first, another replica may have renewed them.
+func (c *FileCache) Clear() {
+	c.sync()
+
+	now := time.Now()
+	var expired []string
+	c.mutex.Lock()
+	for name, entry := range c.index {
+		if now.After(entry.expiry) {
+			expired = append(expired, name)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, name := range expired {
+		item, err := c.read(name)
+		if err == nil && !now.After(item.ExpiryTime) {
+			c.mutex.Lock()
+			c.index[name] = fileIndexEntry{key: item.Key, expiry: item.ExpiryTime}
+			c.mutex.Unlock()
+			continue
+		}
+
+		c.remove(name)
+		c.evictions.Add(1)
+	}
+}
+
+// Stats counts the entries in the index, entries other replicas wrote since the last
+// DeletePrefix or Clear are not counted yet
+func (c *FileCache) Stats() Stats {
+	c.mutex.Lock()
+	size := len(c.index)
+	c.mutex.Unlock()
+
+	return Stats{
+		Backend:   BackendFile,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+	}
+}
+
+// Close stops the cleanup goroutine, the entries stay on disk
+func (c *FileCache) Close() error {
+	c.janitor.close()
+	return nil
+}
+
+// name maps a key to a file name, keys are hashed since they contain slashes
+func (c *FileCache) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+func (c *FileCache) read(name string) (fileItem, error) {
+	var item fileItem
+
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return item, err
+	}
+
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+func (c *FileCache) remove(name string) {
+	os.Remove(filepath.Join(c.dir, name))
+
+	c.mutex.Lock()
+	delete(c.index, name)
+	c.mutex.Unlock()
+}
+
+// sync matches the index with the entry files in the directory. Only files it does not know yet
+// are read, files that cannot be read are indexed as expired so Clear removes them. Temporary files
+// that are still being written are skipped.
+func (c *FileCache) sync() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	present := make(map[string]bool, len(entries))
+	var unknown []string
+
+	c.mutex.Lock()
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+
+		present[entry.Name()] = true
+		if _, found := c.index[entry.Name()]; !found {
+			unknown = append(unknown, entry.Name())
+		}
+	}
+
+	for name := range c.index {
+		if !present[name] {
+			delete(c.index, name)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, name := range unknown {
+		item, _ := c.read(name)
+
+		c.mutex.Lock()
+		c.index[name] = fileIndexEntry{key: item.Key, expiry: item.ExpiryTime}
+		c.mutex.Unlock()
+	}
+}
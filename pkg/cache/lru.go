@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"time"
+)
+
+// NewLRUCache creates an in-memory cache holding at most maxEntries entries, zero means unbounded
+func NewLRUCache(maxEntries int, cleanupInterval time.Duration) *LRUCache {
+	c := &LRUCache{
+		maxEntries: maxEntries,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+	}
+
+	c.janitor.start(cleanupInterval, c.Clear)
+	return c
+}
+
+func (c *LRUCache) Get(key string) (CacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.items[key]
+	if !found {
+		c.misses.Add(1)
+		return CacheEntry{}, false
+	}
+
+	item := element.Value.(*lruItem)
+	if !time.Now().Before(item.entry.ExpiryTime) {
+		c.removeElement(element)
+		c.evictions.Add(1)
+		c.misses.Add(1)
+		return CacheEntry{}, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return item.entry, true
+}
+
+func (c *LRUCache) Set(key string, value []byte, expiry time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := CacheEntry{Value: value, ExpiryTime: expiry}
+
+	if element, found := c.items[key]; found {
+		element.Value.(*lruItem).entry = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruItem{key: key, entry: entry})
+
+	// evict the least recently used entries once the cache is full
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, found := c.items[key]; found {
+		c.removeElement(element)
+	}
+}
+
+// DeletePrefix removes every entry whose key starts with prefix
+func (c *LRUCache) DeletePrefix(prefix string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(element)
+		}
+	}
+}
+
+// Clear removes all expired entries, it runs periodically when a cleanup interval is set
+func (c *LRUCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for _, element := range c.items {
+		if now.After(element.Value.(*lruItem).entry.ExpiryTime) {
+			c.removeElement(element)
+			c.evictions.Add(1)
+		}
+	}
+}
+
+func (c *LRUCache) Stats() Stats {
+	c.mutex.Lock()
+	size := c.order.Len()
+	c.mutex.Unlock()
+
+	return Stats{
+		Backend:    BackendMemory,
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		Size:       size,
+		MaxEntries: c.maxEntries,
+	}
+}
+
+// Close stops the cleanup goroutine
+func (c *LRUCache) Close() error {
+	c.janitor.close()
+	return nil
+}
+
+func (c *LRUCache) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*lruItem).key)
+}
@@ -1,16 +1,87 @@
 package cache
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type URLCache struct {
-	cache map[string]CacheEntry
-	mutex sync.RWMutex
+// Cache is a key value store where every entry has its own expiry time.
+// Values are raw bytes so the same interface can hold signed URLs, listings or object metadata.
+type Cache interface {
+	Get(key string) (CacheEntry, bool)
+	Set(key string, value []byte, expiry time.Time)
+	Delete(key string)
+	DeletePrefix(prefix string)
+	Clear()
+	Stats() Stats
+	Close() error
 }
 
 type CacheEntry struct {
-	URL        string
-	ExpiryTime time.Time
+	Value      []byte    `json:"value"`
+	ExpiryTime time.Time `json:"expiryTime"`
+}
+
+// Stats holds the counters exposed by every cache implementation
+type Stats struct {
+	Backend    string `json:"backend"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	Size       int    `json:"size"`
+	MaxEntries int    `json:"maxEntries,omitempty"`
+}
+
+// LRUCache is a size bounded in-memory cache, least recently used entries are evicted first
+type LRUCache struct {
+	maxEntries int
+	items      map[string]*list.Element
+	order      *list.List
+	mutex      sync.Mutex
+
+	counters
+	janitor
+}
+
+// FileCache stores every entry as a file inside a directory, so it survives restarts
+// and can be shared between replicas mounting the same volume
+type FileCache struct {
+	dir string
+
+	// key and expiry of the entry files by file name, so the files are only read once
+	index map[string]fileIndexEntry
+	mutex sync.Mutex
+
+	counters
+	janitor
+}
+
+type lruItem struct {
+	key   string
+	entry CacheEntry
+}
+
+// fileItem is the on-disk format of a FileCache entry
+type fileItem struct {
+	Key string `json:"key"`
+	CacheEntry
+}
+
+// fileIndexEntry is what a FileCache keeps in memory about an entry file
+type fileIndexEntry struct {
+	key    string
+	expiry time.Time
+}
+
+type counters struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type janitor struct {
+	stop chan struct{}
+	once sync.Once
 }
@@ -0,0 +1,105 @@
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// New creates a client for a daemon at address, either tcp://host:port, unix:///path/to/socket
+// or a bare host:port. timeout bounds a whole scan.
+func New(address string, timeout time.Duration) (*Client, error) {
+	network, address, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{network: network, address: address, timeout: timeout}, nil
+}
+
+// ParseAddress splits a daemon address into the network and address for net.Dial
+func ParseAddress(address string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "://"):
+		return "", "", fmt.Errorf("unsupported scanner address %q, use tcp:// or unix://", address)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid scanner address %q: %w", address, err)
+	}
+
+	return "tcp", address, nil
+}
+
+// Scan sends r with the INSTREAM command and returns the verdict
+func (c *Client) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+
+	// every chunk is prefixed with its length, a zero length ends the stream
+	chunk := make([]byte, chunkSize+4)
+	for {
+		n, err := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, writeErr := conn.Write(chunk[:n+4]); writeErr != nil {
+				// the daemon hangs up once the size limit is reached, its reply says so
+				break
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return Result{}, fmt.Errorf("no reply from scanner: %w", err)
+	}
+
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseReply reads replies like "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (Result, error) {
+	verdict := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	case strings.Contains(verdict, "size limit exceeded"):
+		return Result{}, ErrTooLarge
+	}
+
+	return Result{}, fmt.Errorf("unexpected scanner reply %q", reply)
+}
@@ -0,0 +1,49 @@
+package clamd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseReply(t *testing.T) {
+	for reply, want := range map[string]Result{
+		"stream: OK":                         {},
+		"stream: Eicar-Test-Signature FOUND": {Infected: true, Signature: "Eicar-Test-Signature"},
+		"stream: Win.Test.EICAR_HDB-1 FOUND": {Infected: true, Signature: "Win.Test.EICAR_HDB-1"},
+		"OK":                                 {},
+	} {
+		got, err := parseReply(reply)
+		if err != nil || got != want {
+			t.Errorf("parseReply(%q) = %+v, %v, want %+v", reply, got, err, want)
+		}
+	}
+
+	if _, err := parseReply("INSTREAM size limit exceeded. ERROR"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("size limit: got %v, want ErrTooLarge", err)
+	}
+
+	for _, reply := range []string{"stream: Can't allocate memory ERROR", "", "UNKNOWN COMMAND"} {
+		if _, err := parseReply(reply); err == nil || errors.Is(err, ErrTooLarge) {
+			t.Errorf("parseReply(%q) = %v, want an error", reply, err)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for address, want := range map[string][2]string{
+		"tcp://127.0.0.1:3310":          {"tcp", "127.0.0.1:3310"},
+		"clamd:3310":                    {"tcp", "clamd:3310"},
+		"unix:///run/clamav/clamd.sock": {"unix", "/run/clamav/clamd.sock"},
+	} {
+		network, addr, err := ParseAddress(address)
+		if err != nil || network != want[0] || addr != want[1] {
+			t.Errorf("ParseAddress(%q) = %q, %q, %v, want %q, %q", address, network, addr, err, want[0], want[1])
+		}
+	}
+
+	for _, address := range []string{"http://clamd:3310", "clamd", "tcp://clamd"} {
+		if _, _, err := ParseAddress(address); err == nil {
+			t.Errorf("ParseAddress(%q) should fail", address)
+		}
+	}
+}
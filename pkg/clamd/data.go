@@ -0,0 +1,9 @@
+package clamd
+
+import "errors"
+
+// size of the chunks a stream is sent in, clamd accepts up to its StreamMaxLength in total
+const chunkSize = 64 * 1024
+
+// ErrTooLarge is returned when the stream exceeds the StreamMaxLength of the daemon
+var ErrTooLarge = errors.New("stream exceeds the scanner size limit")
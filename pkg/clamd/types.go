@@ -0,0 +1,16 @@
+package clamd
+
+import "time"
+
+// Client scans streams with a clamd compatible daemon
+type Client struct {
+	network string // tcp or unix
+	address string
+	timeout time.Duration
+}
+
+// Result is the verdict for one stream
+type Result struct {
+	Infected  bool
+	Signature string // name of the detected malware
+}
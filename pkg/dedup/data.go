@@ -0,0 +1,17 @@
+package dedup
+
+// journal operations
+const (
+	opLink    = "link"
+	opUnlink  = "unlink"
+	opRelease = "release"
+)
+
+// the journal and the lock file are written next to the index file with these suffixes
+const (
+	journalSuffix = ".journal"
+	lockSuffix    = ".lock"
+)
+
+// changes appended to the journal before it is folded into the index file
+const compactEvery = 1000
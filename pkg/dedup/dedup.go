@@ -0,0 +1,417 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Open loads the index at path, a missing file is an empty index. Changes are appended to a
+// journal next to it, which is replayed here and folded into the file now and then. The index
+// is locked until it is closed, another process opening it fails.
+func Open(path string) (_ *Index, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(path + lockSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	index := &Index{path: path, lock: lock, targets: map[string]*targetIndex{}}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var snapshot snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, err
+		}
+
+		if snapshot.Targets != nil {
+			index.targets = snapshot.Targets
+		}
+		index.id, index.seq = snapshot.ID, snapshot.Seq
+	}
+
+	replayed, err := index.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	created := index.id == ""
+	if created {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		index.id = hex.EncodeToString(id)
+	}
+
+	// a crash may have cut off the last entry, start a clean journal rather than append to it
+	if replayed > 0 || created {
+		if err := index.snapshot(); err != nil {
+			return nil, err
+		}
+		if err := os.Truncate(index.journalPath(), 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	index.journal, err = os.OpenFile(index.journalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// ID identifies the index. It is created with the index and kept in its file, so it stays the
+// same across restarts and changes when the index is lost. A nil index has none.
+func (i *Index) ID() string {
+	if i == nil {
+		return ""
+	}
+
+	return i.id
+}
+
+// Lookup returns the content a key refers to, found is false for keys stored as they are.
+// A nil index knows no keys.
+func (i *Index) Lookup(target, key string) (sum string, size int64, found bool) {
+	if i == nil {
+		return "", 0, false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t := i.targets[target]
+	if t == nil {
+		return "", 0, false
+	}
+
+	sum, found = t.Keys[key]
+	if blob := t.Blobs[sum]; found && blob != nil {
+		size = blob.Size
+	}
+
+	return sum, size, found
+}
+
+// Link points key at the content with sum, calling store first when no blob holds it yet.
+// The blob previously referenced by key is returned when nothing refers to it anymore,
+// pass it to Release.
+func (i *Index) Link(target, key, sum string, size int64, store func() error) (released string, err error) {
+	unlock := i.lockBlob(target, sum)
+	defer unlock()
+
+	i.mu.Lock()
+	_, exists := i.target(target).Blobs[sum]
+	i.mu.Unlock()
+
+	if !exists {
+		if err := store(); err != nil {
+			return "", err
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	released, changed := i.target(target).link(key, sum, size)
+	if !changed {
+		return "", nil
+	}
+
+	return released, i.record(entry{Op: opLink, Target: target, Key: key, Sum: sum, Size: size})
+}
+
+// Unlink removes key from the index. Its blob is returned when nothing refers to it
+// anymore, pass it to Release.
+func (i *Index) Unlink(target, key string) (released string, err error) {
+	if i == nil {
+		return "", nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	released, found := i.target(target).unlink(key)
+	if !found {
+		return "", nil
+	}
+
+	return released, i.record(entry{Op: opUnlink, Target: target, Key: key})
+}
+
+// Release calls remove for a blob without references and drops it from the index. A blob that
+// was linked again in the meantime is kept.
+func (i *Index) Release(target, sum string, remove func() error) error {
+	unlock := i.lockBlob(target, sum)
+	defer unlock()
+
+	i.mu.Lock()
+	blob := i.target(target).Blobs[sum]
+	i.mu.Unlock()
+
+	if blob == nil || blob.Refs > 0 {
+		return nil
+	}
+
+	if err := remove(); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.target(target).Blobs, sum)
+	return i.record(entry{Op: opRelease, Target: target, Sum: sum})
+}
+
+// Report sums up the blobs and references of a target
+func (i *Index) Report(target string) Report {
+	var report Report
+	if i == nil {
+		return report
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t := i.target(target)
+	for _, blob := range t.Blobs {
+		report.Blobs++
+		report.StoredBytes += blob.Size
+	}
+
+	for _, sum := range t.Keys {
+		report.References++
+		if blob := t.Blobs[sum]; blob != nil {
+			report.LogicalBytes += blob.Size
+		}
+	}
+
+	report.SavedBytes = report.LogicalBytes - report.StoredBytes
+	return report
+}
+
+// Close folds the journal into the index file and unlocks it. Changes made afterwards rewrite the whole file.
+func (i *Index) Close() error {
+	if i == nil {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.journal == nil {
+		return nil
+	}
+
+	err := i.compact()
+	if closeErr := i.journal.Close(); err == nil {
+		err = closeErr
+	}
+	i.journal = nil
+	i.lock.Close()
+
+	return err
+}
+
+// link points key at sum and returns the blob key referred to before once nothing refers to it
+// anymore. changed is false when key already referred to sum.
+func (t *targetIndex) link(key, sum string, size int64) (released string, changed bool) {
+	blob := t.Blobs[sum]
+	if blob == nil {
+		blob = &Blob{Size: size}
+		t.Blobs[sum] = blob
+	}
+
+	previous, found := t.Keys[key]
+	if found && previous == sum {
+		return "", false
+	}
+
+	blob.Refs++
+	t.Keys[key] = sum
+	if found {
+		released = t.unref(previous)
+	}
+
+	return released, true
+}
+
+// unlink removes key and returns its blob once nothing refers to it anymore
+func (t *targetIndex) unlink(key string) (released string, found bool) {
+	sum, found := t.Keys[key]
+	if !found {
+		return "", false
+	}
+
+	delete(t.Keys, key)
+	return t.unref(sum), true
+}
+
+// unref drops a reference to a blob and returns its sum once none are left
+func (t *targetIndex) unref(sum string) string {
+	blob := t.Blobs[sum]
+	if blob == nil {
+		return ""
+	}
+
+	if blob.Refs--; blob.Refs > 0 {
+		return ""
+	}
+
+	return sum
+}
+
+// target returns the index of a target, creating it on first use. Callers hold mu.
+func (i *Index) target(name string) *targetIndex {
+	t := i.targets[name]
+	if t == nil {
+		t = &targetIndex{Blobs: map[string]*Blob{}, Keys: map[string]string{}}
+		i.targets[name] = t
+	}
+
+	return t
+}
+
+// lockBlob serializes storing and removing the same blob
+func (i *Index) lockBlob(target, sum string) func() {
+	lock, _ := i.blobs.LoadOrStore(target+":"+sum, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// record appends a change to the journal and folds the journal into the index file once it
+// holds compactEvery changes. Callers hold mu.
+func (i *Index) record(change entry) error {
+	i.seq++
+	change.Seq = i.seq
+
+	if i.journal == nil {
+		return i.snapshot()
+	}
+
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	if _, err := i.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if i.pending++; i.pending >= compactEvery {
+		return i.compact()
+	}
+
+	return nil
+}
+
+// compact writes the index file and empties the journal. Changes up to the sequence number in the
+// file are skipped on replay, so a crash in between does not apply them twice. Callers hold mu.
+func (i *Index) compact() error {
+	if err := i.snapshot(); err != nil {
+		return err
+	}
+
+	if err := i.journal.Truncate(0); err != nil {
+		return err
+	}
+
+	i.pending = 0
+	return nil
+}
+
+// replay applies the journal entries newer than the index file, up to the first incomplete one
+func (i *Index) replay() (int, error) {
+	data, err := os.ReadFile(i.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var change entry
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			break
+		}
+
+		replayed++
+		if change.Seq <= i.seq {
+			continue
+		}
+
+		t := i.target(change.Target)
+		switch change.Op {
+		case opLink:
+			t.link(change.Key, change.Sum, change.Size)
+		case opUnlink:
+			t.unlink(change.Key)
+		case opRelease:
+			delete(t.Blobs, change.Sum)
+		}
+		i.seq = change.Seq
+	}
+
+	return replayed, nil
+}
+
+// snapshot writes the index to a temporary file and renames it, so a crash never leaves half a file.
+// Callers hold mu.
+func (i *Index) snapshot() error {
+	data, err := json.Marshal(snapshot{ID: i.id, Seq: i.seq, Targets: i.targets})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(i.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(i.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), i.path)
+}
+
+func (i *Index) journalPath() string {
+	return i.path + journalSuffix
+}
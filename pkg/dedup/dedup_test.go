@@ -0,0 +1,266 @@
+package dedup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func open(t *testing.T, path string) *Index {
+	index, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+
+	return index
+}
+
+// link links key and fails the test when it does not succeed, stores counts the calls of store
+func link(t *testing.T, index *Index, key, sum string, stores *int) string {
+	released, err := index.Link("default", key, sum, 10, func() error {
+		*stores++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return released
+}
+
+func refs(index *Index, sum string) int {
+	blob := index.target("default").Blobs[sum]
+	if blob == nil {
+		return -1
+	}
+	return blob.Refs
+}
+
+func TestLinkCountsReferences(t *testing.T) {
+	index := open(t, filepath.Join(t.TempDir(), "dedup.json"))
+	stores := 0
+
+	link(t, index, "a.txt", "s1", &stores)
+	link(t, index, "b.txt", "s1", &stores)
+	if stores != 1 || refs(index, "s1") != 2 {
+		t.Fatalf("stored %d times with %d references, want 1 and 2", stores, refs(index, "s1"))
+	}
+
+	// linking a key to its own content changes nothing
+	link(t, index, "a.txt", "s1", &stores)
+	if refs(index, "s1") != 2 {
+		t.Errorf("relinking the same content: %d references, want 2", refs(index, "s1"))
+	}
+
+	// b.txt still refers to s1
+	if released := link(t, index, "a.txt", "s2", &stores); released != "" || refs(index, "s1") != 1 || refs(index, "s2") != 1 {
+		t.Errorf("replacing a.txt released %q, references %d and %d, want none, 1 and 1", released, refs(index, "s1"), refs(index, "s2"))
+	}
+
+	if released := link(t, index, "b.txt", "s2", &stores); released != "s1" || refs(index, "s1") != 0 {
+		t.Errorf("replacing b.txt released %q with %d references left, want s1 and 0", released, refs(index, "s1"))
+	}
+
+	report := index.Report("default")
+	if report.References != 2 || report.Blobs != 2 || report.LogicalBytes != 20 {
+		t.Errorf("report %+v, want 2 references to 2 blobs of 20 bytes", report)
+	}
+}
+
+func TestUnlinkReleasesUnreferencedBlobs(t *testing.T) {
+	index := open(t, filepath.Join(t.TempDir(), "dedup.json"))
+	stores := 0
+
+	link(t, index, "a.txt", "s1", &stores)
+	link(t, index, "b.txt", "s1", &stores)
+
+	if released, _ := index.Unlink("default", "a.txt"); released != "" {
+		t.Errorf("unlinking a.txt released %q while b.txt refers to it", released)
+	}
+
+	released, err := index.Unlink("default", "b.txt")
+	if err != nil || released != "s1" {
+		t.Fatalf("unlinking b.txt released %q, %v, want s1", released, err)
+	}
+
+	if released, _ := index.Unlink("default", "b.txt"); released != "" {
+		t.Errorf("unlinking an unknown key released %q", released)
+	}
+
+	removed := 0
+	remove := func() error { removed++; return nil }
+	if err := index.Release("default", "s1", remove); err != nil || removed != 1 {
+		t.Fatalf("release removed %d blobs, %v, want 1", removed, err)
+	}
+
+	if _, _, found := index.Lookup("default", "b.txt"); found || refs(index, "s1") != -1 {
+		t.Error("released blob is still in the index")
+	}
+}
+
+func TestReleaseKeepsRelinkedBlobs(t *testing.T) {
+	index := open(t, filepath.Join(t.TempDir(), "dedup.json"))
+	stores := 0
+
+	link(t, index, "a.txt", "s1", &stores)
+	released, _ := index.Unlink("default", "a.txt")
+
+	// linked again before the blob was released
+	link(t, index, "b.txt", released, &stores)
+	if stores != 1 {
+		t.Errorf("stored %d times, want once", stores)
+	}
+
+	err := index.Release("default", released, func() error {
+		t.Error("a blob with references was removed")
+		return nil
+	})
+	if err != nil || refs(index, "s1") != 1 {
+		t.Errorf("release: %v with %d references, want 1", err, refs(index, "s1"))
+	}
+}
+
+func TestLinkFailsWhenStoreFails(t *testing.T) {
+	index := open(t, filepath.Join(t.TempDir(), "dedup.json"))
+
+	failed := errors.New("upload failed")
+	if _, err := index.Link("default", "a.txt", "s1", 10, func() error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the store error", err)
+	}
+
+	if _, _, found := index.Lookup("default", "a.txt"); found || refs(index, "s1") != -1 {
+		t.Error("key was linked to content that was not stored")
+	}
+}
+
+func TestNilIndex(t *testing.T) {
+	var index *Index
+	if _, _, found := index.Lookup("default", "a.txt"); found {
+		t.Error("nil index found a key")
+	}
+	if released, err := index.Unlink("default", "a.txt"); released != "" || err != nil {
+		t.Errorf("nil index unlink: %q, %v", released, err)
+	}
+}
+
+// the journal restores the changes of a process that never closed the index
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	index, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := 0
+
+	link(t, index, "a.txt", "s1", &stores)
+	link(t, index, "b.txt", "s1", &stores)
+	index.Unlink("default", "a.txt")
+	link(t, index, "c.txt", "s2", &stores)
+	index.journal.Close()
+	index.lock.Close()
+
+	// a crash cut off the last entry
+	journal, err := os.OpenFile(path+journalSuffix, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.WriteString(`{"seq":5,"op":"unl`)
+	journal.Close()
+
+	reopened := open(t, path)
+	if refs(reopened, "s1") != 1 || refs(reopened, "s2") != 1 {
+		t.Errorf("references %d and %d after replay, want 1 and 1", refs(reopened, "s1"), refs(reopened, "s2"))
+	}
+	if sum, _, _ := reopened.Lookup("default", "b.txt"); sum != "s1" {
+		t.Errorf("b.txt refers to %q after replay, want s1", sum)
+	}
+	if _, _, found := reopened.Lookup("default", "a.txt"); found {
+		t.Error("unlinked key is back after replay")
+	}
+
+	// the journal was folded into the index file and new changes are appended cleanly
+	link(t, reopened, "d.txt", "s2", &stores)
+	reopened.Close()
+
+	if refs(open(t, path), "s2") != 2 {
+		t.Error("change after replay was lost")
+	}
+}
+
+// a crash after the index file was written but before the journal was emptied applies nothing twice
+func TestJournalEntriesInIndexFileAreSkipped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	index := open(t, path)
+	stores := 0
+
+	link(t, index, "a.txt", "s1", &stores)
+	link(t, index, "b.txt", "s1", &stores)
+
+	journal, err := os.ReadFile(path + journalSuffix)
+	if err != nil || len(journal) == 0 {
+		t.Fatalf("journal is empty: %v", err)
+	}
+
+	index.Close()
+	if err := os.WriteFile(path+journalSuffix, journal, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := refs(open(t, path), "s1"); got != 2 {
+		t.Errorf("%d references after replaying entries already in the index file, want 2", got)
+	}
+}
+
+func TestJournalIsCompacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	index := open(t, path)
+	stores := 0
+
+	for i := 0; i < compactEvery; i++ {
+		link(t, index, "a.txt", []string{"s1", "s2"}[i%2], &stores)
+	}
+
+	info, err := os.Stat(path + journalSuffix)
+	if err != nil || info.Size() != 0 {
+		t.Errorf("journal was not emptied after %d changes: %v", compactEvery, err)
+	}
+
+	// read the file as it is, without the compaction of Close
+	index.lock.Close()
+	if sum, _, _ := open(t, path).Lookup("default", "a.txt"); sum != "s2" {
+		t.Errorf("a.txt refers to %q in the index file, want s2", sum)
+	}
+}
+
+func TestIDIsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	index := open(t, path)
+
+	id := index.ID()
+	if len(id) != 32 {
+		t.Fatalf("ID %q, want 16 random bytes in hex", id)
+	}
+	index.Close()
+
+	if reopened := open(t, path).ID(); reopened != id {
+		t.Errorf("ID %q after reopening, want %q", reopened, id)
+	}
+
+	if other := open(t, filepath.Join(t.TempDir(), "dedup.json")).ID(); other == id {
+		t.Error("two indexes have the same ID")
+	}
+}
+
+func TestOpenLocksIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	index := open(t, path)
+
+	if _, err := Open(path); err == nil {
+		t.Fatal("opened an index that is open already")
+	}
+
+	index.Close()
+	open(t, path)
+}
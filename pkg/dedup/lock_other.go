@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dedup
+
+import "os"
+
+// lockFile opens path without locking it, the bucket claim still keeps a second index out
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+}
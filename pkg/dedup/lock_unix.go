@@ -0,0 +1,29 @@
+//go:build unix
+
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile opens path and takes an exclusive lock on it, which the system drops with the process.
+// It fails at once when another process holds the lock.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s is locked by another process, each instance needs its own dedup index", path)
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
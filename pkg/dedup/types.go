@@ -0,0 +1,59 @@
+package dedup
+
+import (
+	"os"
+	"sync"
+)
+
+// Index records which object keys share stored content, by target. Content is stored once as a
+// blob named by its SHA-256, keys are references to it. The index counts the references, it is
+// kept in a local JSON file with a journal of the changes since the file was written.
+type Index struct {
+	path    string
+	id      string   // identifies the index in the buckets it owns, see ID
+	lock    *os.File // held while the index is open, see lockFile
+	mu      sync.Mutex
+	targets map[string]*targetIndex
+	blobs   sync.Map // per blob locks, held while a blob is stored or removed
+
+	journal *os.File // nil once closed
+	seq     uint64   // number of the last change
+	pending int      // changes in the journal
+}
+
+// snapshot is the content of the index file
+type snapshot struct {
+	ID      string                  `json:"id"`
+	Seq     uint64                  `json:"seq"` // last change included, older journal entries are skipped
+	Targets map[string]*targetIndex `json:"targets"`
+}
+
+// entry is one change in the journal
+type entry struct {
+	Seq    uint64 `json:"seq"`
+	Op     string `json:"op"` // link, unlink or release
+	Target string `json:"target"`
+	Key    string `json:"key,omitempty"`
+	Sum    string `json:"sum,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+type targetIndex struct {
+	Blobs map[string]*Blob  `json:"blobs"` // by SHA-256
+	Keys  map[string]string `json:"keys"`  // SHA-256 of the content by object key
+}
+
+// Blob is stored content shared by one or more keys
+type Blob struct {
+	Size int64 `json:"size"`
+	Refs int   `json:"refs"`
+}
+
+// Report sums up the space saved in a target
+type Report struct {
+	Blobs        int   `json:"blobs"`        // distinct contents stored
+	References   int   `json:"references"`   // keys pointing at them
+	StoredBytes  int64 `json:"storedBytes"`  // size of the blobs
+	LogicalBytes int64 `json:"logicalBytes"` // size of all keys, as without deduplication
+	SavedBytes   int64 `json:"savedBytes"`
+}
@@ -0,0 +1,25 @@
+package duplicates
+
+import "time"
+
+// report statuses
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// which copy of a set a cleanup keeps
+const (
+	KeepOldest = "oldest"
+	KeepNewest = "newest"
+)
+
+// finished reports kept in memory, older ones are dropped
+const maxReports = 20
+
+// objects hashed in parallel by a hashed scan
+const hashConcurrency = 8
+
+// longest a scan may run
+const scanTimeout = time.Hour
@@ -0,0 +1,319 @@
+package duplicates
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/s3"
+	"file-management-service/pkg/tracing"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// New creates a finder, Close stops its running scans
+func New() *Finder {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Finder{reports: map[string]*Report{}, ctx: ctx, cancel: cancel}
+}
+
+// Start scans the folder prefix for duplicates in the background and returns the running report.
+// Objects are grouped by size and ETag, with hash by the SHA-256 of their content, which
+// also finds copies uploaded in a different number of parts.
+func (f *Finder) Start(ctx context.Context, client *s3.S3, prefix string, hash bool) Report {
+	// a folder, like the listings, so "docs" does not match "docs-old/"
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	report := &Report{
+		ID:        newID(),
+		Target:    client.Target(),
+		Prefix:    prefix,
+		Hash:      hash,
+		Status:    StatusRunning,
+		StartedAt: time.Now().UTC(),
+	}
+
+	f.mu.Lock()
+	f.reports[report.ID] = report
+	f.order = append(f.order, report.ID)
+	f.prune()
+	snapshot := *report
+	f.mu.Unlock()
+
+	// the scan outlives the request, it keeps its logger and trace
+	ctx = logger.WithContext(tracing.Detach(ctx), logger.FromContext(ctx))
+
+	f.workers.Add(1)
+	go func() {
+		defer f.workers.Done()
+
+		ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+		defer cancel()
+		stop := context.AfterFunc(f.ctx, cancel)
+		defer stop()
+
+		scanned, sets, err := scan(ctx, client, prefix, hash)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		finished := time.Now().UTC()
+		report.FinishedAt = &finished
+		report.Scanned = scanned
+		if err != nil {
+			logger.FromContext(ctx).Warn("Duplicate scan failed", "prefix", prefix, "error", err)
+			report.Status, report.Error = StatusFailed, err.Error()
+			return
+		}
+
+		report.Status, report.Sets = StatusDone, sets
+		for _, set := range sets {
+			report.WastedBytes += set.WastedBytes
+		}
+	}()
+
+	return snapshot
+}
+
+// Get returns a report by id
+func (f *Finder) Get(id string) (Report, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	report, found := f.reports[id]
+	if !found {
+		return Report{}, false
+	}
+
+	return *report, true
+}
+
+// List returns the reports of a target newest first, without their sets
+func (f *Finder) List(target string) []Report {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reports := []Report{}
+	for i := len(f.order) - 1; i >= 0; i-- {
+		report := *f.reports[f.order[i]]
+		if report.Target == target {
+			report.Sets = nil
+			reports = append(reports, report)
+		}
+	}
+
+	return reports
+}
+
+// Cleanup deletes all but one copy of every set of a finished report, keeping the oldest or newest.
+// Copies that changed or disappeared since the scan are skipped, as are sets whose kept copy did.
+func (f *Finder) Cleanup(ctx context.Context, client *s3.S3, id, keep string) (Cleanup, error) {
+	report, found := f.Get(id)
+	switch {
+	case !found || report.Target != client.Target():
+		return Cleanup{}, apperror.NotFound(fmt.Sprintf("duplicate report not found: %s", id))
+	case report.Status != StatusDone:
+		return Cleanup{}, apperror.Conflict(fmt.Sprintf("duplicate report %s is %s", id, report.Status))
+	}
+
+	cleanup := Cleanup{Deleted: []string{}, Skipped: map[string]string{}}
+	for _, set := range report.Sets {
+		kept := set.Objects[0]
+		if keep == KeepNewest {
+			kept = set.Objects[len(set.Objects)-1]
+		}
+
+		if reason := changed(ctx, client, kept); reason != "" {
+			cleanup.Skipped[kept.Key] = "kept copy " + reason
+			continue
+		}
+
+		for _, object := range set.Objects {
+			if object.Key == kept.Key {
+				continue
+			}
+
+			if reason := changed(ctx, client, object); reason != "" {
+				cleanup.Skipped[object.Key] = reason
+				continue
+			}
+
+			if err := client.DeleteObject(ctx, object.Key); err != nil {
+				return cleanup, err
+			}
+
+			cleanup.Deleted = append(cleanup.Deleted, object.Key)
+			cleanup.FreedBytes += set.Size
+		}
+	}
+
+	return cleanup, nil
+}
+
+// Close stops the running scans and waits for them
+func (f *Finder) Close() {
+	f.cancel()
+	f.workers.Wait()
+}
+
+// scan walks prefix and groups the objects with the same content. Empty objects, folders and
+// deduplicated references are left out, they take no space of their own.
+func scan(ctx context.Context, client *s3.S3, prefix string, hash bool) (int, []Set, error) {
+	scanned := 0
+	bySize := map[int64][]s3.ObjectDetails{}
+	err := client.WalkObjects(ctx, prefix, func(object s3.ObjectDetails) error {
+		if object.IsFolder || object.Size == 0 || object.DedupRef != "" {
+			return nil
+		}
+
+		scanned++
+		bySize[object.Size] = append(bySize[object.Size], object)
+		return nil
+	})
+	if err != nil {
+		return scanned, nil, err
+	}
+
+	var sets []Set
+	for size, objects := range bySize {
+		if len(objects) < 2 {
+			continue
+		}
+
+		fingerprints := make([]string, len(objects))
+		for i, object := range objects {
+			fingerprints[i] = object.ETag
+		}
+
+		if hash {
+			if fingerprints, err = hashObjects(ctx, client, objects); err != nil {
+				return scanned, nil, err
+			}
+		}
+
+		groups := map[string][]Object{}
+		for i, object := range objects {
+			if fingerprints[i] == "" {
+				continue
+			}
+			groups[fingerprints[i]] = append(groups[fingerprints[i]], Object{Key: object.Name, ETag: object.ETag, LastModified: object.LastModified})
+		}
+
+		for fingerprint, group := range groups {
+			if len(group) < 2 {
+				continue
+			}
+
+			sort.Slice(group, func(i, j int) bool { return group[i].LastModified.Before(group[j].LastModified) })
+			sets = append(sets, Set{Size: size, Fingerprint: fingerprint, WastedBytes: size * int64(len(group)-1), Objects: group})
+		}
+	}
+
+	// the most wasteful sets first
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].WastedBytes != sets[j].WastedBytes {
+			return sets[i].WastedBytes > sets[j].WastedBytes
+		}
+		return sets[i].Objects[0].Key < sets[j].Objects[0].Key
+	})
+
+	return scanned, sets, nil
+}
+
+// hashObjects returns the SHA-256 of every object, the stored checksum when it is still current
+// and the content's otherwise. Objects that cannot be read are left out with an empty hash.
+func hashObjects(ctx context.Context, client *s3.S3, objects []s3.ObjectDetails) ([]string, error) {
+	hashes := make([]string, len(objects))
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(hashConcurrency)
+	for i := range objects {
+		i := i
+		group.Go(func() error {
+			sum, err := contentHash(ctx, client, objects[i])
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				logger.FromContext(ctx).Warn("Failed to hash object, it is left out of the duplicates", "file", objects[i].Name, "error", err)
+				return nil
+			}
+
+			hashes[i] = sum
+			return nil
+		})
+	}
+
+	return hashes, group.Wait()
+}
+
+func contentHash(ctx context.Context, client *s3.S3, object s3.ObjectDetails) (string, error) {
+	info, err := client.ObjectInfo(ctx, object.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if info.SHA256 != "" && info.ETag == object.ETag {
+		return info.SHA256, nil
+	}
+
+	body, err := client.GetFile(ctx, object.Name)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// changed returns why an object may no longer be deleted as a duplicate, empty when it may
+func changed(ctx context.Context, client *s3.S3, object Object) string {
+	info, err := client.ObjectInfo(ctx, object.Key)
+	if err != nil && apperror.From(err).Status == http.StatusNotFound {
+		return "no longer exists"
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if info.ETag != object.ETag {
+		return "changed since the scan"
+	}
+
+	return ""
+}
+
+// prune drops the oldest finished reports beyond maxReports. Callers hold mu.
+func (f *Finder) prune() {
+	for i := 0; len(f.order) > maxReports && i < len(f.order); {
+		if f.reports[f.order[i]].Status == StatusRunning {
+			i++
+			continue
+		}
+
+		delete(f.reports, f.order[i])
+		f.order = append(f.order[:i], f.order[i+1:]...)
+	}
+}
+
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,55 @@
+package duplicates
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Finder runs duplicate scans in the background and keeps their reports in memory
+type Finder struct {
+	mu      sync.Mutex
+	reports map[string]*Report
+	order   []string // report ids, oldest first
+
+	ctx     context.Context // cancelled by Close
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// Report is the result of one scan of a prefix
+type Report struct {
+	ID          string     `json:"id"`
+	Target      string     `json:"target"`
+	Prefix      string     `json:"prefix"`
+	Hash        bool       `json:"hash"` // sets were confirmed by the SHA-256 of the content
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Scanned     int        `json:"scanned"`     // objects looked at
+	WastedBytes int64      `json:"wastedBytes"` // freed by keeping one copy of every set
+	Sets        []Set      `json:"sets,omitempty"`
+}
+
+// Set is a group of objects with the same content
+type Set struct {
+	Size        int64    `json:"size"`
+	Fingerprint string   `json:"fingerprint"` // ETag, or SHA-256 for hashed scans
+	WastedBytes int64    `json:"wastedBytes"`
+	Objects     []Object `json:"objects"` // oldest first
+}
+
+// Object is one copy in a set, the ETag is checked again before it is deleted
+type Object struct {
+	Key          string    `json:"key"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// Cleanup is the outcome of deleting all but one copy of every set
+type Cleanup struct {
+	Deleted    []string          `json:"deleted"`
+	FreedBytes int64             `json:"freedBytes"`
+	Skipped    map[string]string `json:"skipped,omitempty"` // reason by key, e.g. changed since the scan
+}
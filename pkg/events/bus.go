@@ -0,0 +1,45 @@
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers fn for every event published from now on, fn must not block
+func (b *Bus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Publish stamps the event with an ID and time and hands it to the subscribers.
+// IDs sort in publishing order. A nil Bus drops the event.
+func (b *Bus) Publish(event Event) Event {
+	if b == nil {
+		return event
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	id := now.UnixNano()
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+	subscribers := b.subscribers
+	b.mu.Unlock()
+
+	event.ID = fmt.Sprintf("%020d", id)
+	event.Time = now.UTC()
+
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+
+	return event
+}
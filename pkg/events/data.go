@@ -0,0 +1,47 @@
+package events
+
+import "time"
+
+// event types
+const (
+	ObjectCreated = "object.created"
+	ObjectDeleted = "object.deleted"
+	ObjectMoved   = "object.moved"
+	ObjectUpdated = "object.updated" // user metadata or tags changed
+	FolderCreated = "folder.created"
+	FolderDeleted = "folder.deleted"
+)
+
+// delivery statuses in the delivery log
+const (
+	StatusDelivered = "delivered"
+	StatusRetrying  = "retrying"
+	StatusFailed    = "failed"  // gave up after the last attempt
+	StatusDropped   = "dropped" // the webhook was removed from the configuration
+)
+
+// headers sent with every webhook request
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// retry delays double from retryBaseDelay up to retryMaxDelay
+const (
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 30 * time.Minute
+)
+
+// number of webhook requests sent at the same time
+const sendConcurrency = 4
+
+// how often the outbox is checked when nothing is due
+const idleInterval = time.Minute
+
+// number of events the feed keeps for subscribers resuming with a last event ID
+const feedHistory = 1000
+
+// events buffered per feed subscriber before it counts as too slow
+const subscriberBuffer = 64
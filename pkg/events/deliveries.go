@@ -0,0 +1,94 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"file-management-service/pkg/rotate"
+	"os"
+)
+
+// NewDeliveryLog opens the delivery log at path, it is rotated after maxSize bytes and every day
+func NewDeliveryLog(path string, maxSize int64) (*DeliveryLog, error) {
+	writer, err := rotate.New(path, maxSize, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeliveryLog{path: path, writer: writer}, nil
+}
+
+// Log appends a delivery attempt
+func (l *DeliveryLog) Log(entry LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (l *DeliveryLog) Close() error {
+	return l.writer.Close()
+}
+
+// Search returns the attempts matching query, newest first. Rotated files are searched too.
+func (l *DeliveryLog) Search(query Query) ([]LogEntry, error) {
+	files, err := rotate.Files(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []LogEntry{}
+
+	// walk the files newest first so the limit keeps the latest entries
+	for i := len(files) - 1; i >= 0; i-- {
+		matches, err := searchFile(files[i], query)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := len(matches) - 1; j >= 0; j-- {
+			entries = append(entries, matches[j])
+			if query.Limit > 0 && len(entries) >= query.Limit {
+				return entries, nil
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func searchFile(path string, query Query) ([]LogEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matches []LogEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // skip partially written lines
+		}
+
+		if query.matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+
+	return matches, scanner.Err()
+}
+
+func (q Query) matches(entry LogEntry) bool {
+	return (q.EventType == "" || entry.EventType == q.EventType) &&
+		(q.Status == "" || entry.Status == q.Status) &&
+		(q.URL == "" || entry.URL == q.URL)
+}
@@ -0,0 +1,89 @@
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// NewFeed keeps the latest events in memory for subscribers that reconnect
+func NewFeed() *Feed {
+	return &Feed{
+		subscribers: map[chan Event]struct{}{},
+		// events from before this process started are never in the history
+		evicted: fmt.Sprintf("%020d", time.Now().UnixNano()),
+	}
+}
+
+// Publish adds an event to the history and passes it on to the subscribers.
+// A subscriber that cannot keep up is disconnected, it resumes from its last event ID.
+func (f *Feed) Publish(event Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+
+	f.history = append(f.history, event)
+	if len(f.history) > feedHistory {
+		f.evicted = f.history[0].ID
+		f.history = f.history[1:]
+	}
+
+	for subscriber := range f.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(f.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Subscribe returns the events after lastEventID and a channel with the events that follow.
+// complete is false when events after lastEventID are no longer in the history.
+// The channel is closed when the subscriber falls behind or the feed is closed, call cancel when done.
+func (f *Feed) Subscribe(lastEventID string) (backlog []Event, complete bool, updates <-chan Event, cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if lastEventID != "" {
+		complete = lastEventID >= f.evicted
+		for _, event := range f.history {
+			if event.ID > lastEventID {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	subscriber := make(chan Event, subscriberBuffer)
+	if f.closed {
+		close(subscriber)
+	} else {
+		f.subscribers[subscriber] = struct{}{}
+	}
+
+	cancel = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if _, found := f.subscribers[subscriber]; found {
+			delete(f.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return backlog, complete, subscriber, cancel
+}
+
+// Close disconnects all subscribers, streams have to end before the server can shut down
+func (f *Feed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for subscriber := range f.subscribers {
+		delete(f.subscribers, subscriber)
+		close(subscriber)
+	}
+}
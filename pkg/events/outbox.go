@@ -0,0 +1,68 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadOutbox reads the deliveries that were not done before the last shutdown
+func loadOutbox(dir string) (map[string]*Delivery, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	pending := map[string]*Delivery{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var delivery Delivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			// a broken file would block the outbox forever, set it aside
+			os.Rename(file, strings.TrimSuffix(file, ".json")+".broken")
+			continue
+		}
+
+		pending[delivery.ID] = &delivery
+	}
+
+	return pending, nil
+}
+
+// saveDelivery writes a delivery to a temporary file and renames it, so a crash never leaves half a file
+func saveDelivery(dir string, delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, delivery.ID+".json"))
+}
+
+func removeDelivery(dir, id string) {
+	os.Remove(filepath.Join(dir, id+".json"))
+}
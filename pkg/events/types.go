@@ -0,0 +1,96 @@
+package events
+
+import (
+	"context"
+	"file-management-service/config"
+	"file-management-service/pkg/rotate"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event describes a change made through the service
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Target    string    `json:"target"`
+	Key       string    `json:"key"`
+	From      string    `json:"from,omitempty"` // previous key of a moved object
+	Size      int64     `json:"size,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// Bus hands every published event to its subscribers
+type Bus struct {
+	mu          sync.Mutex
+	subscribers []func(Event)
+	lastID      int64
+}
+
+// Feed streams events to live subscribers and remembers the latest ones for resumption
+type Feed struct {
+	mu          sync.Mutex
+	history     []Event
+	evicted     string // ID of the newest event no longer in the history
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+// Delivery is an event on its way to one webhook, kept in the outbox until it is done
+type Delivery struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	sending bool
+}
+
+// Dispatcher sends events to the configured webhooks, retrying failed deliveries with backoff
+type Dispatcher struct {
+	configStore *config.Store
+	outbox      string
+	log         *DeliveryLog
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending map[string]*Delivery
+
+	slots   chan struct{} // limits concurrent sends
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// DeliveryLog appends delivery attempts as JSON lines to a rotating file
+type DeliveryLog struct {
+	path   string
+	writer *rotate.Writer
+}
+
+// LogEntry is a single delivery attempt
+type LogEntry struct {
+	Time         time.Time `json:"time"`
+	DeliveryID   string    `json:"deliveryId"`
+	EventID      string    `json:"eventId"`
+	EventType    string    `json:"eventType"`
+	URL          string    `json:"url"`
+	Attempt      int       `json:"attempt"`
+	Status       string    `json:"status"`
+	ResponseCode int       `json:"responseCode,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	LatencyMs    int64     `json:"latencyMs"`
+}
+
+// Query filters the delivery log, zero values match everything
+type Query struct {
+	EventType string
+	Status    string
+	URL       string
+	Limit     int
+}
@@ -0,0 +1,287 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"file-management-service/config"
+	"file-management-service/pkg/metrics"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewDispatcher loads the deliveries left in outboxDir and starts sending them.
+// Webhooks, attempts and timeouts are read from configStore for every delivery.
+func NewDispatcher(configStore *config.Store, outboxDir string, log *DeliveryLog) (*Dispatcher, error) {
+	pending, err := loadOutbox(outboxDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		configStore: configStore,
+		outbox:      outboxDir,
+		log:         log,
+		client:      &http.Client{},
+		pending:     pending,
+		slots:       make(chan struct{}, sendConcurrency),
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	if len(pending) > 0 {
+		slog.Info("Resuming webhook deliveries", "pending", len(pending))
+	}
+
+	d.workers.Add(1)
+	go d.run()
+
+	return d, nil
+}
+
+// Enqueue stores a delivery in the outbox for every webhook subscribed to the event
+func (d *Dispatcher) Enqueue(event Event) {
+	for _, webhook := range d.configStore.Get().Webhooks {
+		if !webhook.Matches(event.Type, event.Target, event.Key, event.From) {
+			continue
+		}
+
+		delivery := &Delivery{
+			ID:          deliveryID(event.ID, webhook.URL),
+			URL:         webhook.URL,
+			Event:       event,
+			NextAttempt: event.Time,
+			CreatedAt:   event.Time,
+		}
+
+		if err := saveDelivery(d.outbox, delivery); err != nil {
+			slog.Error("Failed to store webhook delivery", "delivery", delivery.ID, "url", webhook.URL, "error", err)
+			continue
+		}
+
+		d.mu.Lock()
+		d.pending[delivery.ID] = delivery
+		d.mu.Unlock()
+	}
+
+	d.notify()
+}
+
+// Pending returns the number of deliveries waiting in the outbox
+func (d *Dispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.pending)
+}
+
+// Log returns the delivery log
+func (d *Dispatcher) Log() *DeliveryLog {
+	return d.log
+}
+
+// Close stops sending, deliveries that are not done stay in the outbox for the next start
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.workers.Wait()
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts the due deliveries whenever one is enqueued, finished or its retry time comes
+func (d *Dispatcher) run() {
+	defer d.workers.Done()
+
+	for {
+		wait := d.sendDue()
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sendDue starts as many due deliveries as there are free slots and returns how long
+// to wait for the next one
+func (d *Dispatcher) sendDue() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	wait := idleInterval
+	for _, delivery := range d.pending {
+		if delivery.sending {
+			continue
+		}
+
+		if until := delivery.NextAttempt.Sub(now); until > 0 {
+			wait = min(wait, until)
+			continue
+		}
+
+		select {
+		case d.slots <- struct{}{}:
+		default:
+			// all slots are busy, a finished send wakes the loop again
+			return wait
+		}
+
+		delivery.sending = true
+		d.workers.Add(1)
+		go d.send(delivery)
+	}
+
+	return wait
+}
+
+// send makes one attempt and records its outcome
+func (d *Dispatcher) send(delivery *Delivery) {
+	defer d.workers.Done()
+	defer func() {
+		<-d.slots
+		d.notify()
+	}()
+
+	settings := d.configStore.Get()
+	webhook, found := settings.Webhook(delivery.URL)
+	if !found {
+		d.finish(delivery, LogEntry{Status: StatusDropped, Error: "webhook is no longer configured"})
+		return
+	}
+
+	start := time.Now()
+	status, err := d.post(webhook, delivery, time.Duration(settings.WebhookTimeout)*time.Second)
+	entry := LogEntry{ResponseCode: status, LatencyMs: time.Since(start).Milliseconds()}
+
+	// shutting down, try again on the next start
+	if d.ctx.Err() != nil {
+		d.mu.Lock()
+		delivery.sending = false
+		d.mu.Unlock()
+		return
+	}
+
+	delivery.Attempts++
+	switch {
+	case err == nil:
+		entry.Status = StatusDelivered
+	case delivery.Attempts >= settings.WebhookMaxAttempts:
+		entry.Status, entry.Error = StatusFailed, err.Error()
+	default:
+		entry.Status, entry.Error = StatusRetrying, err.Error()
+	}
+
+	d.finish(delivery, entry)
+}
+
+// post sends the event signed with the webhook secret, any status other than 2xx is an error
+func (d *Dispatcher) post(webhook config.Webhook, delivery *Delivery, timeout time.Duration) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, delivery.Event.Type)
+	request.Header.Set(HeaderDelivery, delivery.ID)
+	request.Header.Set(HeaderTimestamp, timestamp)
+	if webhook.Secret != "" {
+		request.Header.Set(HeaderSignature, "sha256="+Sign(webhook.Secret, timestamp, body))
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook answered with %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+// finish logs the attempt and either schedules the next one or removes the delivery from the outbox
+func (d *Dispatcher) finish(delivery *Delivery, entry LogEntry) {
+	entry.Time = time.Now().UTC()
+	entry.DeliveryID = delivery.ID
+	entry.EventID = delivery.Event.ID
+	entry.EventType = delivery.Event.Type
+	entry.URL = delivery.URL
+	entry.Attempt = delivery.Attempts
+
+	if err := d.log.Log(entry); err != nil {
+		slog.Error("Failed to write webhook delivery log", "delivery", delivery.ID, "error", err)
+	}
+	metrics.WebhookDelivery(entry.Status)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry.Status == StatusRetrying {
+		delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+		delivery.sending = false
+		if err := saveDelivery(d.outbox, delivery); err != nil {
+			slog.Error("Failed to store webhook delivery", "delivery", delivery.ID, "error", err)
+		}
+		return
+	}
+
+	if entry.Status == StatusFailed {
+		slog.Warn("Giving up on webhook delivery", "delivery", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts, "error", entry.Error)
+	}
+
+	delete(d.pending, delivery.ID)
+	removeDelivery(d.outbox, delivery.ID)
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.body", receivers compute the same to verify a request
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff doubles the delay with every attempt
+func backoff(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, retryMaxDelay)
+}
+
+// deliveryID is stable for an event and webhook, receivers can use it to drop duplicates
+func deliveryID(eventID, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return eventID + "-" + hex.EncodeToString(sum[:4])
+}
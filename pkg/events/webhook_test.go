@@ -0,0 +1,238 @@
+package events
+
+import (
+	"encoding/json"
+	"file-management-service/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// computed independently, the signature covers the timestamp, a dot and the body
+	want := "086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"
+	if got := Sign("secret", "1700000000", []byte(`{"id":"1"}`)); got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+
+	if Sign("other", "1700000000", []byte(`{"id":"1"}`)) == want || Sign("secret", "1700000001", []byte(`{"id":"1"}`)) == want {
+		t.Error("signature does not depend on the secret and timestamp")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:   retryBaseDelay,
+		2:   2 * retryBaseDelay,
+		3:   4 * retryBaseDelay,
+		9:   256 * retryBaseDelay,
+		10:  retryMaxDelay,
+		100: retryMaxDelay,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("after %d attempts: %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestEnqueueFiltersWebhooks(t *testing.T) {
+	store := config.NewStore(&config.Config{Webhooks: []config.Webhook{
+		{URL: "http://all.test"},
+		{URL: "http://default.test", Target: "default"},
+		{URL: "http://archive.test", Target: "archive"},
+		{URL: "http://docs.test", Prefix: "docs/"},
+		{URL: "http://deletes.test", Events: []string{ObjectDeleted}},
+	}}, config.Options{}, nil)
+
+	// not started, deliveries stay pending
+	d := &Dispatcher{configStore: store, outbox: t.TempDir(), pending: map[string]*Delivery{}, wake: make(chan struct{}, 1)}
+
+	for event, want := range map[Event]string{
+		{ID: "1", Type: ObjectCreated, Target: "default", Key: "a.txt"}:                   "http://all.test,http://default.test",
+		{ID: "2", Type: ObjectCreated, Target: "archive", Key: "docs/a.txt"}:              "http://all.test,http://archive.test,http://docs.test",
+		{ID: "3", Type: ObjectMoved, Target: "default", Key: "a.txt", From: "docs/a.txt"}: "http://all.test,http://default.test,http://docs.test",
+		{ID: "4", Type: ObjectDeleted, Target: "other", Key: "a.txt"}:                     "http://all.test,http://deletes.test",
+	} {
+		d.Enqueue(event)
+
+		var urls []string
+		for _, delivery := range d.pending {
+			if delivery.Event.ID == event.ID {
+				urls = append(urls, delivery.URL)
+			}
+		}
+		sort.Strings(urls)
+
+		if got := strings.Join(urls, ","); got != want {
+			t.Errorf("event %s was sent to %s, want %s", event.ID, got, want)
+		}
+	}
+}
+
+// webhookServer fails the first requests and records every one it gets
+type webhookServer struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func (server *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	server.mu.Lock()
+	server.requests = append(server.requests, r)
+	server.bodies = append(server.bodies, body)
+	failed := len(server.requests) <= server.failures
+	server.mu.Unlock()
+
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	server.received <- struct{}{}
+}
+
+func (server *webhookServer) wait(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-server.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+// waitFor polls until done reports true
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestDispatcherRetriesFromOutbox(t *testing.T) {
+	server := &webhookServer{failures: 1, received: make(chan struct{}, 2)}
+	endpoint := httptest.NewServer(server)
+	defer endpoint.Close()
+
+	store := config.NewStore(&config.Config{
+		Webhooks:           []config.Webhook{{URL: endpoint.URL, Secret: "secret"}},
+		WebhookMaxAttempts: 3,
+		WebhookTimeout:     5,
+	}, config.Options{}, nil)
+
+	outbox := t.TempDir()
+	log, err := NewDeliveryLog(filepath.Join(t.TempDir(), "deliveries.log"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	d, err := NewDispatcher(store, outbox, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{ID: "1", Type: ObjectCreated, Time: time.Now(), Target: "default", Key: "a.txt"}
+	d.Enqueue(event)
+	server.wait(t)
+
+	// the failed attempt is kept in the outbox with its retry time
+	var stored Delivery
+	waitFor(t, "the retry to be scheduled", func() bool {
+		data, err := os.ReadFile(filepath.Join(outbox, deliveryID(event.ID, endpoint.URL)+".json"))
+		return err == nil && json.Unmarshal(data, &stored) == nil && stored.Attempts == 1
+	})
+	if until := time.Until(stored.NextAttempt); until <= 0 || until > retryBaseDelay {
+		t.Errorf("retry in %s, want at most %s", until, retryBaseDelay)
+	}
+	d.Close()
+
+	// a restarted dispatcher resumes the delivery
+	resumed, err := NewDispatcher(store, outbox, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	resumed.mu.Lock()
+	if resumed.pending[stored.ID] == nil {
+		resumed.mu.Unlock()
+		t.Fatal("delivery was not loaded from the outbox")
+	}
+	resumed.pending[stored.ID].NextAttempt = time.Now()
+	resumed.mu.Unlock()
+	resumed.notify()
+
+	server.wait(t)
+	waitFor(t, "the delivery to finish", func() bool { return resumed.Pending() == 0 })
+
+	if files, _ := filepath.Glob(filepath.Join(outbox, "*.json")); len(files) > 0 {
+		t.Errorf("delivered events are still in the outbox: %v", files)
+	}
+
+	entries, err := log.Search(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Status != StatusDelivered || entries[0].Attempt != 2 || entries[1].Status != StatusRetrying {
+		t.Errorf("logged %+v, want a retry and a delivery on the second attempt", entries)
+	}
+
+	// the same delivery, signed over its timestamp and body
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for i, request := range server.requests {
+		signature := "sha256=" + Sign("secret", request.Header.Get(HeaderTimestamp), server.bodies[i])
+		if request.Header.Get(HeaderSignature) != signature || request.Header.Get(HeaderDelivery) != stored.ID {
+			t.Errorf("request %d has signature %q and delivery %q", i+1, request.Header.Get(HeaderSignature), request.Header.Get(HeaderDelivery))
+		}
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	server := &webhookServer{failures: 1, received: make(chan struct{}, 1)}
+	endpoint := httptest.NewServer(server)
+	defer endpoint.Close()
+
+	store := config.NewStore(&config.Config{
+		Webhooks:           []config.Webhook{{URL: endpoint.URL}},
+		WebhookMaxAttempts: 1,
+		WebhookTimeout:     5,
+	}, config.Options{}, nil)
+
+	log, err := NewDeliveryLog(filepath.Join(t.TempDir(), "deliveries.log"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	d, err := NewDispatcher(store, t.TempDir(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Enqueue(Event{ID: "1", Type: ObjectCreated, Time: time.Now(), Target: "default", Key: "a.txt"})
+	server.wait(t)
+	waitFor(t, "the delivery to be dropped", func() bool { return d.Pending() == 0 })
+
+	entries, err := log.Search(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Status != StatusFailed || entries[0].ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("logged %+v, want a single failed attempt", entries)
+	}
+}
@@ -0,0 +1,56 @@
+package imagemeta
+
+import "errors"
+
+// JPEG markers
+const (
+	markerSOI   = 0xD8
+	markerSOS   = 0xDA
+	markerAPP1  = 0xE1 // Exif and XMP
+	markerAPP13 = 0xED // IPTC and Photoshop resources
+	markerCOM   = 0xFE
+)
+
+// JPEG segments removed by Clean, the rest (JFIF, ICC profiles, Adobe) is kept
+var droppedSegments = map[byte]bool{
+	markerAPP1:  true,
+	markerAPP13: true,
+	markerCOM:   true,
+}
+
+// PNG chunks removed by Clean
+var droppedChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// WebP chunks removed by Clean, with the VP8X flag announcing them
+var droppedWebPChunks = map[string]byte{
+	"EXIF": 0x08,
+	"XMP ": 0x04,
+}
+
+var (
+	// ErrTooLarge is returned for images over MaxPixels that would have to be decoded
+	ErrTooLarge = errors.New("image is too large")
+
+	// ErrOrientedWebP is returned for WebP images with an Exif orientation, which cannot be applied
+	ErrOrientedWebP = errors.New("the Exif orientation of WebP images cannot be applied")
+)
+
+var (
+	jpegSignature = []byte{0xFF, markerSOI}
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader    = []byte("Exif\x00\x00")
+)
+
+const tagOrientation = 0x0112
+
+// MaxPixels is the largest image decoded, larger images are refused instead of being decoded into memory
+const MaxPixels = 50_000_000
+
+// quality used when a JPEG has to be re-encoded to apply its orientation
+const jpegQuality = 92
@@ -0,0 +1,94 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Orientation returns the Exif orientation of a JPEG, PNG or WebP image, 1 when it has none.
+// 2 to 8 mean the pixels are stored flipped or rotated, see Orient.
+func Orientation(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		segments, err := jpegSegments(data)
+		if err == nil {
+			return jpegOrientation(segments)
+		}
+	case bytes.HasPrefix(data, pngSignature):
+		chunks, _ := pngChunks(data)
+		for _, chunk := range chunks {
+			if chunk.kind == "eXIf" {
+				return tiffOrientation(chunk.payload)
+			}
+		}
+	case isWebP(data):
+		chunks, err := webpChunks(data)
+		if err == nil {
+			return webpOrientation(chunks)
+		}
+	}
+
+	return 1
+}
+
+// webpOrientation reads the orientation from the EXIF chunk of a WebP image. The chunk should hold
+// the TIFF data right away, some encoders put the JPEG Exif header in front of it.
+func webpOrientation(chunks []segment) int {
+	for _, chunk := range chunks {
+		if chunk.kind == "EXIF" {
+			return tiffOrientation(bytes.TrimPrefix(chunk.payload, exifHeader))
+		}
+	}
+
+	return 1
+}
+
+// jpegOrientation reads the orientation from the Exif segment of a JPEG
+func jpegOrientation(segments []segment) int {
+	for _, s := range segments {
+		if s.kind[0] == markerAPP1 && bytes.HasPrefix(s.payload, exifHeader) {
+			return tiffOrientation(s.payload[len(exifHeader):])
+		}
+	}
+
+	return 1
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of Exif data
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) == tagOrientation {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			break
+		}
+	}
+
+	return 1
+}
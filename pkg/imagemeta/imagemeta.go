@@ -0,0 +1,271 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+)
+
+// Clean removes Exif, XMP, IPTC and text metadata from a JPEG, PNG or WebP image, e.g. the camera
+// location, and applies the Exif orientation to the pixels first. Images without an orientation
+// are not re-encoded. Other data is returned unchanged.
+//
+// Images over MaxPixels that would have to be decoded fail with ErrTooLarge, WebP images with an
+// orientation with ErrOrientedWebP.
+func Clean(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		return cleanJPEG(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return cleanPNG(data)
+	case isWebP(data):
+		return cleanWebP(data)
+	}
+
+	return data, nil
+}
+
+// IsImage reports whether data starts like a JPEG, PNG or WebP image
+func IsImage(data []byte) bool {
+	return bytes.HasPrefix(data, jpegSignature) || bytes.HasPrefix(data, pngSignature) || isWebP(data)
+}
+
+// checkSize reads the dimensions of an image before it is decoded, a small file can still hold a huge image
+func checkSize(data []byte) error {
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if header.Width*header.Height > MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooLarge, header.Width, header.Height)
+	}
+
+	return nil
+}
+
+// segment is a JPEG marker segment or a PNG or WebP chunk
+type segment struct {
+	kind    string // marker byte for JPEG, chunk type otherwise
+	raw     []byte // the whole segment as stored
+	payload []byte
+}
+
+func cleanJPEG(data []byte) ([]byte, error) {
+	segments, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(jpegSignature)
+	for _, s := range segments {
+		if !droppedSegments[s.kind[0]] {
+			out.Write(s.raw)
+		}
+	}
+
+	orientation := jpegOrientation(segments)
+	if orientation == 1 {
+		return out.Bytes(), nil
+	}
+
+	if err := checkSize(data); err != nil {
+		return nil, err
+	}
+
+	// the encoder writes no metadata of its own
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	out.Reset()
+	if err := jpeg.Encode(&out, Orient(img, orientation), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// jpegSegments splits a JPEG into its marker segments, the last one holds the scan data up to the end
+func jpegSegments(data []byte) ([]segment, error) {
+	var segments []segment
+	for pos := len(jpegSignature); ; {
+		if pos+1 >= len(data) || data[pos] != 0xFF {
+			return nil, errors.New("invalid JPEG: missing marker")
+		}
+
+		// markers may be padded with 0xFF
+		start := pos
+		for pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+1 >= len(data) {
+			return nil, errors.New("invalid JPEG: truncated marker")
+		}
+		marker := data[pos+1]
+
+		switch {
+		case marker == markerSOS:
+			return append(segments, segment{kind: string([]byte{marker}), raw: data[start:]}), nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			segments = append(segments, segment{kind: string([]byte{marker}), raw: data[start : pos+2]})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, errors.New("invalid JPEG: truncated segment")
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end < pos+4 || end > len(data) {
+			return nil, fmt.Errorf("invalid JPEG: bad length for marker %#x", marker)
+		}
+
+		segments = append(segments, segment{kind: string([]byte{marker}), raw: data[start:end], payload: data[pos+4 : end]})
+		pos = end
+	}
+}
+
+func cleanPNG(data []byte) ([]byte, error) {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	orientation := 1
+	for _, chunk := range chunks {
+		if chunk.kind == "eXIf" {
+			orientation = tiffOrientation(chunk.payload)
+		}
+
+		if !droppedChunks[chunk.kind] {
+			out.Write(chunk.raw)
+		}
+	}
+
+	if orientation == 1 {
+		return out.Bytes(), nil
+	}
+
+	if err := checkSize(data); err != nil {
+		return nil, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	out.Reset()
+	if err := png.Encode(&out, Orient(img, orientation)); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// pngChunks splits a PNG into its chunks, anything after IEND is dropped
+func pngChunks(data []byte) ([]segment, error) {
+	var chunks []segment
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, errors.New("invalid PNG: truncated chunk")
+		}
+
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("invalid PNG: bad chunk length")
+		}
+
+		kind := string(data[pos+4 : pos+8])
+		chunks = append(chunks, segment{kind: kind, raw: data[pos:end], payload: data[pos+8 : pos+8+length]})
+		if kind == "IEND" {
+			break
+		}
+		pos = end
+	}
+
+	return chunks, nil
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// cleanWebP drops the EXIF and XMP chunks. There is no WebP encoder to apply the orientation with,
+// images that have one are refused rather than stored the wrong way up.
+func cleanWebP(data []byte) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if orientation := webpOrientation(chunks); orientation != 1 {
+		return nil, fmt.Errorf("%w: orientation %d", ErrOrientedWebP, orientation)
+	}
+
+	var flags byte
+	for _, chunk := range chunks {
+		flags |= droppedWebPChunks[chunk.kind]
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		if _, dropped := droppedWebPChunks[chunk.kind]; dropped {
+			continue
+		}
+
+		// VP8X announces the optional chunks in its flags
+		if chunk.kind == "VP8X" && len(chunk.payload) > 0 {
+			raw := append([]byte(nil), chunk.raw...)
+			raw[8] &^= flags
+			body.Write(raw)
+			continue
+		}
+
+		body.Write(chunk.raw)
+	}
+
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:], uint32(body.Len()))
+	return append(out, body.Bytes()...), nil
+}
+
+// webpChunks splits the RIFF container of a WebP image into its chunks
+func webpChunks(data []byte) ([]segment, error) {
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	if size+8 > len(data) || size < 4 {
+		return nil, errors.New("invalid WebP: bad RIFF size")
+	}
+	data = data[:size+8]
+
+	var chunks []segment
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, errors.New("invalid WebP: truncated chunk")
+		}
+
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length + length%2 // chunks are padded to an even size
+		if length < 0 || end > len(data) {
+			return nil, errors.New("invalid WebP: bad chunk length")
+		}
+
+		chunks = append(chunks, segment{kind: string(data[pos : pos+4]), raw: data[pos:end], payload: data[pos+8 : pos+8+length]})
+		pos = end
+	}
+
+	return chunks, nil
+}
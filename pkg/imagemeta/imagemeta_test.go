@@ -0,0 +1,258 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestOrientation(t *testing.T) {
+	for name, test := range map[string]struct {
+		data []byte
+		want int
+	}{
+		"jpeg little endian": {jpegFixture(t, 6, binary.LittleEndian), 6},
+		"jpeg big endian":    {jpegFixture(t, 8, binary.BigEndian), 8},
+		"jpeg without exif":  {jpegFixture(t, 0, nil), 1},
+		"png":                {pngFixture(t, 3), 3},
+		"png without exif":   {pngFixture(t, 0), 1},
+		"webp":               {webpFixture(5, false), 5},
+		"webp exif header":   {webpFixture(7, true), 7},
+		"not an image":       {[]byte("plain text"), 1},
+	} {
+		if got := Orientation(test.data); got != test.want {
+			t.Errorf("%s: orientation %d, want %d", name, got, test.want)
+		}
+	}
+}
+
+func TestCleanJPEG(t *testing.T) {
+	cleaned, err := Clean(jpegFixture(t, 6, binary.BigEndian))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(cleaned, exifHeader) || bytes.Contains(cleaned, []byte("secret comment")) {
+		t.Error("metadata was kept")
+	}
+
+	// 3x2 rotated by 90 degrees
+	img, err := jpeg.Decode(bytes.NewReader(cleaned))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(2, 3) {
+		t.Errorf("cleaned image is %v, want 2x3", size)
+	}
+}
+
+func TestCleanJPEGWithoutOrientation(t *testing.T) {
+	original := jpegFixture(t, 1, binary.LittleEndian)
+	cleaned, err := Clean(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not re-encoded, only the metadata segments are gone
+	plain := jpegFixture(t, 0, nil)
+	if !bytes.Equal(cleaned, plain) {
+		t.Errorf("cleaned image has %d bytes, want the %d of the image without metadata", len(cleaned), len(plain))
+	}
+}
+
+func TestCleanPNG(t *testing.T) {
+	cleaned, err := Clean(pngFixture(t, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(cleaned, []byte("eXIf")) || bytes.Contains(cleaned, []byte("tEXt")) {
+		t.Error("metadata was kept")
+	}
+
+	img, err := png.Decode(bytes.NewReader(cleaned))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(2, 3) {
+		t.Fatalf("cleaned image is %v, want 2x3", size)
+	}
+
+	// rotated 90 clockwise, the top left pixel ends up top right
+	if got := color.RGBAModel.Convert(img.At(1, 0)); got != topLeft {
+		t.Errorf("pixel at 1,0 is %v, want %v", got, topLeft)
+	}
+}
+
+func TestCleanRefusesHugeImages(t *testing.T) {
+	_, err := Clean(hugePNG(6))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+
+	// nothing to apply, the image is not decoded
+	if _, err := Clean(hugePNG(0)); err != nil {
+		t.Errorf("image without orientation: %v", err)
+	}
+}
+
+func TestCleanWebP(t *testing.T) {
+	cleaned, err := Clean(webpFixture(1, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(cleaned, []byte("EXIF")) {
+		t.Error("EXIF chunk was kept")
+	}
+
+	chunks, err := webpChunks(cleaned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || chunks[0].kind != "VP8X" || chunks[0].payload[0]&droppedWebPChunks["EXIF"] != 0 {
+		t.Errorf("VP8X still announces the EXIF chunk: %q", cleaned)
+	}
+
+	if _, err := Clean(webpFixture(6, false)); !errors.Is(err, ErrOrientedWebP) {
+		t.Errorf("oriented WebP: got %v, want ErrOrientedWebP", err)
+	}
+}
+
+var topLeft = color.RGBA{R: 255, A: 255}
+
+// testImage is 3x2 with a red top left pixel
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.RGBA{B: 255, A: 255})
+		}
+	}
+	img.Set(0, 0, topLeft)
+
+	return img
+}
+
+// exifFixture is TIFF data with an orientation tag
+func exifFixture(orientation int, order binary.ByteOrder) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], tagOrientation)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+
+	return tiff
+}
+
+// jpegFixture encodes testImage with an Exif segment and a comment, orientation 0 leaves both out
+func jpegFixture(t *testing.T, orientation int, order binary.ByteOrder) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if orientation == 0 {
+		return encoded.Bytes()
+	}
+
+	var data bytes.Buffer
+	data.Write(jpegSignature)
+	data.Write(jpegSegment(markerAPP1, append(append([]byte(nil), exifHeader...), exifFixture(orientation, order)...)))
+	data.Write(jpegSegment(markerCOM, []byte("secret comment")))
+	data.Write(encoded.Bytes()[len(jpegSignature):])
+
+	return data.Bytes()
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngFixture encodes testImage with an eXIf and a tEXt chunk, orientation 0 leaves both out
+func pngFixture(t *testing.T, orientation int) []byte {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+
+	if orientation == 0 {
+		return encoded.Bytes()
+	}
+
+	// the chunks go right after IHDR
+	headerEnd := len(pngSignature) + 25
+	var data bytes.Buffer
+	data.Write(encoded.Bytes()[:headerEnd])
+	data.Write(pngChunk("eXIf", exifFixture(orientation, binary.BigEndian)))
+	data.Write(pngChunk("tEXt", []byte("Comment\x00secret")))
+	data.Write(encoded.Bytes()[headerEnd:])
+
+	return data.Bytes()
+}
+
+// hugePNG announces a 10000x10000 image without pixel data, orientation 0 leaves out the eXIf chunk
+func hugePNG(orientation int) []byte {
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header, 10000)
+	binary.BigEndian.PutUint32(header[4:], 10000)
+	header[8], header[9] = 8, 2 // 8 bit RGB
+
+	data := append([]byte(nil), pngSignature...)
+	data = append(data, pngChunk("IHDR", header)...)
+	if orientation != 0 {
+		data = append(data, pngChunk("eXIf", exifFixture(orientation, binary.LittleEndian))...)
+	}
+
+	return append(data, pngChunk("IEND", nil)...)
+}
+
+func pngChunk(kind string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// webpFixture is a WebP container with a VP8X, an EXIF and an image chunk. The image chunk
+// is not valid, Clean does not decode WebP images.
+func webpFixture(orientation int, withExifHeader bool) []byte {
+	exif := exifFixture(orientation, binary.LittleEndian)
+	if withExifHeader {
+		exif = append(append([]byte(nil), exifHeader...), exif...)
+	}
+
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", []byte{droppedWebPChunks["EXIF"], 0, 0, 0, 2, 0, 0, 1, 0, 0})...)
+	body = append(body, webpChunk("EXIF", exif)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2f, 1, 2})...)
+
+	data := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return append(data, body...)
+}
+
+func webpChunk(kind string, payload []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(kind), uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+
+	return chunk
+}
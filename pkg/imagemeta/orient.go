@@ -0,0 +1,54 @@
+package imagemeta
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Orient returns img as it is meant to be displayed for an Exif orientation,
+// i.e. flipped and rotated so the orientation can be dropped
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	// 5 to 8 swap the sides
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2: // mirrored
+				dx = width - 1 - x
+			case 3: // rotated 180
+				dx, dy = width-1-x, height-1-y
+			case 4: // flipped
+				dy = height - 1 - y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = height-1-y, x
+			case 7: // transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90 counter clockwise
+				dx, dy = y, width-1-x
+			}
+
+			s, d := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"file-management-service/pkg/rotate"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	OutputStdout = "stdout"
+	OutputFile   = "file"
+)
+
+type contextKey struct{}
+
+// New creates a JSON logger writing to stdout or to a file rotated after maxSize bytes and every day.
+// The returned closer releases the file, it is a no-op for stdout.
+func New(output, path string, maxSize int64, level string) (*slog.Logger, io.Closer, error) {
+	var slogLevel slog.Level
+	if err := slogLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, fmt.Errorf("unknown log level: %s", level)
+	}
+
+	var writer io.WriteCloser
+	switch output {
+	case "", OutputStdout:
+		writer = nopCloser{os.Stdout}
+	case OutputFile:
+		file, err := rotate.New(path, maxSize, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		writer = file
+	default:
+		return nil, nil, fmt.Errorf("unknown log output: %s", output)
+	}
+
+	handler := slog.NewJSONHandler(writer, &slog.HandlerOptions{Level: slogLevel})
+	return slog.New(handler), writer, nil
+}
+
+// WithContext stores a logger in ctx
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// Middleware stores a logger carrying the request ID, and the key when the request names one,
+// in the request context and logs every request once it is answered.
+// It must run after the request ID middleware.
+func Middleware(base *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+
+			requestLogger := base.With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+			if key := c.QueryParam("path"); key != "" {
+				requestLogger = requestLogger.With("key", key)
+			}
+
+			request := c.Request()
+			c.SetRequest(request.WithContext(WithContext(request.Context(), requestLogger)))
+
+			// let echo write the error response first so the final status is known
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			level := slog.LevelInfo
+			switch {
+			case status >= 500:
+				level = slog.LevelError
+			case status >= 400:
+				level = slog.LevelWarn
+			}
+
+			requestLogger.Log(request.Context(), level, "request",
+				"method", request.Method,
+				"route", c.Path(),
+				"status", status,
+				"latency_ms", time.Since(start).Milliseconds(),
+				"ip", c.RealIP(),
+			)
+			return nil
+		}
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "file_service"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	s3Calls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_calls_total",
+		Help:      "S3 API calls by operation.",
+	}, []string{"operation"})
+
+	s3Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_errors_total",
+		Help:      "Failed S3 API calls by operation.",
+	}, []string{"operation"})
+
+	s3Duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_call_duration_seconds",
+		Help:      "S3 API call latency by operation, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	bytesUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes uploaded to S3.",
+	})
+
+	bytesReadInternally = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "internal_read_bytes_total",
+		Help:      "Bytes the service read from S3 itself, downloads through presigned links are not included.",
+	})
+
+	rateLimitRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by the rate limiter.",
+	})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts by outcome.",
+	}, []string{"status"})
+
+	uploadStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_stage_duration_seconds",
+		Help:      "Time spent in upload pipeline stages by stage.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"stage"})
+
+	uploadRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_rejections_total",
+		Help:      "Uploads rejected by upload pipeline stages by stage.",
+	}, []string{"stage"})
+)
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"file-management-service/pkg/cache"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts requests and records their latency per route and status
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+
+			// let echo write the error response first so the final status is known
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			// the route template keeps the label cardinality bounded
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			status := strconv.Itoa(c.Response().Status)
+			method := c.Request().Method
+
+			httpRequests.WithLabelValues(route, method, status).Inc()
+			httpDuration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+			return nil
+		}
+	}
+}
+
+// InstrumentS3 records every S3 API call sent through handlers
+func InstrumentS3(handlers *request.Handlers) {
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "metrics.S3Call",
+		Fn: func(r *request.Request) {
+			ObserveS3Call(r.Operation.Name, time.Since(r.Time), r.Error)
+		},
+	})
+}
+
+// ObserveS3Call records a single S3 call, used directly for calls that are not sent, like presigning
+func ObserveS3Call(operation string, duration time.Duration, err error) {
+	s3Calls.WithLabelValues(operation).Inc()
+	s3Duration.WithLabelValues(operation).Observe(duration.Seconds())
+
+	if err != nil {
+		s3Errors.WithLabelValues(operation).Inc()
+	}
+}
+
+// AddUploadedBytes counts bytes uploaded to S3
+func AddUploadedBytes(bytes int64) {
+	bytesUploaded.Add(float64(bytes))
+}
+
+// AddInternalReadBytes counts bytes the service read from S3 for its own work, such as thumbnails or hashing
+func AddInternalReadBytes(bytes int64) {
+	bytesReadInternally.Add(float64(bytes))
+}
+
+// RateLimitRejected counts a request denied by the rate limiter
+func RateLimitRejected() {
+	rateLimitRejections.Inc()
+}
+
+// WebhookDelivery counts a webhook delivery attempt by its outcome
+func WebhookDelivery(status string) {
+	webhookDeliveries.WithLabelValues(status).Inc()
+}
+
+// ObserveUploadStage records a run of an upload pipeline stage and whether it rejected the upload
+func ObserveUploadStage(stage string, duration time.Duration, rejected bool) {
+	uploadStageDuration.WithLabelValues(stage).Observe(duration.Seconds())
+
+	if rejected {
+		uploadRejections.WithLabelValues(stage).Inc()
+	}
+}
+
+// RegisterCache exposes the counters, size and hit ratio of a cache under the given name
+func RegisterCache(name string, stats func() cache.Stats) {
+	labels := prometheus.Labels{"cache": name}
+
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace, Name: "cache_hits_total", Help: "Cache hits.", ConstLabels: labels,
+		}, func() float64 { return float64(stats().Hits) }),
+
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace, Name: "cache_misses_total", Help: "Cache misses.", ConstLabels: labels,
+		}, func() float64 { return float64(stats().Misses) }),
+
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace, Name: "cache_evictions_total", Help: "Cache evictions.", ConstLabels: labels,
+		}, func() float64 { return float64(stats().Evictions) }),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "cache_entries", Help: "Entries in the cache.", ConstLabels: labels,
+		}, func() float64 { return float64(stats().Size) }),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "cache_hit_ratio", Help: "Hits divided by lookups since start.", ConstLabels: labels,
+		}, func() float64 {
+			current := stats()
+			if lookups := current.Hits + current.Misses; lookups > 0 {
+				return float64(current.Hits) / float64(lookups)
+			}
+			return 0
+		}),
+	)
+}
@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"file-management-service/pkg/apperror"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// digest hashes the body from the start and rewinds it. A body shorter or longer than
+// the size of the upload fails, S3 would otherwise store whatever was read.
+func digest(upload *Upload) (*digests, error) {
+	if _, err := upload.Body.Seek(0, io.SeekStart); err != nil {
+		return nil, apperror.Internal("failed to rewind the upload", err)
+	}
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	n, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), upload.Body)
+	if err != nil {
+		return nil, apperror.Internal("failed to read the upload", err)
+	}
+
+	if n != upload.Size {
+		return nil, apperror.BadRequest(fmt.Sprintf("upload of %s is truncated, read %d of %d bytes", upload.Key, n, upload.Size))
+	}
+
+	if _, err := upload.Body.Seek(0, io.SeekStart); err != nil {
+		return nil, apperror.Internal("failed to rewind the upload", err)
+	}
+
+	return &digests{md5: md5Hash.Sum(nil), sha256: sha256Hash.Sum(nil)}, nil
+}
+
+// verify compares the digests with the ones the client sent
+func (d *digests) verify(expected Checksums) error {
+	for _, check := range []struct {
+		name, expected string
+		actual         []byte
+	}{
+		{"MD5", expected.MD5, d.md5},
+		{"SHA-256", expected.SHA256, d.sha256},
+	} {
+		if check.expected != "" && check.expected != hex.EncodeToString(check.actual) {
+			return apperror.New(http.StatusBadRequest, apperror.CodeChecksumMismatch,
+				fmt.Sprintf("%s checksum mismatch, expected %s but received %s", check.name, check.expected, hex.EncodeToString(check.actual)))
+		}
+	}
+
+	return nil
+}
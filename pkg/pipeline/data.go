@@ -0,0 +1,37 @@
+package pipeline
+
+import "file-management-service/config"
+
+// name of the tracer used for stage spans
+const tracerName = "file-management-service/pkg/pipeline"
+
+// name of the stage checking the upload policy, it runs first whenever a policy applies
+const stagePolicy = "policy"
+
+// stages by the name used in UPLOAD_PIPELINES, config.Validate checks names against its own list
+var stages = map[string]func(*config.Config) (Stage, error){
+	config.StageStripMetadata: func(config *config.Config) (Stage, error) {
+		return &stripStage{maxSize: int64(config.StripMetadataMaxSize) << 20}, nil
+	},
+	config.StageScan: func(config *config.Config) (Stage, error) {
+		return newScanStage(config, false)
+	},
+	config.StageScanAfterStore: func(config *config.Config) (Stage, error) {
+		return newScanStage(config, true)
+	},
+}
+
+// stages that run once the file is stored
+var afterStore = map[string]bool{
+	config.StageScanAfterStore: true,
+}
+
+// bytes read to tell images from other files
+const sniffLength = 512
+
+// values of s3.MetaScanStatus
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "failed"
+)
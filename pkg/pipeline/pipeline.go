@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"file-management-service/config"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/metrics"
+	"file-management-service/pkg/s3"
+	"file-management-service/pkg/tracing"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// For builds the pipeline configured for objectKey, see config.UploadStages.
+// The upload policy of the key is checked before any other stage.
+func For(config *config.Config, objectKey string) (*Pipeline, error) {
+	pipeline := &Pipeline{staging: config.StagingPrefix}
+	if policy, found := config.PolicyFor(objectKey); found {
+		pipeline.before = append(pipeline.before, namedStage{stagePolicy, &policyCheck{policy}})
+	}
+
+	for _, name := range config.UploadStages(objectKey) {
+		build, found := stages[name]
+		if !found {
+			continue
+		}
+
+		stage, err := build(config)
+		if err != nil {
+			return nil, apperror.Internal(fmt.Sprintf("failed to set up upload stage %s", name), err)
+		}
+
+		if afterStore[name] {
+			pipeline.after = append(pipeline.after, namedStage{name, stage})
+		} else {
+			pipeline.before = append(pipeline.before, namedStage{name, stage})
+		}
+	}
+
+	return pipeline, nil
+}
+
+// Store passes the upload through the stages and stores it in between, stopping at the first
+// stage that rejects it. When stages run after storing, the file is stored below the staging prefix
+// and only moved to its key once they all accepted it, so a rejected file never replaces the current
+// one. Those stages remove the staged object themselves when they reject it.
+func (p *Pipeline) Store(ctx context.Context, upload *Upload) error {
+	if upload.Metadata == nil {
+		upload.Metadata = map[string]string{}
+	}
+
+	// the client checksums cover the file as sent, before any stage changed it
+	received := upload.Body
+	var sums *digests
+	if upload.Expected != (Checksums{}) {
+		var err error
+		if sums, err = digest(upload); err != nil {
+			return err
+		}
+
+		if err := sums.verify(upload.Expected); err != nil {
+			return err
+		}
+	}
+
+	for _, stage := range p.before {
+		if err := run(ctx, stage, upload); err != nil {
+			return err
+		}
+	}
+
+	if sums == nil || upload.Body != received {
+		var err error
+		if sums, err = digest(upload); err != nil {
+			return err
+		}
+	}
+
+	upload.Metadata[s3.MetaMD5] = hex.EncodeToString(sums.md5)
+	upload.Metadata[s3.MetaSHA256] = hex.EncodeToString(sums.sha256)
+
+	options := s3.UploadOptions{
+		ContentType:    upload.ContentType,
+		Metadata:       upload.Metadata,
+		Tags:           upload.Tags,
+		ContentMD5:     base64.StdEncoding.EncodeToString(sums.md5),
+		ChecksumSHA256: base64.StdEncoding.EncodeToString(sums.sha256),
+	}
+	upload.Stored = upload.Key
+	if len(p.after) > 0 {
+		upload.Stored = p.staging + stagingID() + "/" + upload.Key
+	}
+
+	if err := upload.Client.UploadFile(ctx, upload.Body, upload.Stored, options); err != nil {
+		return fmt.Errorf("Failed to upload file to S3: %w", err)
+	}
+
+	if len(p.after) == 0 {
+		return nil
+	}
+
+	if _, err := upload.Body.Seek(0, io.SeekStart); err != nil {
+		p.discard(ctx, upload)
+		return apperror.Internal("failed to rewind the upload", err)
+	}
+
+	for _, stage := range p.after {
+		if err := run(ctx, stage, upload); err != nil {
+			p.discard(ctx, upload)
+			return err
+		}
+	}
+
+	// the stages may have added metadata, e.g. the scan status
+	options = s3.UploadOptions{ContentType: upload.ContentType, Metadata: upload.Metadata}
+	if err := upload.Client.MoveWithMetadata(ctx, upload.Stored, upload.Key, options); err != nil {
+		p.discard(ctx, upload)
+		return fmt.Errorf("Failed to move the staged upload to its key: %w", err)
+	}
+
+	upload.Stored = upload.Key
+	return nil
+}
+
+// discard deletes the staged copy of a rejected upload unless a stage moved it away already
+func (p *Pipeline) discard(ctx context.Context, upload *Upload) {
+	if !strings.HasPrefix(upload.Stored, p.staging) {
+		return
+	}
+
+	if err := upload.Client.DeleteObject(ctx, upload.Stored); err != nil {
+		logger.FromContext(ctx).Warn("Failed to delete staged upload", "file", upload.Key, "staged", upload.Stored, "error", err)
+	}
+}
+
+// stagingID keeps concurrent uploads of the same key apart
+func stagingID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return time.Now().UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(id)
+}
+
+func run(ctx context.Context, stage namedStage, upload *Upload) (err error) {
+	ctx, span := tracing.Start(ctx, tracerName, "pipeline."+stage.name, attribute.String("s3.key", upload.Key))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	err = stage.stage.Process(ctx, upload)
+	metrics.ObserveUploadStage(stage.name, time.Since(start), err != nil)
+	if err != nil {
+		// rejections keep their status, anything else is a failure of the stage itself
+		var appErr *apperror.Error
+		if errors.As(err, &appErr) {
+			return err
+		}
+		return apperror.Internal(fmt.Sprintf("upload stage %s failed", stage.name), err)
+	}
+
+	// the next stage reads the body from the start again
+	if _, err = upload.Body.Seek(0, io.SeekStart); err != nil {
+		return apperror.Internal("failed to rewind the upload", err)
+	}
+
+	return nil
+}
+
+func (f StageFunc) Process(ctx context.Context, upload *Upload) error {
+	return f(ctx, upload)
+}
@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"file-management-service/config"
+	"strings"
+	"testing"
+)
+
+// names lists the stages in the order they run
+func names(stages []namedStage) string {
+	var names []string
+	for _, stage := range stages {
+		names = append(names, stage.name)
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestForPicksLongestPrefix(t *testing.T) {
+	settings := &config.Config{
+		ClamdAddress:          "127.0.0.1:3310",
+		ClamdTimeout:          1,
+		StagingPrefix:         ".staging/",
+		StripMetadataMaxSize:  1,
+		StripMetadataPrefixes: []string{"photos/"},
+		UploadPolicies:        []config.UploadPolicy{{Prefix: "photos/", MaxFileSize: 10}},
+		UploadPipelines: []config.UploadPipeline{
+			{Prefix: "", Stages: []string{config.StageScan}},
+			{Prefix: "photos/", Stages: []string{config.StageScanAfterStore}},
+			{Prefix: "photos/raw/", Stages: []string{}},
+		},
+	}
+
+	for key, want := range map[string]struct{ before, after string }{
+		"a.txt":            {config.StageScan, ""},
+		"photos/a.png":     {stagePolicy + "," + config.StageStripMetadata, config.StageScanAfterStore},
+		"photos/raw/a.png": {stagePolicy + "," + config.StageStripMetadata, ""},
+	} {
+		pipeline, err := For(settings, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the policy is checked first, stages after storing run once the file is staged
+		if names(pipeline.before) != want.before || names(pipeline.after) != want.after {
+			t.Errorf("%s: stages %q before and %q after storing, want %q and %q",
+				key, names(pipeline.before), names(pipeline.after), want.before, want.after)
+		}
+	}
+}
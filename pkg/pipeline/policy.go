@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"file-management-service/pkg/apperror"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Process checks the size and extension of the upload, and the type sniffed from its first bytes.
+// The content type sent by the client is not trusted.
+func (p *policyCheck) Process(ctx context.Context, upload *Upload) error {
+	policy := p.policy
+
+	if limit := policy.FileLimit(); limit > 0 && upload.Size > limit {
+		return apperror.TooLarge(fmt.Sprintf("%s is larger than the %d MB allowed below %q", path.Base(upload.Key), policy.MaxFileSize, policy.Prefix))
+	}
+
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(upload.Key), "."))
+	if matchesExtension(policy.DeniedExtensions, extension) ||
+		(len(policy.AllowedExtensions) > 0 && !matchesExtension(policy.AllowedExtensions, extension)) {
+		return apperror.UnsupportedMedia(fmt.Sprintf("files with the extension %q are not allowed below %q", extension, policy.Prefix))
+	}
+
+	if len(policy.AllowedTypes) == 0 {
+		return nil
+	}
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(upload.Body, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(header[:n]))
+	if !matchesType(policy.AllowedTypes, detected) {
+		return apperror.UnsupportedMedia(fmt.Sprintf("content of type %s is not allowed below %q, allowed are %s",
+			detected, policy.Prefix, strings.Join(policy.AllowedTypes, ", ")))
+	}
+
+	return nil
+}
+
+// matchesExtension compares extensions case insensitively, with or without the dot
+func matchesExtension(extensions []string, extension string) bool {
+	for _, candidate := range extensions {
+		if strings.EqualFold(strings.TrimPrefix(candidate, "."), extension) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesType accepts exact MIME types and families like image/*
+func matchesType(types []string, contentType string) bool {
+	for _, candidate := range types {
+		candidate = strings.ToLower(candidate)
+		if candidate == contentType || (strings.HasSuffix(candidate, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(candidate, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
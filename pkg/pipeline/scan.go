@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"file-management-service/config"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/clamd"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/s3"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+func newScanStage(config *config.Config, afterStore bool) (Stage, error) {
+	scanner, err := clamd.New(config.ClamdAddress, time.Duration(config.ClamdTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scanStage{scanner: scanner, quarantine: config.QuarantinePrefix, afterStore: afterStore}, nil
+}
+
+// Process scans the upload. Infected files are quarantined and rejected. Files that could not
+// be scanned are rejected too, once staged they are quarantined as well so nothing unscanned stays.
+func (s *scanStage) Process(ctx context.Context, upload *Upload) error {
+	result, err := s.scanner.Scan(ctx, upload.Body)
+
+	upload.Metadata[s3.MetaScannedAt] = time.Now().UTC().Format(time.RFC3339)
+	switch {
+	case err != nil:
+		upload.Metadata[s3.MetaScanStatus] = ScanFailed
+	case result.Infected:
+		upload.Metadata[s3.MetaScanStatus] = ScanInfected
+		upload.Metadata[s3.MetaScanSignature] = result.Signature
+	default:
+		upload.Metadata[s3.MetaScanStatus] = ScanClean
+	}
+
+	// a staged file gets its status when it is moved to its key
+	if err == nil && !result.Infected {
+		return nil
+	}
+
+	if err == nil || s.afterStore {
+		if quarantineErr := s.quarantineUpload(ctx, upload); quarantineErr != nil {
+			return apperror.Internal("failed to quarantine upload", quarantineErr)
+		}
+	}
+
+	switch {
+	case errors.Is(err, clamd.ErrTooLarge):
+		return apperror.TooLarge("file is too large to be scanned for malware")
+	case err != nil:
+		return apperror.New(http.StatusServiceUnavailable, apperror.CodeScanUnavailable, fmt.Sprintf("malware scan failed: %s", err))
+	}
+
+	logger.FromContext(ctx).Warn("Malware detected in upload", "file", upload.Key, "signature", result.Signature)
+	return apperror.New(http.StatusUnprocessableEntity, apperror.CodeMalwareDetected,
+		fmt.Sprintf("upload rejected, malware detected: %s", result.Signature))
+}
+
+// quarantineUpload keeps the file below the quarantine prefix, by time so repeated uploads
+// of a key do not replace each other. A staged file is moved there.
+func (s *scanStage) quarantineUpload(ctx context.Context, upload *Upload) error {
+	key := s.quarantine + time.Now().UTC().Format("20060102T150405.000Z") + "/" + upload.Key
+	options := s3.UploadOptions{ContentType: upload.ContentType, Metadata: upload.Metadata, Tags: upload.Tags}
+
+	if !s.afterStore {
+		if _, err := upload.Body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		return upload.Client.UploadFile(ctx, upload.Body, key, options)
+	}
+
+	if err := upload.Client.MoveWithMetadata(ctx, upload.Stored, key, options); err != nil {
+		return err
+	}
+
+	upload.Stored = key
+	return nil
+}
@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/imagemeta"
+	"fmt"
+	"io"
+)
+
+// Process removes the metadata of JPEG, PNG and WebP images and applies their orientation. Images
+// are read into memory, those larger than maxSize are rejected before more of them is read. Other
+// files are passed on as they are, without reading them into memory.
+func (s *stripStage) Process(ctx context.Context, upload *Upload) error {
+	header := make([]byte, sniffLength)
+	n, _ := io.ReadFull(upload.Body, header)
+	if !imagemeta.IsImage(header[:n]) {
+		return nil
+	}
+
+	if _, err := upload.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(upload.Body, s.maxSize+1))
+	if err != nil {
+		return err
+	}
+
+	if int64(len(data)) > s.maxSize {
+		return apperror.TooLarge(fmt.Sprintf("Failed to remove image metadata: images over %d MB are not accepted", s.maxSize>>20))
+	}
+
+	cleaned, err := imagemeta.Clean(data)
+	switch {
+	case errors.Is(err, imagemeta.ErrTooLarge):
+		return apperror.BadRequest(fmt.Sprintf("Failed to remove image metadata: %s", err))
+	case err != nil:
+		return apperror.UnsupportedMedia(fmt.Sprintf("Failed to remove image metadata: %s", err))
+	}
+
+	upload.Body, upload.Size = bytes.NewReader(cleaned), int64(len(cleaned))
+	return nil
+}
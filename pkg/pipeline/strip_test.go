@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file-management-service/pkg/apperror"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func pngImage(t *testing.T) []byte {
+	var data bytes.Buffer
+	if err := png.Encode(&data, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	return data.Bytes()
+}
+
+func TestStripRejectsLargeImages(t *testing.T) {
+	data := pngImage(t)
+	stage := &stripStage{maxSize: int64(len(data)) - 1}
+
+	err := stage.Process(context.Background(), &Upload{Body: bytes.NewReader(data), Size: int64(len(data))})
+
+	var appErr *apperror.Error
+	if !errors.As(err, &appErr) || appErr.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("image over the limit: %v, want 413", err)
+	}
+}
+
+func TestStripKeepsOtherFiles(t *testing.T) {
+	stage := &stripStage{maxSize: 1}
+	body := bytes.NewReader([]byte("plain text, larger than the image limit"))
+
+	upload := &Upload{Body: body, Size: body.Size()}
+	if err := stage.Process(context.Background(), upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if upload.Body != body {
+		t.Error("a file that is no image was replaced")
+	}
+}
+
+func TestStripCleansImages(t *testing.T) {
+	data := pngImage(t)
+	stage := &stripStage{maxSize: int64(len(data))}
+
+	upload := &Upload{Body: bytes.NewReader(data), Size: int64(len(data))}
+	if err := stage.Process(context.Background(), upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if upload.Size <= 0 {
+		t.Errorf("cleaned image has %d bytes", upload.Size)
+	}
+}
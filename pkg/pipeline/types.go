@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"context"
+	"file-management-service/config"
+	"file-management-service/pkg/clamd"
+	"file-management-service/pkg/s3"
+	"io"
+)
+
+// Upload is a file on its way to storage. Stages may read it, replace its body,
+// or annotate it with metadata stored along with the object.
+type Upload struct {
+	Key         string
+	Client      *s3.S3        // client of the target the file is stored in
+	Body        io.ReadSeeker // read from the start by every stage, rewound in between
+	Size        int64
+	ContentType string            // as sent by the client, stored with the object
+	Metadata    map[string]string // stored as x-amz-meta-* headers
+	Tags        map[string]string // object tags sent by the client
+
+	// key the file was stored at, below the staging prefix until the stages after storing accepted it
+	Stored string
+
+	// digests sent by the client, checked against the body as received
+	Expected Checksums
+}
+
+// Checksums are the hex encoded digests of a file, empty when unknown
+type Checksums struct {
+	MD5    string
+	SHA256 string
+}
+
+// Stage is one step of a pipeline, returning an error rejects the upload.
+// Rejections should be *apperror.Error so the client gets a matching status.
+type Stage interface {
+	Process(ctx context.Context, upload *Upload) error
+}
+
+// StageFunc adapts a function to a Stage
+type StageFunc func(ctx context.Context, upload *Upload) error
+
+// Pipeline runs the stages configured for a key prefix in order, around storing the file
+type Pipeline struct {
+	before  []namedStage
+	after   []namedStage // run once the file is stored
+	staging string       // key prefix files are stored below until the after stages accepted them
+}
+
+type namedStage struct {
+	name  string
+	stage Stage
+}
+
+// stripStage removes the metadata of images up to maxSize bytes, larger ones are rejected
+type stripStage struct {
+	maxSize int64
+}
+
+// scanStage sends uploads to a clamd compatible scanner and quarantines infected files
+type scanStage struct {
+	scanner    *clamd.Client
+	quarantine string // key prefix infected files are moved to
+	afterStore bool
+}
+
+// policyCheck rejects files the upload policy of their prefix does not allow
+type policyCheck struct {
+	policy config.UploadPolicy
+}
+
+// digests of the body about to be stored
+type digests struct {
+	md5    []byte
+	sha256 []byte
+}
@@ -0,0 +1,120 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Writer is an append only file that is rotated once it grows past a maximum size
+// or, when daily is set, once the date changes. Rotated files keep the path with a timestamp suffix.
+type Writer struct {
+	path    string
+	maxSize int64
+	daily   bool
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// New opens the file at path for appending, zero maxSize disables size based rotation
+func New(path string, maxSize int64, daily bool) (*Writer, error) {
+	w := &Writer{path: path, maxSize: maxSize, daily: daily}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
+
+// Files returns the rotated files of path, oldest first, followed by path itself
+func Files(path string) ([]string, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	// the timestamp suffix sorts chronologically
+	sort.Strings(rotated)
+	return append(rotated, path), nil
+}
+
+func (w *Writer) shouldRotate(next int64) bool {
+	if w.maxSize > 0 && w.size > 0 && w.size+next > w.maxSize {
+		return true
+	}
+
+	if w.daily {
+		y1, m1, d1 := w.opened.Date()
+		y2, m2, d2 := time.Now().Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+
+	return false
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := w.path + "." + time.Now().Format("20060102-150405.000000")
+	if err := os.Rename(w.path, rotated); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	w.opened = info.ModTime()
+	if w.size == 0 {
+		w.opened = time.Now()
+	}
+
+	return nil
+}
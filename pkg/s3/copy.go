@@ -0,0 +1,175 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/logger"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+// copyObject copies the object source was read from to destinationKey, replacing its content type
+// when options has one and its user metadata. The other headers, its storage class, encryption and
+// tags are carried over and S3 stores a SHA-256 checksum of the copy. The copy only succeeds while
+// the source is still the one that was read, a changed source fails it with a conflict to retry.
+// Objects larger than a single copy allows are copied in parts. opts apply to the request writing
+// the copy, the single copy or the completion of the parts.
+func (s *S3) copyObject(ctx context.Context, source *s3.HeadObjectOutput, sourceKey, destinationKey string, options UploadOptions, opts ...request.Option) error {
+	contentType := source.ContentType
+	if options.ContentType != "" {
+		contentType = aws.String(options.ContentType)
+	}
+
+	copySource := aws.String((&url.URL{Path: s.bucketName + "/" + sourceKey}).EscapedPath())
+	metadata := aws.StringMap(s.withReference(sourceKey, options.Metadata))
+
+	var expires *time.Time
+	if at, err := http.ParseTime(aws.StringValue(source.Expires)); err == nil {
+		expires = aws.Time(at)
+	}
+
+	var err error
+	if aws.Int64Value(source.ContentLength) > maxCopySize {
+		err = s.copyParts(ctx, source, sourceKey, &s3.CreateMultipartUploadInput{
+			Bucket:                  aws.String(s.bucketName),
+			Key:                     aws.String(destinationKey),
+			Metadata:                metadata,
+			ContentType:             contentType,
+			CacheControl:            source.CacheControl,
+			ContentDisposition:      source.ContentDisposition,
+			ContentEncoding:         source.ContentEncoding,
+			ContentLanguage:         source.ContentLanguage,
+			Expires:                 expires,
+			WebsiteRedirectLocation: source.WebsiteRedirectLocation,
+			StorageClass:            source.StorageClass,
+			ServerSideEncryption:    source.ServerSideEncryption,
+			SSEKMSKeyId:             source.SSEKMSKeyId,
+			BucketKeyEnabled:        source.BucketKeyEnabled,
+			ChecksumAlgorithm:       aws.String(s3.ChecksumAlgorithmSha256),
+		}, opts...)
+	} else {
+		_, err = s.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:                  aws.String(s.bucketName),
+			CopySource:              copySource,
+			CopySourceIfMatch:       source.ETag,
+			Key:                     aws.String(destinationKey),
+			MetadataDirective:       aws.String(s3.MetadataDirectiveReplace),
+			Metadata:                metadata,
+			ContentType:             contentType,
+			CacheControl:            source.CacheControl,
+			ContentDisposition:      source.ContentDisposition,
+			ContentEncoding:         source.ContentEncoding,
+			ContentLanguage:         source.ContentLanguage,
+			Expires:                 expires,
+			WebsiteRedirectLocation: source.WebsiteRedirectLocation,
+			StorageClass:            source.StorageClass,
+			ServerSideEncryption:    source.ServerSideEncryption,
+			SSEKMSKeyId:             source.SSEKMSKeyId,
+			BucketKeyEnabled:        source.BucketKeyEnabled,
+			ChecksumAlgorithm:       aws.String(s3.ChecksumAlgorithmSha256),
+		}, opts...)
+	}
+
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusPreconditionFailed {
+		return apperror.Conflict(fmt.Sprintf("%s changed while it was copied, retry", sourceKey))
+	}
+
+	return err
+}
+
+// copyParts copies a large object with a multipart upload whose parts are copied server side. The
+// parts only copy the source as it was when source was read. A multipart upload starts without
+// tags, so they are read and set on it. opts apply to the completion.
+func (s *S3) copyParts(ctx context.Context, source *s3.HeadObjectOutput, sourceKey string, input *s3.CreateMultipartUploadInput, opts ...request.Option) (err error) {
+	tags, err := s.Tags(ctx, sourceKey)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) > 0 {
+		input.Tagging = aws.String(tagging(tags))
+	}
+
+	upload, err := s.svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		_, abortErr := s.svc.AbortMultipartUploadWithContext(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   input.Bucket,
+			Key:      input.Key,
+			UploadId: upload.UploadId,
+		})
+		if abortErr != nil {
+			logger.FromContext(ctx).Warn("Failed to abort multipart copy", "file", aws.StringValue(input.Key), "error", abortErr)
+		}
+	}()
+
+	var mu sync.Mutex
+	parts := []*s3.CompletedPart{}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(copyConcurrency)
+
+	size := aws.Int64Value(source.ContentLength)
+	for number, start := int64(1), int64(0); start < size; number, start = number+1, start+copyPartSize {
+		number, start := number, start
+
+		group.Go(func() error {
+			output, err := s.svc.UploadPartCopyWithContext(groupCtx, &s3.UploadPartCopyInput{
+				Bucket:            input.Bucket,
+				Key:               input.Key,
+				UploadId:          upload.UploadId,
+				PartNumber:        aws.Int64(number),
+				CopySource:        aws.String((&url.URL{Path: s.bucketName + "/" + sourceKey}).EscapedPath()),
+				CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, min(start+copyPartSize, size)-1)),
+				CopySourceIfMatch: source.ETag,
+			})
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			parts = append(parts, &s3.CompletedPart{
+				PartNumber:     aws.Int64(number),
+				ETag:           output.CopyPartResult.ETag,
+				ChecksumSHA256: output.CopyPartResult.ChecksumSHA256,
+			})
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+
+	_, err = s.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}, opts...)
+	return err
+}
@@ -0,0 +1,279 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"file-management-service/pkg/apperror"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// copyServer records the copy requests of a client and answers them like S3 does
+type copyServer struct {
+	mu       sync.Mutex
+	headers  []http.Header // of CopyObject and CreateMultipartUpload
+	ranges   []string      // of UploadPartCopy
+	parts    [][]string    // part numbers listed by CompleteMultipartUpload
+	aborted  bool
+	failPart bool // parts fail as if the source changed
+	failCopy bool // copies fail as if the source changed
+
+	objects    map[string]int64 // sizes of the keys HEAD finds
+	completed  http.Header      // of CompleteMultipartUpload
+	deletes    []http.Header    // of DeleteObject
+	failDelete bool             // deletes fail as if the source changed
+}
+
+func (server *copyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Has("tagging"):
+		fmt.Fprint(w, `<Tagging><TagSet><Tag><Key>project</Key><Value>apollo</Value></Tag></TagSet></Tagging>`)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		server.headers = append(server.headers, r.Header.Clone())
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		if server.failPart {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		server.ranges = append(server.ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+		fmt.Fprintf(w, `<CopyPartResult><ETag>"p%s"</ETag></CopyPartResult>`, query.Get("partNumber"))
+	case r.Method == http.MethodHead:
+		size, found := server.objects[strings.TrimPrefix(r.URL.Path, "/b/")]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("ETag", `"e"`)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Amz-Meta-Owner", "ana")
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		server.completed = r.Header.Clone()
+		body, _ := io.ReadAll(r.Body)
+		server.parts = regexp.MustCompile(`<PartNumber>(\d+)</PartNumber>`).FindAllStringSubmatch(string(body), -1)
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"m"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		server.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		server.deletes = append(server.deletes, r.Header.Clone())
+		if server.failDelete {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && server.failCopy:
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+	case r.Method == http.MethodPut:
+		server.headers = append(server.headers, r.Header.Clone())
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"c"</ETag></CopyObjectResult>`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// newTestClient returns a client of bucket b whose requests handler answers
+func newTestClient(t *testing.T, handler http.Handler) *S3 {
+	endpoint := httptest.NewServer(handler)
+	t.Cleanup(endpoint.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(endpoint.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+	}))
+
+	return &S3{svc: s3.New(sess), bucketName: "b", target: "default"}
+}
+
+func headOutput(size int64) *s3.HeadObjectOutput {
+	return &s3.HeadObjectOutput{
+		ContentLength:      aws.Int64(size),
+		ContentType:        aws.String("text/plain"),
+		ContentDisposition: aws.String(`attachment; filename="report.txt"`),
+		CacheControl:       aws.String("max-age=60"),
+		ContentEncoding:    aws.String("gzip"),
+		ETag:               aws.String(`"e"`),
+		Expires:            aws.String("Wed, 21 Oct 2026 07:28:00 GMT"),
+		StorageClass:       aws.String("STANDARD_IA"),
+
+		ServerSideEncryption:    aws.String("aws:kms"),
+		SSEKMSKeyId:             aws.String("key-1"),
+		WebsiteRedirectLocation: aws.String("/other.txt"),
+	}
+}
+
+func TestCopyObjectKeepsHeaders(t *testing.T) {
+	server := &copyServer{}
+	client := newTestClient(t, server)
+
+	err := client.copyObject(context.Background(), headOutput(10), "a.txt", "a.txt", UploadOptions{Metadata: map[string]string{"owner": "ana"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := server.headers[0]
+	for name, want := range map[string]string{
+		"Content-Type":                                "text/plain",
+		"Content-Disposition":                         `attachment; filename="report.txt"`,
+		"Cache-Control":                               "max-age=60",
+		"Content-Encoding":                            "gzip",
+		"X-Amz-Metadata-Directive":                    "REPLACE",
+		"X-Amz-Meta-Owner":                            "ana",
+		"X-Amz-Checksum-Algorithm":                    "SHA256",
+		"X-Amz-Copy-Source":                           "b/a.txt",
+		"X-Amz-Copy-Source-If-Match":                  `"e"`,
+		"Expires":                                     "Wed, 21 Oct 2026 07:28:00 GMT",
+		"X-Amz-Storage-Class":                         "STANDARD_IA",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key-1",
+		"X-Amz-Website-Redirect-Location":             "/other.txt",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCopyObjectInParts(t *testing.T) {
+	server := &copyServer{}
+	client := newTestClient(t, server)
+
+	size := int64(maxCopySize + copyPartSize/2)
+	if err := client.copyObject(context.Background(), headOutput(size), "big.bin", "big.bin", UploadOptions{ContentType: "application/zip"}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := server.headers[0]
+	if header.Get("Content-Type") != "application/zip" || header.Get("Content-Disposition") == "" || header.Get("X-Amz-Tagging") != "project=apollo" ||
+		header.Get("X-Amz-Storage-Class") != "STANDARD_IA" || header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "key-1" {
+		t.Errorf("multipart upload created with %v", header)
+	}
+
+	wantParts := int((size + copyPartSize - 1) / copyPartSize)
+	if len(server.ranges) != wantParts || len(server.parts) != wantParts {
+		t.Fatalf("copied %d parts and completed %d, want %d", len(server.ranges), len(server.parts), wantParts)
+	}
+
+	for i, part := range server.parts {
+		if part[1] != strconv.Itoa(i+1) {
+			t.Fatalf("part %s completed as part %d, parts must be listed in order", part[1], i+1)
+		}
+	}
+
+	sort.Slice(server.ranges, func(i, j int) bool {
+		var a, b int64
+		fmt.Sscanf(server.ranges[i], "bytes=%d-", &a)
+		fmt.Sscanf(server.ranges[j], "bytes=%d-", &b)
+		return a < b
+	})
+	if last := server.ranges[wantParts-1]; last != fmt.Sprintf("bytes=%d-%d", int64(wantParts-1)*copyPartSize, size-1) {
+		t.Errorf("last part copies %s", last)
+	}
+}
+
+func TestCopyObjectInPartsAbortsOnFailure(t *testing.T) {
+	server := &copyServer{failPart: true}
+	client := newTestClient(t, server)
+
+	err := client.copyObject(context.Background(), headOutput(maxCopySize+1), "big.bin", "big.bin", UploadOptions{})
+
+	var appErr *apperror.Error
+	if !errors.As(err, &appErr) || appErr.Status != http.StatusConflict {
+		t.Fatalf("copy of a changed source: %v, want a conflict", err)
+	}
+
+	if !server.aborted {
+		t.Error("multipart upload was not aborted")
+	}
+}
+
+func TestCopyObjectOfChangedSource(t *testing.T) {
+	client := newTestClient(t, &copyServer{failCopy: true})
+
+	err := client.copyObject(context.Background(), headOutput(10), "a.txt", "a.txt", UploadOptions{})
+
+	var appErr *apperror.Error
+	if !errors.As(err, &appErr) || appErr.Status != http.StatusConflict {
+		t.Errorf("copy of a changed source: %v, want a conflict", err)
+	}
+}
+
+func TestMoveObject(t *testing.T) {
+	server := &copyServer{objects: map[string]int64{"a.txt": 10}}
+	client := newTestClient(t, server)
+
+	if err := client.MoveObject(context.Background(), "a.txt", "docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := server.headers[0]
+	for name, want := range map[string]string{
+		"If-None-Match":              "*",
+		"X-Amz-Copy-Source-If-Match": `"e"`,
+		"X-Amz-Meta-Owner":           "ana",
+		"Content-Type":               "text/plain",
+	} {
+		if got := copied.Get(name); got != want {
+			t.Errorf("copy %s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if len(server.deletes) != 1 || server.deletes[0].Get("If-Match") != `"e"` {
+		t.Errorf("source deleted with %v, want If-Match on the version read", server.deletes)
+	}
+}
+
+func TestMoveObjectInParts(t *testing.T) {
+	server := &copyServer{objects: map[string]int64{"big.bin": maxCopySize + 1}}
+	client := newTestClient(t, server)
+
+	if err := client.MoveObject(context.Background(), "big.bin", "archive/big.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	wantParts := (maxCopySize + copyPartSize) / copyPartSize
+	if len(server.parts) != wantParts || server.completed.Get("If-None-Match") != "*" {
+		t.Errorf("completed %d parts with %v, want %d with If-None-Match", len(server.parts), server.completed, wantParts)
+	}
+}
+
+func TestMoveObjectConflicts(t *testing.T) {
+	for name, test := range map[string]struct {
+		server  *copyServer
+		message string
+	}{
+		"destination exists": {&copyServer{failCopy: true, objects: map[string]int64{"a.txt": 10, "b.txt": 5}}, "already exists"},
+		"source changed":     {&copyServer{failCopy: true, objects: map[string]int64{"a.txt": 10}}, "changed"},
+		"changed after copy": {&copyServer{failDelete: true, objects: map[string]int64{"a.txt": 10}}, "changed"},
+	} {
+		err := newTestClient(t, test.server).MoveObject(context.Background(), "a.txt", "b.txt")
+
+		var appErr *apperror.Error
+		if !errors.As(err, &appErr) || appErr.Status != http.StatusConflict || !strings.Contains(appErr.Message, test.message) {
+			t.Errorf("%s: %v, want a conflict saying %q", name, err, test.message)
+		}
+	}
+}
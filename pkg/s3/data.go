@@ -1,9 +1,94 @@
 package s3
 
 import (
+	"regexp"
+	"sync"
 	"time"
 )
 
+// name of the tracer used for storage spans
+const tracerName = "file-management-service/pkg/s3"
+
+// AWS sessions by target name, see targetSession
+var sessions sync.Map
+
+// object below the blob prefix naming the dedup index that owns the shared content of a bucket,
+// see ClaimDedup
+const dedupOwnerName = ".owner"
+
+// owners of the shared content confirmed by ClaimDedup, by endpoint, bucket and key
+var claims sync.Map
+
+// cache keys of download links with their checksums start with it, see DownloadLink
+const downloadKeyPrefix = "download:"
+
+// maximum number of download URLs presigned in parallel for a listing
+const presignConcurrency = 16
+
+// maximum number of objects looked up in parallel for a listing
+const headConcurrency = 16
+
+// most pages listed to fill a page of files matching a tag filter, see listMatching
+const maxFilterPages = 10
+
+// page tokens starting with it hold the base64 key a page of files matching a tag filter was cut
+// after, the next page starts after that key, see cutAfter
+const startAfterToken = "after:"
+
+// largest object a single CopyObject copies, larger ones are copied in parts of copyPartSize,
+// copyConcurrency of them at a time
+const (
+	maxCopySize     = 5 << 30
+	copyPartSize    = 512 << 20
+	copyConcurrency = 8
+)
+
+// user metadata holding the hex digests of an object, written on upload
+const (
+	MetaMD5    = "md5"
+	MetaSHA256 = "sha256"
+)
+
+// user metadata of a key stored as a reference, naming the SHA-256 and size of its shared content
+const (
+	MetaDedupRef  = "dedup-ref"
+	MetaDedupSize = "dedup-size"
+)
+
+// user metadata written by the scan stages
+const (
+	MetaScanStatus    = "scan-status" // clean, infected or failed
+	MetaScanSignature = "scan-signature"
+	MetaScannedAt     = "scanned-at"
+)
+
+// user metadata the service writes itself. Clients can neither set nor replace it,
+// and it is left out of the metadata they read.
+var serviceMetadata = map[string]bool{
+	MetaMD5:           true,
+	MetaSHA256:        true,
+	MetaDedupRef:      true,
+	MetaDedupSize:     true,
+	MetaScanStatus:    true,
+	MetaScanSignature: true,
+	MetaScannedAt:     true,
+}
+
+// limits on what clients set. S3 allows 2 KB of user metadata per object, part of it is left
+// for serviceMetadata. Tags are limited by S3 itself.
+const (
+	maxUserMetadataSize = 1536
+	maxTags             = 10
+	maxTagKeyLength     = 128
+	maxTagValueLength   = 256
+)
+
+// metadata names are sent as header names, kept to characters every S3 implementation accepts
+var metadataName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// characters S3 allows in tag keys and values
+var tagCharacters = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
 var sizeRanges = map[string]FilterSizeRange{
 	"0-10MB":    {0, 10 * 1024 * 1024},
 	"10-100MB":  {10 * 1024 * 1024, 100 * 1024 * 1024},
@@ -0,0 +1,293 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/dedup"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/tracing"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UseDedup lets the client resolve keys stored as references to shared content,
+// and store uploads that way when DEDUP_ENABLED is set
+func (s *S3) UseDedup(index *dedup.Index) {
+	s.dedup = index
+}
+
+// ClaimDedup makes sure the index is the only one counting the references to the shared content of
+// the bucket. The first index to use it claims it with an object below the blob prefix holding the
+// ID of the index and the name of the target. Another index, e.g. of a second instance, would not
+// know those references and delete content they still use, so a claim held by any other index fails
+// with a conflict until that object is deleted. Confirmed claims are remembered.
+func (s *S3) ClaimDedup(ctx context.Context) (err error) {
+	if s.dedup == nil {
+		return nil
+	}
+
+	key := s.blobPrefix + dedupOwnerName
+	owner := s.dedup.ID() + " " + s.target
+	claim := s.svc.Endpoint + "/" + s.bucketName + "/" + key
+	if claimed, found := claims.Load(claim); found && claimed == owner {
+		return nil
+	}
+
+	ctx, span := s.startSpan(ctx, "s3.ClaimDedup", attribute.String("s3.key", key))
+	defer func() { tracing.End(span, err) }()
+
+	_, err = s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(owner),
+		ContentType: aws.String("text/plain"),
+	}, ifNoneMatch)
+
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusPreconditionFailed {
+		output, getErr := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucketName),
+			Key:    aws.String(key),
+		})
+		if getErr != nil {
+			return getErr
+		}
+		defer output.Body.Close()
+
+		current, readErr := io.ReadAll(io.LimitReader(output.Body, 1024))
+		if readErr != nil {
+			return readErr
+		}
+
+		if string(current) != owner {
+			return apperror.Conflict(fmt.Sprintf("the shared content of bucket %s is counted by another dedup index (%s), "+
+				"deduplication needs a single instance per bucket, delete %s to hand it over", s.bucketName, current, key))
+		}
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	claims.Store(claim, owner)
+	return nil
+}
+
+// DedupReport sums up the space deduplication saved in the target
+func (s *S3) DedupReport() dedup.Report {
+	return s.dedup.Report(s.target)
+}
+
+// uploadReference stores the content once below the blob prefix, named by its SHA-256, unless it
+// is stored already. The key itself becomes an empty object carrying the metadata and the reference.
+func (s *S3) uploadReference(ctx context.Context, src io.Reader, objectKey string, options UploadOptions) error {
+	digest, err := base64.StdEncoding.DecodeString(options.ChecksumSHA256)
+	if err != nil {
+		return fmt.Errorf("invalid SHA-256 checksum: %w", err)
+	}
+	sum := hex.EncodeToString(digest)
+
+	seeker, ok := src.(io.Seeker)
+	if !ok {
+		return errors.New("deduplicated uploads must be seekable")
+	}
+
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := s.ClaimDedup(ctx); err != nil {
+		return err
+	}
+
+	released, err := s.dedup.Link(s.target, objectKey, sum, size, func() error {
+		return s.putObject(ctx, src, s.blobPrefix+sum, UploadOptions{
+			ContentType:    options.ContentType,
+			ContentMD5:     options.ContentMD5,
+			ChecksumSHA256: options.ChecksumSHA256,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.release(ctx, released)
+
+	metadata := map[string]string{MetaDedupRef: sum, MetaDedupSize: strconv.FormatInt(size, 10)}
+	for name, value := range options.Metadata {
+		metadata[name] = value
+	}
+
+	if err := s.putObject(ctx, bytes.NewReader(nil), objectKey, UploadOptions{ContentType: options.ContentType, Metadata: metadata, Tags: options.Tags}); err != nil {
+		// without the key the reference must not keep the content alive
+		s.unlink(ctx, objectKey)
+		return err
+	}
+
+	return nil
+}
+
+// copyReference makes destinationKey refer to the content of sourceKey once the object was copied.
+// A copied regular object replaces whatever reference destinationKey was.
+func (s *S3) copyReference(ctx context.Context, sourceKey, destinationKey string) error {
+	sum, size, found := s.dedup.Lookup(s.target, sourceKey)
+	if !found {
+		return s.unlink(ctx, destinationKey)
+	}
+
+	released, err := s.dedup.Link(s.target, destinationKey, sum, size, func() error {
+		return fmt.Errorf("content of %s is missing from the dedup index", sourceKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.release(ctx, released)
+	return nil
+}
+
+// unlink drops the reference of a key that was deleted or replaced, removing content nothing refers to anymore
+func (s *S3) unlink(ctx context.Context, objectKey string) error {
+	released, err := s.dedup.Unlink(s.target, objectKey)
+	if err != nil {
+		return err
+	}
+
+	s.release(ctx, released)
+	return nil
+}
+
+// release deletes shared content without references. A failure only leaves the content
+// behind, the keys are consistent either way.
+func (s *S3) release(ctx context.Context, sum string) {
+	if sum == "" {
+		return
+	}
+
+	// without the claim other keys may still refer to it
+	if err := s.ClaimDedup(ctx); err != nil {
+		logger.FromContext(ctx).Warn("Kept unreferenced content", "sha256", sum, "error", err)
+		return
+	}
+
+	err := s.dedup.Release(s.target, sum, func() error {
+		_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucketName),
+			Key:    aws.String(s.blobPrefix + sum),
+		})
+		return err
+	})
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to remove unreferenced content", "sha256", sum, "error", err)
+	}
+}
+
+// contentKey returns the key the content of objectKey is stored at. ref is the reference the key
+// is known to carry, e.g. from a listing or its metadata, the index is asked when it is empty.
+func (s *S3) contentKey(objectKey, ref string) string {
+	if ref == "" {
+		ref, _, _ = s.dedup.Lookup(s.target, objectKey)
+	}
+
+	if ref != "" {
+		return s.blobPrefix + ref
+	}
+
+	return objectKey
+}
+
+// reference returns the shared content a key refers to, by the index or else by the reference in
+// its metadata, names in lower case. References stored by another instance, or before the index
+// was lost, resolve that way too.
+func (s *S3) reference(ctx context.Context, objectKey string, metadata map[string]string) (sum string, size int64, err error) {
+	if sum, size, found := s.dedup.Lookup(s.target, objectKey); found {
+		return sum, size, nil
+	}
+
+	sum = metadata[MetaDedupRef]
+	if sum == "" {
+		return "", 0, nil
+	}
+
+	if size, err := strconv.ParseInt(metadata[MetaDedupSize], 10, 64); err == nil {
+		return sum, size, nil
+	}
+
+	// references stored before their size was recorded
+	output, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.blobPrefix + sum),
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return sum, aws.Int64Value(output.ContentLength), nil
+}
+
+// findReferences looks up the empty files of a listing the index does not know with HEAD, so
+// references it misses are listed with their content too. Files whose lookup failed stay empty.
+func (s *S3) findReferences(ctx context.Context, objects []ObjectDetails) {
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, headConcurrency)
+
+	for i := range objects {
+		if objects[i].Size != 0 || objects[i].DedupRef != "" || strings.HasSuffix(objects[i].Name, "/") {
+			continue
+		}
+
+		wg.Add(1)
+		limit <- struct{}{}
+
+		go func(obj *ObjectDetails) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			info, err := s.ObjectInfo(ctx, obj.Name)
+			if err != nil {
+				logger.FromContext(ctx).Warn("Failed to look up empty file", "file", obj.Name, "error", err)
+				return
+			}
+
+			obj.DedupRef, obj.Size = info.DedupRef, info.Size
+		}(&objects[i])
+	}
+
+	wg.Wait()
+}
+
+// withReference adds the reference of a key to metadata about to replace its own
+func (s *S3) withReference(objectKey string, metadata map[string]string) map[string]string {
+	sum, size, found := s.dedup.Lookup(s.target, objectKey)
+	if !found {
+		return metadata
+	}
+
+	withRef := map[string]string{MetaDedupRef: sum, MetaDedupSize: strconv.FormatInt(size, 10)}
+	for name, value := range metadata {
+		withRef[name] = value
+	}
+
+	return withRef
+}
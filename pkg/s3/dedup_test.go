@@ -0,0 +1,107 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/dedup"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bucketServer keeps the objects written to it in memory and honours If-None-Match on PUT
+type bucketServer struct {
+	mu      sync.Mutex
+	objects map[string]string
+	deleted []string
+}
+
+func (server *bucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/b/")
+	content, found := server.objects[key]
+
+	switch r.Method {
+	case http.MethodPut:
+		if found && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		server.objects[key] = string(body)
+	case http.MethodGet:
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		io.WriteString(w, content)
+	case http.MethodDelete:
+		delete(server.objects, key)
+		server.deleted = append(server.deleted, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newDedupClient(t *testing.T, server *bucketServer, target string) *S3 {
+	index, err := dedup.Open(filepath.Join(t.TempDir(), "dedup.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+
+	client := newTestClient(t, server)
+	client.target, client.blobPrefix = target, ".blobs/"
+	client.UseDedup(index)
+	return client
+}
+
+func TestClaimDedup(t *testing.T) {
+	server := &bucketServer{objects: map[string]string{}}
+	client := newDedupClient(t, server, "claim-"+t.Name())
+
+	if err := client.ClaimDedup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.objects[".blobs/"+dedupOwnerName]; owner != client.dedup.ID()+" "+client.target {
+		t.Fatalf("owner %q was stored", owner)
+	}
+
+	// the claim of the same index is confirmed again, e.g. after a restart
+	claims.Delete(client.svc.Endpoint + "/b/.blobs/" + dedupOwnerName)
+	if err := client.ClaimDedup(context.Background()); err != nil {
+		t.Errorf("claiming again: %v", err)
+	}
+
+	// another index must not count references to the same content
+	other := newDedupClient(t, server, client.target)
+	err := other.ClaimDedup(context.Background())
+
+	var appErr *apperror.Error
+	if !errors.As(err, &appErr) || appErr.Status != http.StatusConflict {
+		t.Errorf("second index claimed the bucket: %v", err)
+	}
+}
+
+func TestReleaseKeepsContentOfClaimedBucket(t *testing.T) {
+	server := &bucketServer{objects: map[string]string{".blobs/" + dedupOwnerName: "another index"}}
+	client := newDedupClient(t, server, "release-"+t.Name())
+
+	client.dedup.Link(client.target, "a.txt", "s1", 10, func() error { return nil })
+	if err := client.unlink(context.Background(), "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.deleted) > 0 {
+		t.Errorf("deleted %v from a bucket another index owns", server.deleted)
+	}
+}
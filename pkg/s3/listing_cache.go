@@ -0,0 +1,150 @@
+package s3
+
+import (
+	"context"
+	"file-management-service/pkg/cache"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/tracing"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const listingKeyPrefix = "list:"
+
+// NewListingCache caches listing pages for ttl. With a staleTTL, pages older than ttl are
+// still served for staleTTL while a fresh copy is fetched in the background.
+func NewListingCache(store cache.Cache, ttl, staleTTL time.Duration) *ListingCache {
+	return &ListingCache{
+		cache:    store,
+		ttl:      ttl,
+		staleTTL: staleTTL,
+	}
+}
+
+// Fetch returns the cached page for the given listing of a target or calls fetch and caches its result.
+// A nil ListingCache always calls fetch.
+func (l *ListingCache) Fetch(ctx context.Context, target, folderPath string, options ListOptions, fetch func(context.Context) (*ListFilesResponse, error)) (*ListFilesResponse, error) {
+	if l == nil {
+		return fetch(ctx)
+	}
+
+	key := listingKey(target, folderPath, options)
+
+	var page cachedListing
+	if _, found := cache.GetJSON(l.cache, key, &page); found && page.Response != nil {
+		// empty folders used to be cached as "data": null
+		if page.Response.Files == nil {
+			page.Response.Files = &[]ObjectDetails{}
+		}
+
+		// past the ttl the page is stale, serve it and refresh it once in the background
+		if time.Since(page.FetchedAt) > l.ttl {
+			l.revalidate(logger.WithContext(tracing.Detach(ctx), logger.FromContext(ctx)), folderPath, key, fetch)
+		}
+		return page.Response, nil
+	}
+
+	response, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l.save(ctx, folderPath, key, response)
+	return response, nil
+}
+
+// InvalidateObject drops the cached pages of the folder holding objectKey in a target and of
+// every folder above it, where a folder created or emptied by the change shows up as an entry
+func (l *ListingCache) InvalidateObject(target, objectKey string) {
+	if l == nil {
+		return
+	}
+
+	for folder := parentFolder(objectKey); ; folder = parentFolder(folder) {
+		l.cache.DeletePrefix(folderKeyPrefix(target, folder) + "\x00")
+		if folder == "" {
+			return
+		}
+	}
+}
+
+// InvalidateFolder drops the cached pages of a folder, of everything below it
+// and of its parent folder where it shows up as an entry
+func (l *ListingCache) InvalidateFolder(target, folderPath string) {
+	if l == nil {
+		return
+	}
+
+	if folderPath != "" && !strings.HasSuffix(folderPath, "/") {
+		folderPath += "/"
+	}
+
+	l.cache.DeletePrefix(folderKeyPrefix(target, folderPath))
+	l.InvalidateObject(target, folderPath)
+}
+
+// Close waits for background refreshes to finish
+func (l *ListingCache) Close() {
+	if l != nil {
+		l.workers.Wait()
+	}
+}
+
+// Stats returns the counters of the underlying cache
+func (l *ListingCache) Stats() cache.Stats {
+	return l.cache.Stats()
+}
+
+// revalidate refreshes a page in the background, ctx must not be tied to the request
+func (l *ListingCache) revalidate(ctx context.Context, folderPath, key string, fetch func(context.Context) (*ListFilesResponse, error)) {
+	if _, running := l.refreshing.LoadOrStore(key, true); running {
+		return
+	}
+
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		defer l.refreshing.Delete(key)
+
+		response, err := fetch(ctx)
+		if err != nil {
+			logger.FromContext(ctx).Warn("Failed to refresh cached listing", "prefix", folderPath, "error", err)
+			return
+		}
+
+		l.save(ctx, folderPath, key, response)
+	}()
+}
+
+func (l *ListingCache) save(ctx context.Context, folderPath, key string, response *ListFilesResponse) {
+	page := cachedListing{Response: response, FetchedAt: time.Now()}
+
+	err := cache.SetJSON(l.cache, key, page, page.FetchedAt.Add(l.ttl+l.staleTTL))
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to cache listing", "prefix", folderPath, "error", err)
+	}
+}
+
+// listingKey starts with the target and folder path followed by a separator, so a folder and
+// all of its sub folders share a common key prefix
+func listingKey(target, folderPath string, options ListOptions) string {
+	return fmt.Sprintf("%s\x00%s|%d|%t", folderKeyPrefix(target, folderPath), options.PageToken, options.PageSize, options.FoldersOnly)
+}
+
+// folderKeyPrefix is shared by the pages of a folder and of everything below it,
+// target names cannot contain the colon
+func folderKeyPrefix(target, folderPath string) string {
+	return listingKeyPrefix + target + ":" + folderPath
+}
+
+// parentFolder returns the folder path an object is listed under, "" for the bucket root
+func parentFolder(objectKey string) string {
+	parent := path.Dir(strings.TrimSuffix(objectKey, "/"))
+	if parent == "." || parent == "/" {
+		return ""
+	}
+
+	return parent + "/"
+}
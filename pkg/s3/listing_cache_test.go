@@ -0,0 +1,67 @@
+package s3
+
+import (
+	"context"
+	"file-management-service/pkg/cache"
+	"testing"
+	"time"
+)
+
+// an empty folder cached before it was stored as an empty list must not crash later listings
+func TestListFilesCachedEmptyFolder(t *testing.T) {
+	store := cache.NewLRUCache(0, 0)
+	listCache := NewListingCache(store, time.Minute, 0)
+	client := &S3{target: "default"}
+
+	options := ListOptions{PageSize: 10, IncludeLinks: true, IncludeChecksums: true, IncludeTags: true, TagFilter: map[string]string{"project": ""}}
+	page := cachedListing{Response: &ListFilesResponse{IsLastPage: true}, FetchedAt: time.Now()}
+	if err := cache.SetJSON(store, listingKey("default", "empty/", options), page, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := client.ListFiles(context.Background(), "empty", options, store, listCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Files == nil || len(*response.Files) != 0 {
+		t.Fatalf("expected an empty listing, got %v", response.Files)
+	}
+}
+
+func TestParentFolder(t *testing.T) {
+	for key, want := range map[string]string{
+		"a.txt":       "",
+		"a/b.txt":     "a/",
+		"a/b/":        "a/",
+		"a/b/c/d.txt": "a/b/c/",
+	} {
+		if got := parentFolder(key); got != want {
+			t.Errorf("parentFolder(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// a new key can create implicit folders all the way up, so every ancestor's pages are dropped
+func TestInvalidateObjectDropsAncestors(t *testing.T) {
+	store := cache.NewLRUCache(0, 0)
+	listCache := NewListingCache(store, time.Minute, 0)
+
+	options := ListOptions{PageSize: 10}
+	folders := []string{"", "a/", "a/b/", "a/b/c/", "other/"}
+	for _, folder := range folders {
+		page := cachedListing{Response: &ListFilesResponse{Files: &[]ObjectDetails{}}, FetchedAt: time.Now()}
+		if err := cache.SetJSON(store, listingKey("default", folder, options), page, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listCache.InvalidateObject("default", "a/b/c/d.txt")
+
+	for _, folder := range folders {
+		_, found := store.Get(listingKey("default", folder, options))
+		if want := folder == "other/"; found != want {
+			t.Errorf("page of %q cached = %t, want %t", folder, found, want)
+		}
+	}
+}
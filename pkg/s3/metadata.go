@@ -0,0 +1,263 @@
+package s3
+
+import (
+	"context"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/tracing"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ValidateMetadata checks user metadata set by a client, names are lower cased first as S3 does
+func ValidateMetadata(metadata map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(metadata))
+	size := 0
+	for name, value := range metadata {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case !metadataName.MatchString(name):
+			return nil, fmt.Errorf("metadata name %q may only contain letters, digits, '.', '_' and '-'", name)
+		case serviceMetadata[name]:
+			return nil, fmt.Errorf("metadata %s is set by the service", name)
+		case !printable(value):
+			return nil, fmt.Errorf("metadata %s may only contain printable ASCII characters", name)
+		}
+
+		normalized[name] = value
+		size += len(name) + len(value)
+	}
+
+	if size > maxUserMetadataSize {
+		return nil, fmt.Errorf("metadata may take at most %d bytes", maxUserMetadataSize)
+	}
+
+	return normalized, nil
+}
+
+// ValidateTags checks object tags set by a client against the limits of S3
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags can be set on a file", maxTags)
+	}
+
+	for key, value := range tags {
+		switch {
+		case key == "" || len([]rune(key)) > maxTagKeyLength:
+			return fmt.Errorf("tag keys must have 1 to %d characters", maxTagKeyLength)
+		case len([]rune(value)) > maxTagValueLength:
+			return fmt.Errorf("tag %s: values may have at most %d characters", key, maxTagValueLength)
+		case strings.HasPrefix(strings.ToLower(key), "aws:"):
+			return fmt.Errorf("tag %s: the aws: prefix is reserved", key)
+		case !tagCharacters.MatchString(key) || !tagCharacters.MatchString(value):
+			return fmt.Errorf("tag %s: keys and values may only contain letters, digits, spaces and _ . : / = + - @", key)
+		}
+	}
+
+	return nil
+}
+
+// UserMetadata drops the metadata written by the service
+func UserMetadata(metadata map[string]string) map[string]string {
+	user := map[string]string{}
+	for name, value := range metadata {
+		if !serviceMetadata[name] {
+			user[name] = value
+		}
+	}
+
+	return user
+}
+
+// SetUserMetadata replaces the user metadata of an object, keeping the metadata written by the service.
+// The object is copied onto itself, which keeps its headers and tags, see copyObject.
+func (s *S3) SetUserMetadata(ctx context.Context, objectKey string, metadata map[string]string) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.SetUserMetadata", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	output, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	replaced := map[string]string{}
+	for name, value := range output.Metadata {
+		if name = strings.ToLower(name); serviceMetadata[name] {
+			replaced[name] = aws.StringValue(value)
+		}
+	}
+
+	for name, value := range metadata {
+		replaced[name] = value
+	}
+
+	return s.copyObject(ctx, output, objectKey, objectKey, UploadOptions{Metadata: replaced})
+}
+
+// Tags returns the tags of an object
+func (s *S3) Tags(ctx context.Context, objectKey string) (_ map[string]string, err error) {
+	ctx, span := s.startSpan(ctx, "s3.GetObjectTagging", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	output, err := s.svc.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+// SetTags replaces the tags of an object, no tags removes them all
+func (s *S3) SetTags(ctx context.Context, objectKey string, tags map[string]string) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.PutObjectTagging", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	if len(tags) == 0 {
+		_, err = s.svc.DeleteObjectTaggingWithContext(ctx, &s3.DeleteObjectTaggingInput{
+			Bucket: aws.String(s.bucketName),
+			Key:    aws.String(objectKey),
+		})
+		return err
+	}
+
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for _, key := range sortedKeys(tags) {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+
+	_, err = s.svc.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s.bucketName),
+		Key:     aws.String(objectKey),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// addObjectMetadata looks up the stored digests, user metadata or tags of the files concurrently,
+// as options asks for. Files whose lookup failed are listed without them.
+func (s *S3) addObjectMetadata(ctx context.Context, objects []ObjectDetails, options ListOptions) {
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, headConcurrency)
+
+	for i := range objects {
+		if objects[i].IsFolder {
+			continue
+		}
+
+		wg.Add(1)
+		limit <- struct{}{}
+
+		go func(obj *ObjectDetails) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			if options.IncludeChecksums || options.IncludeMetadata {
+				metadata, err := s.Metadata(ctx, obj.Name)
+				if err != nil {
+					logger.FromContext(ctx).Warn("Failed to look up metadata", "file", obj.Name, "error", err)
+				} else {
+					if options.IncludeChecksums {
+						obj.MD5, obj.SHA256 = metadata[MetaMD5], metadata[MetaSHA256]
+					}
+					if options.IncludeMetadata {
+						obj.Metadata = UserMetadata(metadata)
+					}
+				}
+			}
+
+			if options.IncludeTags || len(options.TagFilter) > 0 {
+				tags, err := s.Tags(ctx, obj.Name)
+				if err != nil {
+					logger.FromContext(ctx).Warn("Failed to look up tags", "file", obj.Name, "error", err)
+					return
+				}
+				obj.Tags = tags
+			}
+		}(&objects[i])
+	}
+
+	wg.Wait()
+}
+
+// filterByTags keeps the files of a page carrying every tag of the filter, an empty value matches any
+// value. Folders carry no tags and are kept, so matching files below them can still be browsed to.
+func filterByTags(response *ListFilesResponse, filter map[string]string) {
+	objects := []ObjectDetails{}
+	var fileCount int32
+	for _, object := range *response.Files {
+		switch {
+		case object.IsFolder:
+		case hasTags(object.Tags, filter):
+			fileCount++
+		default:
+			continue
+		}
+		objects = append(objects, object)
+	}
+
+	response.Files = &objects
+	response.NoOfRecordsReturned = int32(len(objects))
+	response.FilesCount = fileCount
+	response.FoldersCount = int32(len(objects)) - fileCount
+}
+
+func hasTags(tags, filter map[string]string) bool {
+	for key, value := range filter {
+		tag, found := tags[key]
+		if !found || (value != "" && tag != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tagging encodes tags for the x-amz-tagging header of an upload
+func tagging(tags map[string]string) string {
+	query := url.Values{}
+	for key, value := range tags {
+		query.Set(key, value)
+	}
+
+	// S3 expects spaces as %20, a literal + is already escaped
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func printable(value string) bool {
+	for _, char := range value {
+		if char < ' ' || char > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
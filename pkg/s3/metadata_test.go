@@ -0,0 +1,233 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	metadata, err := ValidateMetadata(map[string]string{" Owner ": "ana", "review.state": "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != 2 || metadata["owner"] != "ana" || metadata["review.state"] != "draft" {
+		t.Errorf("got %v, want names lower cased and trimmed", metadata)
+	}
+
+	for name, invalid := range map[string]map[string]string{
+		"name with a space":   {"my owner": "ana"},
+		"name with a colon":   {"owner:": "ana"},
+		"leading dot":         {".owner": "ana"},
+		"empty name":          {"": "ana"},
+		"service metadata":    {"SHA256": "abc"},
+		"dedup reference":     {"dedup-ref": "abc"},
+		"scan status":         {"scan-status": "clean"},
+		"non-ASCII value":     {"owner": "anaïs"},
+		"control character":   {"owner": "ana\n"},
+		"more than 1536 byte": {"notes": strings.Repeat("x", maxUserMetadataSize)},
+	} {
+		if _, err := ValidateMetadata(invalid); err == nil {
+			t.Errorf("%s: %v was accepted", name, invalid)
+		}
+	}
+
+	// the limit counts names and values together
+	if _, err := ValidateMetadata(map[string]string{"a": strings.Repeat("x", maxUserMetadataSize-1)}); err != nil {
+		t.Errorf("metadata of exactly %d bytes: %v", maxUserMetadataSize, err)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	valid := map[string]string{"project": "apollo 11", "path": "a/b=c+d@e:f_g.h-i", "empty": "", "Ölçü": "ünïcode"}
+	if err := ValidateTags(valid); err != nil {
+		t.Errorf("%v: %v", valid, err)
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i <= maxTags; i++ {
+		tooMany[string(rune('a'+i))] = "x"
+	}
+
+	for name, invalid := range map[string]map[string]string{
+		"too many tags":      tooMany,
+		"empty key":          {"": "x"},
+		"long key":           {strings.Repeat("k", maxTagKeyLength+1): "x"},
+		"long value":         {"k": strings.Repeat("v", maxTagValueLength+1)},
+		"reserved prefix":    {"AWS:createdBy": "x"},
+		"invalid key char":   {"a,b": "x"},
+		"invalid value char": {"k": "a&b"},
+	} {
+		if err := ValidateTags(invalid); err == nil {
+			t.Errorf("%s: %v was accepted", name, invalid)
+		}
+	}
+
+	// lengths are counted in characters, not bytes
+	if err := ValidateTags(map[string]string{"k": strings.Repeat("é", maxTagValueLength)}); err != nil {
+		t.Errorf("%d two byte characters: %v", maxTagValueLength, err)
+	}
+}
+
+func TestTagging(t *testing.T) {
+	tags := map[string]string{"project": "apollo 11", "sum": "1+1=2", "path": "a/b", "empty": ""}
+	encoded := tagging(tags)
+
+	if strings.Contains(encoded, "+") {
+		t.Errorf("%q encodes a space or plus sign as +", encoded)
+	}
+
+	decoded, err := url.ParseQuery(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range tags {
+		if decoded.Get(key) != value || !decoded.Has(key) {
+			t.Errorf("%s: decoded %q, want %q", key, decoded.Get(key), value)
+		}
+	}
+}
+
+func TestFilterByTags(t *testing.T) {
+	response := &ListFilesResponse{Files: &[]ObjectDetails{
+		{Name: "docs/", IsFolder: true},
+		{Name: "a.txt", Tags: map[string]string{"project": "apollo", "status": "draft"}},
+		{Name: "b.txt", Tags: map[string]string{"project": "gemini"}},
+		{Name: "c.txt"},
+	}}
+
+	filterByTags(response, map[string]string{"project": "apollo", "status": ""})
+
+	names := []string{}
+	for _, object := range *response.Files {
+		names = append(names, object.Name)
+	}
+	if strings.Join(names, ",") != "docs/,a.txt" {
+		t.Errorf("kept %v, want the folder and a.txt", names)
+	}
+
+	if response.NoOfRecordsReturned != 2 || response.FilesCount != 1 || response.FoldersCount != 1 {
+		t.Errorf("counted %d records, %d files and %d folders, want 2, 1 and 1",
+			response.NoOfRecordsReturned, response.FilesCount, response.FoldersCount)
+	}
+}
+
+func TestCutAfter(t *testing.T) {
+	page := &ListFilesResponse{NextPageToken: "t", Files: &[]ObjectDetails{
+		{Name: "docs/a/", IsFolder: true},
+		{Name: "docs/c/", IsFolder: true},
+		{Name: "docs/a.txt"},
+		{Name: "docs/b.txt"},
+		{Name: "docs/d.txt"},
+	}}
+
+	cutAfter(page, 2)
+
+	// folders listed after the cut show up on the next page
+	if names := listNames(page); names != "docs/a/,docs/a.txt,docs/b.txt" || page.FilesCount != 2 || page.FoldersCount != 1 {
+		t.Errorf("kept %s", names)
+	}
+	if page.NextPageToken != startAfterToken+"ZG9jcy9iLnR4dA" || page.IsLastPage {
+		t.Errorf("next page token %q, last %t", page.NextPageToken, page.IsLastPage)
+	}
+}
+
+// pagedServer lists keys two per page, files starting with m are tagged project=apollo
+type pagedServer struct {
+	keys  []string
+	pages atomic.Int32
+}
+
+func (server *pagedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("tagging") {
+		if strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/b/"), "m") {
+			fmt.Fprint(w, `<Tagging><TagSet><Tag><Key>project</Key><Value>apollo</Value></Tag></TagSet></Tagging>`)
+		} else {
+			fmt.Fprint(w, `<Tagging><TagSet></TagSet></Tagging>`)
+		}
+		return
+	}
+
+	server.pages.Add(1)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	if after := query.Get("start-after"); after != "" {
+		for start < len(server.keys) && server.keys[start] <= after {
+			start++
+		}
+	}
+	end := min(start+2, len(server.keys))
+
+	fmt.Fprintf(w, `<ListBucketResult><IsTruncated>%t</IsTruncated>`, end < len(server.keys))
+	if end < len(server.keys) {
+		fmt.Fprintf(w, `<NextContinuationToken>%d</NextContinuationToken>`, end)
+	}
+	for _, key := range server.keys[start:end] {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>1</Size><LastModified>2026-01-01T00:00:00Z</LastModified></Contents>`, key)
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+func listNames(response *ListFilesResponse) string {
+	names := []string{}
+	for _, object := range *response.Files {
+		names = append(names, object.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListFilesFillsTagFilteredPages(t *testing.T) {
+	server := &pagedServer{keys: []string{"a1", "m1", "a2", "a3", "m2", "m3", "m4", "a4"}}
+	client := newTestClient(t, server)
+	options := ListOptions{PageSize: 2, TagFilter: map[string]string{"project": "apollo"}}
+
+	response, err := client.ListFiles(context.Background(), "", options, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first page holds a single match, the second none, the third is cut after the match that fills the page
+	if names := listNames(response); names != "m1,m2" || response.FilesCount != 2 || response.IsLastPage || server.pages.Load() != 3 {
+		t.Fatalf("listed %s in %d pages, last %t, want m1,m2 in 3 pages", names, server.pages.Load(), response.IsLastPage)
+	}
+
+	for _, want := range []string{"m3,m4", ""} {
+		options.PageToken = response.NextPageToken
+		response, err = client.ListFiles(context.Background(), "", options, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if names := listNames(response); names != want || int(response.FilesCount) != len(*response.Files) {
+			t.Errorf("listed %s after the token, want %q", names, want)
+		}
+	}
+
+	if !response.IsLastPage {
+		t.Error("the last page is not marked as such")
+	}
+}
+
+func TestListFilesBoundsTagFilteredPages(t *testing.T) {
+	server := &pagedServer{}
+	for i := 0; i < 2*(maxFilterPages+5); i++ {
+		server.keys = append(server.keys, fmt.Sprintf("a%03d", i))
+	}
+	client := newTestClient(t, server)
+
+	options := ListOptions{PageSize: 2, TagFilter: map[string]string{"project": "apollo"}}
+	response, err := client.ListFiles(context.Background(), "", options, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.pages.Load() != maxFilterPages || len(*response.Files) != 0 || response.IsLastPage || response.NextPageToken == "" {
+		t.Errorf("listed %d pages, %d files, last %t, want %d empty pages and a token to go on",
+			server.pages.Load(), len(*response.Files), response.IsLastPage, maxFilterPages)
+	}
+}
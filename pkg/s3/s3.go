@@ -1,63 +1,175 @@
 package s3
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"file-management-service/config"
+	"file-management-service/pkg/apperror"
 	"file-management-service/pkg/cache"
+	"file-management-service/pkg/dedup"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/metrics"
+	"file-management-service/pkg/tracing"
+	"fmt"
 	"io"
+	"net/http"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // S3 represents the Amazon S3 service.
 type S3 struct {
+	target     string // name of the configured target, cache keys are scoped by it
 	bucketName string
 	svc        *s3.S3
-}
 
-// NewS3 creates a new S3 instance with the specified bucket name and AWS session.
-func NewClient(config *config.Config) (*S3, error) {
-	// Create a new AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(config.Region), // Replace with your desired AWS region,
-		Credentials: credentials.NewStaticCredentials(
-			config.AwsAccessKeyID,     // Replace with your AWS access key ID
-			config.AwsSecretAccessKey, // Replace with your AWS secret access key
-			"",
-		),
-	})
+	// derived, quarantined, staged and shared objects are kept below these prefixes and left out of listings
+	hiddenPrefixes []string
+
+	// references of keys to shared content, nil when deduplication was never used
+	dedup        *dedup.Index
+	dedupUploads bool   // store new uploads as references
+	blobPrefix   string // shared content is stored below it by SHA-256
+
+	// limits applied to signed download URLs
+	maxDownloadExpiry time.Duration
+	minURLRemaining   time.Duration
+}
 
+// NewS3 creates a new S3 instance for a storage target, resolved with config.Target.
+// Download link limits are taken from config.
+func NewClient(config *config.Config, target config.Target) (*S3, error) {
+	sess, err := targetSession(target, config.TargetNames())
 	if err != nil {
 		return nil, err
 	}
 
 	// Create an S3 service client
 	svc := s3.New(sess)
+	metrics.InstrumentS3(&svc.Handlers)
 
 	return &S3{
-		bucketName: config.BucketName,
-		svc:        svc,
+		target:            target.Name,
+		bucketName:        target.BucketName,
+		svc:               svc,
+		hiddenPrefixes:    []string{config.ThumbnailPrefix, config.QuarantinePrefix, config.StagingPrefix, config.DedupPrefix},
+		dedupUploads:      config.DedupEnabled,
+		blobPrefix:        config.DedupPrefix,
+		maxDownloadExpiry: time.Duration(config.DownloadURLTimeLimit) * time.Minute,
+		minURLRemaining:   time.Duration(config.DownloadURLMinRemaining) * time.Second,
 	}, nil
 }
 
+// targetSession returns the AWS session for a target. Sessions are shared between requests
+// so credentials from the chain are cached, a changed target gets a new session. targets are the
+// names of all configured targets.
+func targetSession(target config.Target, targets []string) (*session.Session, error) {
+	// the settings include the secret key, only a hash of them is kept
+	fingerprint := sha256.Sum256([]byte(fmt.Sprintf("%+v", target)))
+	if cached, found := sessions.Load(target.Name); found && cached.(cachedSession).fingerprint == fingerprint {
+		return cached.(cachedSession).session, nil
+	}
+
+	awsConfig := aws.Config{
+		Region:           aws.String(target.Region),
+		S3ForcePathStyle: aws.Bool(target.ForcePathStyle),
+		DisableSSL:       aws.Bool(target.DisableSSL),
+	}
+
+	if target.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(target.Endpoint)
+	}
+
+	// the chain is what the SDK uses when no credentials are set
+	if target.CredentialsProvider == config.CredentialsStatic {
+		awsConfig.Credentials = credentials.NewStaticCredentials(target.AwsAccessKeyID, target.AwsSecretAccessKey, "")
+	}
+
+	// Create a new AWS session
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           target.AwsProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the session of a changed target is replaced, those of targets removed by a reload are dropped
+	sessions.Store(target.Name, cachedSession{fingerprint: fingerprint, session: sess})
+	pruneSessions(targets)
+
+	return sess, nil
+}
+
+// pruneSessions drops the sessions of targets that are no longer configured
+func pruneSessions(targets []string) {
+	configured := map[string]bool{}
+	for _, name := range targets {
+		configured[name] = true
+	}
+
+	sessions.Range(func(name, _ any) bool {
+		if !configured[name.(string)] {
+			sessions.Delete(name)
+		}
+		return true
+	})
+}
+
+// Target returns the name of the storage target the client works on
+func (s *S3) Target() string {
+	return s.target
+}
+
+// startSpan starts a child span for a storage operation, end it with tracing.End
+func (s *S3) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("s3.bucket", s.bucketName), attribute.String("storage.target", s.target))
+	return tracing.Start(ctx, tracerName, name, attrs...)
+}
+
+// HeadBucket checks that the bucket exists and is reachable with the configured credentials
+func (s *S3) HeadBucket(ctx context.Context) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.HeadBucket")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = s.svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucketName),
+	})
+
+	return err
+}
+
 // CreateFolder creates a folder (empty object) in the specified bucket and folder path
-func (s *S3) CreateFolder(folderPath string) error {
+func (s *S3) CreateFolder(ctx context.Context, folderPath string) (err error) {
 	// Add a trailing slash to the folder path if not already present
 	if folderPath != "" && !strings.HasSuffix(folderPath, "/") {
 		folderPath += "/"
 	}
 
+	ctx, span := s.startSpan(ctx, "s3.CreateFolder", attribute.String("s3.prefix", folderPath))
+	defer func() { tracing.End(span, err) }()
+
 	// Create an empty object with the folder path as the key
 	input := &s3.PutObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(folderPath),
 	}
 
-	_, err := s.svc.PutObject(input)
+	_, err = s.svc.PutObjectWithContext(ctx, input)
 	if err != nil {
 		return err
 	}
@@ -65,30 +177,63 @@ func (s *S3) CreateFolder(folderPath string) error {
 	return nil
 }
 
-// UploadFile uploads a file to the S3 bucket.
-func (s *S3) UploadFile(src io.Reader, objectKey string) error {
-	// Upload the file to S3
-	_, err := s.svc.PutObject(&s3.PutObjectInput{
+// UploadFile uploads a file to the S3 bucket. With deduplication enabled, uploads that come with
+// their SHA-256 are stored as a reference to shared content, see uploadReference.
+func (s *S3) UploadFile(ctx context.Context, src io.Reader, objectKey string, options UploadOptions) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.PutObject", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	if s.dedup != nil && s.dedupUploads && options.ChecksumSHA256 != "" {
+		span.SetAttributes(attribute.Bool("s3.dedup", true))
+		return s.uploadReference(ctx, src, objectKey, options)
+	}
+
+	if err := s.putObject(ctx, src, objectKey, options); err != nil {
+		return err
+	}
+
+	// the key may have been a reference before
+	return s.unlink(ctx, objectKey)
+}
+
+// putObject stores src at objectKey
+func (s *S3) putObject(ctx context.Context, src io.Reader, objectKey string, options UploadOptions) error {
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(objectKey),
 		Body:   aws.ReadSeekCloser(src),
-	})
-	if err != nil {
-		return err
 	}
 
-	return nil
+	if options.ContentType != "" {
+		input.ContentType = aws.String(options.ContentType)
+	}
+
+	if len(options.Metadata) > 0 {
+		input.Metadata = aws.StringMap(options.Metadata)
+	}
+
+	if len(options.Tags) > 0 {
+		input.Tagging = aws.String(tagging(options.Tags))
+	}
+
+	if options.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(options.ContentMD5)
+	}
+
+	if options.ChecksumSHA256 != "" {
+		input.ChecksumSHA256 = aws.String(options.ChecksumSHA256)
+	}
+
+	// Upload the file to S3
+	_, err := s.svc.PutObjectWithContext(ctx, input)
+	return err
 }
 
 // Upload multiple files to the S3 bucket.
-func (s *S3) UploadFiles(files []io.Reader, objectKeys []string) error {
+func (s *S3) UploadFiles(ctx context.Context, files []io.Reader, objectKeys []string) error {
 	// Upload the file to S3
 	for i, file := range files {
-		_, err := s.svc.PutObject(&s3.PutObjectInput{
-			Bucket: aws.String(s.bucketName),
-			Key:    aws.String(objectKeys[i]),
-			Body:   aws.ReadSeekCloser(file),
-		})
+		err := s.UploadFile(ctx, file, objectKeys[i], UploadOptions{})
 		if err != nil {
 			return err
 		}
@@ -98,30 +243,190 @@ func (s *S3) UploadFiles(files []io.Reader, objectKeys []string) error {
 }
 
 // ListObjects lists all the objects within a folder in the S3 bucket.
-func (s *S3) ListFiles(folderPath string, nextPageToken string, pageSize int, isFolder bool, cache *cache.URLCache) (*ListFilesResponse, error) {
+// Pages come from listCache when one is given, download links are added afterwards when requested.
+func (s *S3) ListFiles(ctx context.Context, folderPath string, options ListOptions, cache cache.Cache, listCache *ListingCache) (_ *ListFilesResponse, err error) {
 
 	// If the folder path does not end with a slash, add it
 	if (folderPath != "") && !strings.HasSuffix(folderPath, "/") {
 		folderPath += "/"
 	}
 
+	ctx, span := s.startSpan(ctx, "s3.ListFiles",
+		attribute.String("s3.prefix", folderPath),
+		attribute.Int("s3.page_size", options.PageSize),
+		attribute.Bool("s3.include_links", options.IncludeLinks),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	var response *ListFilesResponse
+	if len(options.TagFilter) > 0 {
+		response, err = s.listMatching(ctx, folderPath, options, listCache)
+	} else {
+		response, err = listCache.Fetch(ctx, s.target, folderPath, options, func(ctx context.Context) (*ListFilesResponse, error) {
+			return s.listPage(ctx, folderPath, options)
+		})
+		if err == nil && (options.IncludeChecksums || options.IncludeMetadata || options.IncludeTags) {
+			s.addObjectMetadata(ctx, *response.Files, options)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options.IncludeLinks {
+		s.addDownloadLinks(ctx, *response.Files, cache)
+	}
+
+	return response, nil
+}
+
+// listMatching fetches pages until they hold PageSize files carrying the tags of the filter, or
+// maxFilterPages of them were fetched, and returns the folders and matching files of those pages
+// as a single page. Its next page token is the one of the last page fetched.
+func (s *S3) listMatching(ctx context.Context, folderPath string, options ListOptions, listCache *ListingCache) (*ListFilesResponse, error) {
+	objects := []ObjectDetails{}
+	matching := &ListFilesResponse{Files: &objects}
+
+	for pages := 1; ; pages++ {
+		page, err := listCache.Fetch(ctx, s.target, folderPath, options, func(ctx context.Context) (*ListFilesResponse, error) {
+			return s.listPage(ctx, folderPath, options)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s.addObjectMetadata(ctx, *page.Files, options)
+		filterByTags(page, options.TagFilter)
+
+		// a page holding more matches than fit is cut after the last one kept, the next page starts after it
+		if int(matching.FilesCount+page.FilesCount) > options.PageSize {
+			cutAfter(page, options.PageSize-int(matching.FilesCount))
+		}
+
+		objects = append(objects, *page.Files...)
+		matching.FilesCount += page.FilesCount
+		matching.FoldersCount += page.FoldersCount
+		matching.NextPageToken, matching.IsLastPage = page.NextPageToken, page.IsLastPage
+
+		// folders are never filtered, a listing of folders only has nothing to fill
+		if page.IsLastPage || options.FoldersOnly || int(matching.FilesCount) >= options.PageSize || pages >= maxFilterPages {
+			break
+		}
+		options.PageToken = page.NextPageToken
+	}
+
+	matching.NoOfRecordsReturned = int32(len(objects))
+	return matching, nil
+}
+
+// cutAfter keeps the first files of a page and the entries listed before the last of them. S3
+// lists keys in order, so the page that follows it starts after that key.
+func cutAfter(page *ListFilesResponse, files int) {
+	var last string
+	for _, object := range *page.Files {
+		if !object.IsFolder {
+			if files == 0 {
+				break
+			}
+			files--
+			last = object.Name
+		}
+	}
+
+	objects := []ObjectDetails{}
+	var fileCount int32
+	for _, object := range *page.Files {
+		if object.Name > last {
+			continue
+		}
+		if !object.IsFolder {
+			fileCount++
+		}
+		objects = append(objects, object)
+	}
+
+	page.Files = &objects
+	page.NoOfRecordsReturned = int32(len(objects))
+	page.FilesCount = fileCount
+	page.FoldersCount = int32(len(objects)) - fileCount
+	page.NextPageToken, page.IsLastPage = startAfterToken+base64.RawURLEncoding.EncodeToString([]byte(last)), false
+}
+
+// addDownloadLinks presigns the files concurrently. A failed presign is reported on the
+// object itself so the rest of the listing is still returned.
+func (s *S3) addDownloadLinks(ctx context.Context, objects []ObjectDetails, cache cache.Cache) {
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, presignConcurrency)
+
+	for i := range objects {
+		if objects[i].IsFolder {
+			continue
+		}
+
+		wg.Add(1)
+		limit <- struct{}{}
+
+		go func(obj *ObjectDetails) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			// generate a signed download URL for the object
+			downloadURL, _, err := s.presign(ctx, obj.Name, obj.DedupRef, DownloadLinkOptions{}, cache)
+			if err != nil {
+				logger.FromContext(ctx).Warn("Failed to generate download link", "file", obj.Name, "error", err)
+				obj.DownloadLinkError = err.Error()
+				return
+			}
+
+			obj.DownloadLink = downloadURL
+		}(&objects[i])
+	}
+
+	wg.Wait()
+}
+
+// listPage fetches a single listing page from S3, without download links
+func (s *S3) listPage(ctx context.Context, folderPath string, options ListOptions) (_ *ListFilesResponse, err error) {
+	ctx, span := s.startSpan(ctx, "s3.ListObjectsV2",
+		attribute.String("s3.prefix", folderPath),
+		attribute.Bool("s3.continued", options.PageToken != ""),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	input := &s3.ListObjectsV2Input{
 		Bucket:    aws.String(s.bucketName),
 		Prefix:    aws.String(folderPath),
 		Delimiter: aws.String("/"),
-		MaxKeys:   aws.Int64(int64(pageSize + 1)),
+		MaxKeys:   aws.Int64(int64(options.PageSize + 1)),
 	}
 
-	if nextPageToken != "" {
-		input.ContinuationToken = aws.String(nextPageToken)
+	if after, found := strings.CutPrefix(options.PageToken, startAfterToken); found {
+		key, err := base64.RawURLEncoding.DecodeString(after)
+		if err != nil {
+			return nil, apperror.BadRequest("Invalid page token")
+		}
+		input.StartAfter = aws.String(string(key))
+	} else if options.PageToken != "" {
+		input.ContinuationToken = aws.String(options.PageToken)
 	}
 
-	resp, err := s.svc.ListObjectsV2(input)
+	resp, err := s.svc.ListObjectsV2WithContext(ctx, input)
 
-	// send all file details
-	var objects []ObjectDetails
+	if err != nil {
+		return nil, err
+	}
+
+	// send all file details, an empty folder is cached as an empty list rather than null
+	objects := []ObjectDetails{}
 
 	for _, obj := range resp.CommonPrefixes {
+		if s.Hidden(*obj.Prefix) {
+			continue
+		}
+
 		objects = append(objects, ObjectDetails{
 			Name:         *obj.Prefix,
 			IsFolder:     true,
@@ -130,35 +435,27 @@ func (s *S3) ListFiles(folderPath string, nextPageToken string, pageSize int, is
 		})
 	}
 
-	if err != nil {
-		return nil, err
-	}
-
 	var fileCount int32 = 0
 
-	if !isFolder {
+	if !options.FoldersOnly {
+		files := []ObjectDetails{}
 		for _, obj := range resp.Contents {
-			if *obj.Key == folderPath {
+			if *obj.Key == folderPath || s.Hidden(*obj.Key) {
 				continue // skip the folder itself
 			}
 
-			fileCount++
-			objects = append(objects, ObjectDetails{
-				Name:         *obj.Key,
-				IsFolder:     *obj.Size == 0,
-				Size:         *obj.Size,
-				LastModified: *obj.LastModified,
-			})
-
-			// generate a signed download URL for the object
-			downloadURL, err := s.GenerateDownloadLink(*obj.Key, cache)
-
-			if err != nil {
-				return nil, err
+			// references are empty objects, they are listed with the size of their content
+			file := ObjectDetails{Name: *obj.Key, Size: *obj.Size, LastModified: *obj.LastModified}
+			if sum, contentSize, found := s.dedup.Lookup(s.target, *obj.Key); found {
+				file.DedupRef, file.Size = sum, contentSize
 			}
-
-			objects[len(objects)-1].DownloadLink = downloadURL
+			files = append(files, file)
 		}
+
+		// only keys ending in / are folders, empty files and references are files
+		s.findReferences(ctx, files)
+		fileCount = int32(len(files))
+		objects = append(objects, files...)
 	}
 
 	nextToken := ""
@@ -172,140 +469,323 @@ func (s *S3) ListFiles(folderPath string, nextPageToken string, pageSize int, is
 		IsLastPage:          !*resp.IsTruncated,
 		NoOfRecordsReturned: int32(len(objects)),
 		FilesCount:          fileCount,
-		FoldersCount:        int32(len(resp.CommonPrefixes)),
+		FoldersCount:        int32(len(objects)) - fileCount,
 	}
 
 	return response, nil
 }
 
-func (s *S3) ListAllFiles(folderPath string) (*ListFilesResponse, error) {
-	objects, err := s.ListFiles(folderPath, "", 10, false, &cache.URLCache{})
-	nextToken := objects.NextPageToken
-	if err != nil {
-		return nil, err
+// ListAllFiles lists every object below a folder, in all of its subfolders, with download links.
+// Subfolders are listed whether or not a folder object was created for them.
+func (s *S3) ListAllFiles(ctx context.Context, folderPath string) (*ListFilesResponse, error) {
+	if folderPath != "" && !strings.HasSuffix(folderPath, "/") {
+		folderPath += "/"
 	}
 
 	var allObjects []ObjectDetails
+	var fileCount int32
+	folders := map[string]bool{}
+	err := s.WalkObjects(ctx, folderPath, func(object ObjectDetails) error {
+		if object.Name == folderPath {
+			return nil // skip the folder itself
+		}
 
-	// check if next page token is present
-	for nextToken != "" {
-		temp, _ := s.ListFiles(folderPath, nextToken, 10, false, &cache.URLCache{})
-		allObjects = append(allObjects, *temp.Files...)
+		// the folders between folderPath and the object, unless they were listed already
+		for i := len(folderPath); i < len(object.Name)-1; i++ {
+			if folder := object.Name[:i+1]; object.Name[i] == '/' && !folders[folder] {
+				folders[folder] = true
+				allObjects = append(allObjects, ObjectDetails{
+					Name:         folder,
+					IsFolder:     true,
+					LastModified: time.Now().UTC().Truncate(time.Second),
+				})
+			}
+		}
 
-		if temp.IsLastPage {
-			nextToken = ""
+		if object.IsFolder {
+			if folders[object.Name] {
+				return nil
+			}
+			folders[object.Name] = true
+		} else {
+			fileCount++
 		}
-		nextToken = temp.NextPageToken
+
+		allObjects = append(allObjects, object)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Helper function to recursively fetch objects from subfolders
-	var listObjectsRecursively func(path string) error
-	listObjectsRecursively = func(path string) error {
-		objects, err := s.ListFiles(path, "", 10, false, &cache.URLCache{})
-		nextToken := objects.NextPageToken
+	s.addDownloadLinks(ctx, allObjects, cache.NewLRUCache(0, 0))
+
+	return &ListFilesResponse{
+		Files:               &allObjects,
+		IsLastPage:          true,
+		NoOfRecordsReturned: int32(len(allObjects)),
+		FilesCount:          fileCount,
+		FoldersCount:        int32(len(allObjects)) - fileCount,
+	}, nil
+}
+
+// WalkObjects calls fn for every object below prefix, in all of its subfolders, page by page.
+// Hidden objects are skipped, references are passed with the size of their content.
+func (s *S3) WalkObjects(ctx context.Context, prefix string, fn func(ObjectDetails) error) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.WalkObjects", attribute.String("s3.prefix", prefix))
+	defer func() { tracing.End(span, err) }()
 
-		// check if next page token is present
-		for nextToken != "" {
-			t, _ := s.ListFiles(path, nextToken, 10, false, &cache.URLCache{})
-			allObjects = append(allObjects, *t.Files...)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	}
 
-			if t.IsLastPage {
-				nextToken = ""
+	var walkErr error
+	err = s.svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects := make([]ObjectDetails, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			if s.Hidden(*obj.Key) {
+				continue
 			}
-			nextToken = t.NextPageToken
+
+			object := ObjectDetails{
+				Name:         *obj.Key,
+				IsFolder:     strings.HasSuffix(*obj.Key, "/"),
+				Size:         *obj.Size,
+				LastModified: *obj.LastModified,
+				ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+			}
+			if sum, contentSize, found := s.dedup.Lookup(s.target, *obj.Key); found {
+				object.DedupRef, object.Size = sum, contentSize
+			}
+			objects = append(objects, object)
 		}
 
-		if err != nil {
-			return err
+		s.findReferences(ctx, objects)
+		for _, object := range objects {
+			if walkErr = fn(object); walkErr != nil {
+				return false
+			}
 		}
 
-		// Add the objects from the current folder to the result
-		allObjects = append(allObjects, *objects.Files...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
 
-		// Recursively fetch objects from subfolders
+	return walkErr
+}
 
-		for _, subfolder := range *objects.Files {
-			if subfolder.IsFolder {
-				err := listObjectsRecursively(subfolder.Name)
-				if err != nil {
-					return err
-				}
-			}
-		}
+// ObjectInfo returns the size, ETag, stored checksums and reference of an object with HEAD
+func (s *S3) ObjectInfo(ctx context.Context, objectKey string) (_ ObjectDetails, err error) {
+	ctx, span := s.startSpan(ctx, "s3.HeadObject", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
 
-		return nil
+	output, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return ObjectDetails{}, err
 	}
 
-	// Recursively fetch objects from subfolders
-	for _, folder := range *objects.Files {
-		if folder.IsFolder {
-			err := listObjectsRecursively(folder.Name)
-			if err != nil {
-				return nil, err
-			}
-		}
+	object := ObjectDetails{
+		Name:         objectKey,
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+		ETag:         strings.Trim(aws.StringValue(output.ETag), `"`),
 	}
 
-	// Combine the initial folder's objects with the recursively fetched objects
-	allObjects = append(*objects.Files, allObjects...)
+	metadata := lowerCase(output.Metadata)
+	object.MD5, object.SHA256 = metadata[MetaMD5], metadata[MetaSHA256]
 
-	return &ListFilesResponse{
-		Files:               &allObjects,
-		NextPageToken:       objects.NextPageToken,
-		IsLastPage:          objects.IsLastPage,
-		NoOfRecordsReturned: int32(len(allObjects)),
-		FilesCount:          objects.FilesCount,
-		FoldersCount:        objects.FoldersCount,
-	}, nil
+	sum, contentSize, err := s.reference(ctx, objectKey, metadata)
+	if err != nil {
+		return ObjectDetails{}, err
+	}
+
+	if sum != "" {
+		object.DedupRef, object.Size = sum, contentSize
+	}
+
+	return object, nil
 }
 
-// GetFile retrieves a file from the specified bucket and key in S3.
-func (s *S3) GetFile(bucket, key string) (io.Reader, error) {
+// GetFile retrieves a file from the S3 bucket, the caller closes it.
+func (s *S3) GetFile(ctx context.Context, key string) (_ io.ReadCloser, err error) {
+	ctx, span := s.startSpan(ctx, "s3.GetObject", attribute.String("s3.key", key))
+	defer func() { tracing.End(span, err) }()
+
 	input := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.contentKey(key, "")),
 	}
 
-	result, err := s.svc.GetObject(input)
+	result, err := s.svc.GetObjectWithContext(ctx, input)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return result.Body, nil
+	// a reference the index does not know, its content is read instead
+	if ref := lowerCase(result.Metadata)[MetaDedupRef]; ref != "" && aws.Int64Value(result.ContentLength) == 0 {
+		result.Body.Close()
+
+		input.Key = aws.String(s.blobPrefix + ref)
+		if result, err = s.svc.GetObjectWithContext(ctx, input); err != nil {
+			return nil, err
+		}
+	}
+
+	return &countingReader{reader: result.Body}, nil
+}
+
+// Function to generate a signed download URL for the object.
+// The expiry in options is capped by the configured DownloadURLTimeLimit, a zero value means the maximum.
+func (s *S3) GenerateDownloadLink(ctx context.Context, objectKey string, options DownloadLinkOptions, cache cache.Cache) (_ string, err error) {
+	downloadURL, _, err := s.presign(ctx, objectKey, "", options, cache)
+	return downloadURL, err
 }
 
-// Function to generate a signed download URL for the object
-func (s *S3) GenerateDownloadLink(objectKey string, cache *cache.URLCache) (string, error) {
-	url, found := cache.Get(objectKey)
+// DownloadLink presigns a download URL for a file along with its stored checksums. The file is looked
+// up with HEAD only when no link is cached for it, a missing file fails with the NotFound error of S3.
+func (s *S3) DownloadLink(ctx context.Context, objectKey string, options DownloadLinkOptions, urlCache cache.Cache) (Download, error) {
+	cacheKey := downloadKeyPrefix + options.cacheKey(s.target, objectKey)
+
+	var download Download
+	if entry, found := cache.GetJSON(urlCache, cacheKey, &download); found && s.usable(entry.ExpiryTime, options) {
+		return download, nil
+	}
+
+	metadata, err := s.Metadata(ctx, objectKey)
+	if err != nil {
+		return Download{}, err
+	}
+
+	download.URL, download.ExpiresAt, err = s.presign(ctx, objectKey, metadata[MetaDedupRef], options, urlCache)
+	if err != nil {
+		return Download{}, err
+	}
+	download.MD5, download.SHA256 = metadata[MetaMD5], metadata[MetaSHA256]
 
-	// Check if the URL is already in the cache and valid
-	if found {
-		return url, nil
+	if err := cache.SetJSON(urlCache, cacheKey, download, download.ExpiresAt); err != nil {
+		logger.FromContext(ctx).Warn("Failed to cache download link", "file", objectKey, "error", err)
 	}
 
-	expiryTime := 15 * time.Minute
+	return download, nil
+}
 
-	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+// ForgetDownloads drops the cached download links of a key, or of every key below a folder,
+// so the next download looks the file up again
+func ForgetDownloads(urlCache cache.Cache, target, objectKey string) {
+	urlCache.DeletePrefix(target + ":" + objectKey)
+	urlCache.DeletePrefix(downloadKeyPrefix + target + ":" + objectKey)
+}
+
+// presign returns a signed GET URL for an object and when it expires, from the cache while a
+// cached URL is valid for long enough. ref is the reference the object is known to carry, if any.
+func (s *S3) presign(ctx context.Context, objectKey, ref string, options DownloadLinkOptions, cache cache.Cache) (_ string, _ time.Time, err error) {
+	_, span := s.startSpan(ctx, "s3.Presign", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	// references are downloaded from the shared content, cached by it as it never changes.
+	// The file is still saved under the name of the key rather than the SHA-256 of its content.
+	if contentKey := s.contentKey(objectKey, ref); contentKey != objectKey {
+		if options.FileName == "" {
+			options.FileName = path.Base(objectKey)
+		}
+		if options.Disposition == "" {
+			options.Disposition = "inline"
+		}
+		objectKey = contentKey
+	}
+
+	// response overrides change the signed URL, so they are part of the cache key
+	cacheKey := options.cacheKey(s.target, objectKey)
+
+	// Check if the URL is already in the cache and still valid for long enough.
+	// A cached URL that outlives the requested expiry is not handed out either.
+	if entry, found := cache.Get(cacheKey); found && s.usable(entry.ExpiryTime, options) {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return string(entry.Value), entry.ExpiryTime, nil
+	}
+
+	input := &s3.GetObjectInput{
 		Bucket:              aws.String(s.bucketName),
 		Key:                 aws.String(objectKey),
 		ResponseContentType: aws.String("image/png"),
-	})
+	}
+
+	if options.ContentType != "" {
+		input.ResponseContentType = aws.String(options.ContentType)
+	}
+
+	if disposition := options.contentDisposition(); disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+
+	req, _ := s.svc.GetObjectRequest(input)
 
+	expiryTime := s.linkExpiry(options)
+	start := time.Now()
 	downloadURL, err := req.Presign(expiryTime) // Set the validity period of the signed URL
+	metrics.ObserveS3Call("Presign", time.Since(start), err)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
 	// Cache the URL with its expiration time
-	cache.Set(objectKey, downloadURL, time.Now().Add(expiryTime))
+	expiresAt := start.Add(expiryTime)
+	cache.Set(cacheKey, []byte(downloadURL), expiresAt)
+
+	return downloadURL, expiresAt, nil
+}
+
+// linkExpiry is the validity asked for in options, capped by the configured maximum
+func (s *S3) linkExpiry(options DownloadLinkOptions) time.Duration {
+	if options.Expiry <= 0 || options.Expiry > s.maxDownloadExpiry {
+		return s.maxDownloadExpiry
+	}
+
+	return options.Expiry
+}
 
-	return downloadURL, nil
+// usable reports whether a cached link expiring at expiresAt may be handed out for options
+func (s *S3) usable(expiresAt time.Time, options DownloadLinkOptions) bool {
+	remaining := time.Until(expiresAt)
+	return remaining >= s.minURLRemaining && remaining <= s.linkExpiry(options)
+}
+
+// cacheKey builds the URL cache key for an object of a target and its response overrides
+func (o DownloadLinkOptions) cacheKey(target, objectKey string) string {
+	if o.ContentType == "" && o.contentDisposition() == "" {
+		return target + ":" + objectKey
+	}
+
+	return fmt.Sprintf("%s:%s|%s|%s", target, objectKey, o.ContentType, o.contentDisposition())
+}
+
+// contentDisposition builds the Content-Disposition header value for the signed URL
+func (o DownloadLinkOptions) contentDisposition() string {
+	disposition := o.Disposition
+	if disposition == "" && o.FileName != "" {
+		disposition = "attachment"
+	}
+
+	if o.FileName != "" {
+		disposition = fmt.Sprintf("%s; filename=%q", disposition, o.FileName)
+	}
+
+	return disposition
 }
 
 // DeleteObject deletes an object from the S3 bucket.
-func (s *S3) DeleteObject(objectKey string) error {
-	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+func (s *S3) DeleteObject(ctx context.Context, objectKey string) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.DeleteObject", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	_, err = s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(objectKey),
 	})
@@ -313,166 +793,244 @@ func (s *S3) DeleteObject(objectKey string) error {
 		return err
 	}
 
-	return nil
+	return s.unlink(ctx, objectKey)
 }
 
-// DeleteFolder deletes a folder and its contents recursively from the S3 bucket.
-func (s *S3) DeleteFolder(folderPath string) error {
+// ObjectExists checks whether an object exists using a HEAD request
+func (s *S3) ObjectExists(ctx context.Context, objectKey string) (_ bool, err error) {
+	ctx, span := s.startSpan(ctx, "s3.HeadObject", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
 
-	// add a trailing slash to the folder path if not already present
-	if folderPath != "" && !strings.HasSuffix(folderPath, "/") {
-		folderPath += "/"
+	_, err = s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+		return false, nil
 	}
 
-	allObjects := []ObjectDetails{}
+	if err != nil {
+		return false, err
+	}
 
-	resp, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:  aws.String(s.bucketName),
-		Prefix:  aws.String(folderPath),
-		MaxKeys: aws.Int64(2),
+	return true, nil
+}
+
+// Metadata returns the user metadata of an object with HEAD, keys in lower case
+func (s *S3) Metadata(ctx context.Context, objectKey string) (_ map[string]string, err error) {
+	ctx, span := s.startSpan(ctx, "s3.HeadObject", attribute.String("s3.key", objectKey))
+	defer func() { tracing.End(span, err) }()
+
+	output, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	for _, obj := range resp.Contents {
+	return lowerCase(output.Metadata), nil
+}
 
-		if *obj.Key == folderPath {
-			continue // skip the folder itself
-		}
+// lowerCase returns user metadata with its names in lower case, the SDK returns them in
+// canonical form, e.g. Sha256
+func lowerCase(metadata map[string]*string) map[string]string {
+	lowered := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		lowered[strings.ToLower(key)] = aws.StringValue(value)
+	}
 
-		allObjects = append(allObjects, ObjectDetails{
-			Name:         *obj.Key,
-			IsFolder:     *obj.Size == 0,
-			Size:         *obj.Size,
-			LastModified: *obj.LastModified,
-		})
+	return lowered
+}
+
+// MoveObject moves an object to a new key using a server side copy followed by a delete, in parts for
+// objects larger than a single copy allows. The copy never replaces an existing destination and, like
+// the delete, only applies to the version of the source read first. Either failing is a conflict.
+func (s *S3) MoveObject(ctx context.Context, sourceKey, destinationKey string) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.MoveObject",
+		attribute.String("s3.key", sourceKey),
+		attribute.String("s3.destination_key", destinationKey),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	source, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(sourceKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the metadata is copied as it is, with the reference of a deduplicated key
+	err = s.copyObject(ctx, source, sourceKey, destinationKey, UploadOptions{Metadata: lowerCase(source.Metadata)}, ifNoneMatch)
+	if err != nil && apperror.From(err).Status == http.StatusConflict {
+		// the copy does not tell which condition failed
+		if exists, existsErr := s.ObjectExists(ctx, destinationKey); existsErr == nil && exists {
+			return apperror.Conflict(fmt.Sprintf("a file already exists at %s", destinationKey))
+		}
 	}
 
 	if err != nil {
 		return err
 	}
 
-	nextToken := resp.NextContinuationToken
+	if err := s.copyReference(ctx, sourceKey, destinationKey); err != nil {
+		return err
+	}
 
-	for nextToken != nil {
+	_, err = s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(sourceKey),
+	}, ifMatch(aws.StringValue(source.ETag)))
 
-		curr, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket:            aws.String(s.bucketName),
-			Prefix:            aws.String(folderPath),
-			MaxKeys:           aws.Int64(1000),
-			ContinuationToken: nextToken,
-		})
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusPreconditionFailed {
+		return apperror.Conflict(fmt.Sprintf("%s changed while it was moved, it was copied to %s as it was before and kept", sourceKey, destinationKey))
+	}
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return err
+	}
 
-		for _, obj := range curr.Contents {
+	return s.unlink(ctx, sourceKey)
+}
 
-			if *obj.Key == folderPath {
-				continue // skip the folder itself
-			}
+// MoveWithMetadata moves an object to destinationKey, replacing its content type and user metadata on the way.
+// Its tags and other headers are kept and an existing destination is replaced, see copyObject.
+func (s *S3) MoveWithMetadata(ctx context.Context, sourceKey, destinationKey string, options UploadOptions) (err error) {
+	ctx, span := s.startSpan(ctx, "s3.MoveWithMetadata",
+		attribute.String("s3.key", sourceKey),
+		attribute.String("s3.destination_key", destinationKey),
+	)
+	defer func() { tracing.End(span, err) }()
 
-			allObjects = append(allObjects, ObjectDetails{
-				Name:         *obj.Key,
-				IsFolder:     *obj.Size == 0,
-				Size:         *obj.Size,
-				LastModified: *obj.LastModified,
-			})
+	source, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(sourceKey),
+	})
+	if err != nil {
+		return err
+	}
 
-			// update the next token
-			nextToken = curr.NextContinuationToken
+	if err := s.copyObject(ctx, source, sourceKey, destinationKey, options); err != nil {
+		return err
+	}
 
-			if nextToken == nil {
-				break
-			}
-		}
+	if err := s.copyReference(ctx, sourceKey, destinationKey); err != nil {
+		return err
+	}
 
+	return s.DeleteObject(ctx, sourceKey)
+}
+
+// ifNoneMatch makes a write fail when its key exists, the SDK has no field for it on copies
+func ifNoneMatch(r *request.Request) {
+	r.HTTPRequest.Header.Set("If-None-Match", "*")
+}
+
+// ifMatch makes a write or delete fail unless its key still has etag, the SDK has no field for it on deletes
+func ifMatch(etag string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("If-Match", etag)
 	}
+}
 
-	for _, obj := range allObjects {
-		err := s.DeleteObject(obj.Name)
-		if err != nil {
-			return err
-		}
+// DeleteFolder deletes a folder and its contents recursively from the S3 bucket.
+func (s *S3) DeleteFolder(ctx context.Context, folderPath string) (err error) {
+
+	// add a trailing slash to the folder path if not already present
+	if folderPath != "" && !strings.HasSuffix(folderPath, "/") {
+		folderPath += "/"
 	}
 
-	// delete the folder itself
-	err = s.DeleteObject(folderPath)
+	ctx, span := s.startSpan(ctx, "s3.DeleteFolder", attribute.String("s3.prefix", folderPath))
+	defer func() { tracing.End(span, err) }()
 
+	// every key below the folder, on all pages, is listed before anything is deleted
+	var keys []string
+	err = s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(folderPath),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if *obj.Key != folderPath {
+				keys = append(keys, *obj.Key) // the folder itself is deleted last
+			}
+		}
+		return true
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	for _, key := range keys {
+		if err := s.DeleteObject(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	// delete the folder itself
+	return s.DeleteObject(ctx, folderPath)
 }
 
-// ListAllFolders lists all the folders within a folder in the S3 bucket.
-func (s *S3) ListAllFolders(folderPath string) []ObjectDetails {
+// ListAllFolders lists all the folders within a folder in the S3 bucket, on all pages of the listing.
+func (s *S3) ListAllFolders(ctx context.Context, folderPath string) (_ []ObjectDetails, err error) {
 	// add a trailing slash to the folder path if not already present
 	if folderPath != "" && !strings.HasSuffix(folderPath, "/") {
 		folderPath += "/"
 	}
 
-	allObjects := []ObjectDetails{}
-
-	resp, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:  aws.String(s.bucketName),
-		Prefix:  aws.String(folderPath),
-		MaxKeys: aws.Int64(1000),
-	})
-
-	for _, obj := range resp.Contents {
+	ctx, span := s.startSpan(ctx, "s3.ListAllFolders", attribute.String("s3.prefix", folderPath))
+	defer func() { tracing.End(span, err) }()
 
-		if *obj.Key == folderPath {
-			continue // skip the folder itself
-		}
+	allObjects := []ObjectDetails{}
+	err = s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(folderPath),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			// references are empty objects too, only keys ending in / are folders
+			if *obj.Key == folderPath || !strings.HasSuffix(*obj.Key, "/") || s.Hidden(*obj.Key) {
+				continue
+			}
 
-		if *obj.Size == 0 {
 			allObjects = append(allObjects, ObjectDetails{
 				Name:         *obj.Key,
-				IsFolder:     *obj.Size == 0,
+				IsFolder:     true,
 				Size:         *obj.Size,
 				LastModified: *obj.LastModified,
 			})
 		}
-	}
-
+		return true
+	})
 	if err != nil {
-		return allObjects
+		return nil, err
 	}
 
-	nextToken := resp.NextContinuationToken
-
-	for nextToken != nil {
-		curr, _ := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket:            aws.String(s.bucketName),
-			Prefix:            aws.String(folderPath),
-			MaxKeys:           aws.Int64(1000),
-			ContinuationToken: nextToken,
-		})
-
-		for _, obj := range curr.Contents {
+	return allObjects, nil
+}
 
-			if *obj.Key == folderPath {
-				continue // skip the folder itself
-			}
+// Hidden reports whether key is below one of the prefixes the service keeps for itself, such as
+// thumbnails and quarantined files. They are kept out of listings and clients cannot address them.
+func (s *S3) Hidden(key string) bool {
+	for _, prefix := range s.hiddenPrefixes {
+		if prefix != "" && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
 
-			if *obj.Size == 0 {
-				allObjects = append(allObjects, ObjectDetails{
-					Name:         *obj.Key,
-					IsFolder:     *obj.Size == 0,
-					Size:         *obj.Size,
-					LastModified: *obj.LastModified,
-				})
-			}
+	return false
+}
 
-			// update the next token
-			nextToken = curr.NextContinuationToken
-			if nextToken == nil {
-				break
-			}
+// ContainsHidden reports whether deleting folderPath would reach into one of the hidden prefixes
+func (s *S3) ContainsHidden(folderPath string) bool {
+	for _, prefix := range s.hiddenPrefixes {
+		if prefix != "" && strings.HasPrefix(prefix, folderPath) {
+			return true
 		}
-
 	}
 
-	return allObjects
+	return s.Hidden(folderPath)
 }
@@ -1,7 +1,13 @@
 package s3
 
 import (
+	"crypto/sha256"
+	"file-management-service/pkg/cache"
+	"io"
+	"sync"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 type ObjectDetails struct {
@@ -10,6 +16,67 @@ type ObjectDetails struct {
 	Size         int64     `json:"size"`
 	LastModified time.Time `json:"lastModified"`
 	DownloadLink string    `json:"downloadLink,omitempty"`
+
+	// set instead of DownloadLink when presigning this object failed
+	DownloadLinkError string `json:"downloadLinkError,omitempty"`
+
+	// /thumbnail URLs by size, for images listed with include=thumbnails
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+
+	// hex digests stored at upload, for files listed with include=checksums
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// entity tag S3 reported, set by WalkObjects and ObjectInfo
+	ETag string `json:"etag,omitempty"`
+
+	// SHA-256 of the shared content when the key is a deduplicated reference
+	DedupRef string `json:"dedupRef,omitempty"`
+
+	// user metadata and tags, for files listed with include=metadata and include=tags
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// ListOptions controls which page of a folder is listed and what is included for each object
+type ListOptions struct {
+	PageToken        string
+	PageSize         int
+	FoldersOnly      bool
+	IncludeLinks     bool // presign a download URL for every file
+	IncludeChecksums bool // look up the stored digests of every file
+	IncludeMetadata  bool // look up the user metadata of every file
+	IncludeTags      bool // look up the tags of every file
+
+	// only list files carrying all of these tags, an empty value matches any value
+	TagFilter map[string]string
+}
+
+// UploadOptions holds the optional object settings for an upload
+type UploadOptions struct {
+	ContentType string            // stored with the object, S3 uses binary/octet-stream when empty
+	Metadata    map[string]string // user metadata, sent as x-amz-meta-* headers
+	Tags        map[string]string // object tags
+
+	// base64 digests of the body, S3 rejects the upload when the body it receives does not match
+	ContentMD5     string
+	ChecksumSHA256 string
+}
+
+// DownloadLinkOptions holds the per-request settings for a signed download URL
+type DownloadLinkOptions struct {
+	Expiry      time.Duration // zero means the configured maximum
+	Disposition string        // inline or attachment
+	FileName    string        // file name suggested to the browser
+	ContentType string        // overrides the Content-Type served by S3
+}
+
+// Download is a signed download URL of a file with the checksums stored at upload
+type Download struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	MD5       string    `json:"md5,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
 }
 
 // CreateFolderRequest represents the request body structure for creating a folder
@@ -35,11 +102,13 @@ type SuccessResponse struct {
 type FailureResponse struct {
 	Status       string `json:"status"`
 	ResponseCode int    `json:"response_code"`
+	ErrorCode    string `json:"error_code"`
 	ErrorMessage string `json:"error_message"`
+	RequestID    string `json:"request_id,omitempty"`
 }
 
 type S3UploadPayload struct {
-	Bucket     string `json:"bucket"`
+	Target     string `json:"target"`
 	FolderPath string `json:"folderPath"`
 }
 
@@ -64,3 +133,28 @@ type FilterSizeRange struct {
 	MinSize int64
 	MaxSize int64
 }
+
+// ListingCache caches listing pages, see NewListingCache
+type ListingCache struct {
+	cache      cache.Cache
+	ttl        time.Duration
+	staleTTL   time.Duration
+	refreshing sync.Map // keys with a background refresh in flight
+	workers    sync.WaitGroup
+}
+
+// countingReader reports the bytes read from an object body to the metrics
+type countingReader struct {
+	reader io.ReadCloser
+}
+
+type cachedListing struct {
+	Response  *ListFilesResponse `json:"response"`
+	FetchedAt time.Time          `json:"fetchedAt"`
+}
+
+// cachedSession is the AWS session of a target with the hash of the settings it was created with
+type cachedSession struct {
+	fingerprint [sha256.Size]byte
+	session     *session.Session
+}
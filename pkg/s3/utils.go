@@ -1,6 +1,8 @@
 package s3
 
 import (
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/metrics"
 	"net/http"
 	"sort"
 	"strings"
@@ -9,11 +11,16 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// GetFailureResponse builds the response body for err, the status and error code
+// come from apperror so AWS errors map to a matching status
 func GetFailureResponse(err error) FailureResponse {
+	appErr := apperror.From(err)
+
 	return FailureResponse{
 		Status:       "Failure",
-		ResponseCode: http.StatusInternalServerError,
-		ErrorMessage: err.Error(),
+		ResponseCode: appErr.Status,
+		ErrorCode:    appErr.Code,
+		ErrorMessage: appErr.Message,
 	}
 }
 
@@ -33,6 +40,16 @@ func GetSuccessResponse(message string) SuccessResponse {
 	}
 }
 
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	metrics.AddInternalReadBytes(int64(n))
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	return r.reader.Close()
+}
+
 // custom function to sort the files by name or last modified
 func SortFiles(files []ObjectDetails, c echo.Context) *[]ObjectDetails {
 	sortBy := c.QueryParam("sortBy")
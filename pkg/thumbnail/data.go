@@ -0,0 +1,30 @@
+package thumbnail
+
+import "time"
+
+// how a thumbnail is fitted into the requested box
+const (
+	FitContain = "contain" // scaled down to fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // scaled to fill the box, the overflow is cropped from the center
+	FitFill    = "fill"    // stretched to the box
+)
+
+var fits = map[string]bool{
+	FitContain: true,
+	FitCover:   true,
+	FitFill:    true,
+}
+
+// content types of the images thumbnails are generated for, by extension
+var sourceTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+const jpegQuality = 85
+
+// limit for thumbnails generated in the background after an upload
+const backgroundTimeout = 2 * time.Minute
@@ -0,0 +1,90 @@
+package thumbnail
+
+import (
+	"bytes"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/imagemeta"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+
+	// decoders for image.Decode
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// render decodes an image of at most maxSize bytes, scales it to spec and encodes it as contentType.
+// Animated GIFs get a thumbnail of their first frame.
+func render(src io.Reader, maxSize int64, spec Spec, contentType string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(src, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, apperror.TooLarge(fmt.Sprintf("image is too large for a thumbnail: more than %d MB", maxSize>>20))
+	}
+
+	// check the dimensions before decoding, a small file can still hold a huge image
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, apperror.UnsupportedMedia(fmt.Sprintf("not a JPEG, PNG, GIF or WebP image: %s", err))
+	}
+
+	if header.Width*header.Height > imagemeta.MaxPixels {
+		return nil, apperror.BadRequest(fmt.Sprintf("image is too large for a thumbnail: %dx%d", header.Width, header.Height))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, apperror.UnsupportedMedia(fmt.Sprintf("failed to decode image: %s", err))
+	}
+
+	// photos are often stored sideways with an Exif orientation
+	img = imagemeta.Orient(img, imagemeta.Orientation(data))
+
+	var out bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&out, resize(img, spec), &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&out, resize(img, spec))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// resize scales img into the box of spec according to its fit
+func resize(img image.Image, spec Spec) image.Image {
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	source := bounds
+
+	var dst *image.RGBA
+	switch spec.Fit {
+	case FitFill:
+		dst = image.NewRGBA(image.Rect(0, 0, spec.Width, spec.Height))
+	case FitCover:
+		// crop the source to the aspect ratio of the box, around its center
+		scale := math.Max(float64(spec.Width)/width, float64(spec.Height)/height)
+		cropWidth, cropHeight := int(math.Round(float64(spec.Width)/scale)), int(math.Round(float64(spec.Height)/scale))
+		offset := image.Pt((bounds.Dx()-cropWidth)/2, (bounds.Dy()-cropHeight)/2)
+		source = image.Rectangle{Min: bounds.Min.Add(offset), Max: bounds.Min.Add(offset).Add(image.Pt(cropWidth, cropHeight))}
+		dst = image.NewRGBA(image.Rect(0, 0, spec.Width, spec.Height))
+	default:
+		// never scaled up, a small image is only re-encoded
+		scale := math.Min(1, math.Min(float64(spec.Width)/width, float64(spec.Height)/height))
+		dst = image.NewRGBA(image.Rect(0, 0, max(1, int(math.Round(width*scale))), max(1, int(math.Round(height*scale)))))
+	}
+
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, source, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,147 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/s3"
+	"file-management-service/pkg/tracing"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// New creates a generator storing thumbnails below prefix, e.g. .thumbnails/.
+// Images larger than maxSourceSize bytes are refused.
+func New(prefix string, maxSourceSize int64) *Generator {
+	return &Generator{prefix: prefix, maxSourceSize: maxSourceSize}
+}
+
+// Supported reports whether thumbnails can be generated for the object, by its extension
+func Supported(objectKey string) bool {
+	_, found := sourceTypes[strings.ToLower(path.Ext(objectKey))]
+	return found
+}
+
+// ValidFit reports whether fit is one of contain, cover or fill
+func ValidFit(fit string) bool {
+	return fits[fit]
+}
+
+// ContentType returns the content type of the thumbnails of an object.
+// JPEG images get JPEG thumbnails, the rest PNG so transparency is kept.
+func ContentType(objectKey string) string {
+	if sourceTypes[strings.ToLower(path.Ext(objectKey))] == "image/jpeg" {
+		return "image/jpeg"
+	}
+
+	return "image/png"
+}
+
+// Key returns the key a thumbnail of an object is stored under
+func (g *Generator) Key(objectKey string, spec Spec) string {
+	extension := ".png"
+	if ContentType(objectKey) == "image/jpeg" {
+		extension = ".jpg"
+	}
+
+	return fmt.Sprintf("%s%dx%d-%s%s", g.folder(objectKey), spec.Width, spec.Height, spec.Fit, extension)
+}
+
+// folder holds all thumbnails of an object, so they can be dropped together
+func (g *Generator) folder(objectKey string) string {
+	return g.prefix + objectKey + "/"
+}
+
+// Ensure returns the key of the thumbnail, generating and storing it first when it does not exist yet
+func (g *Generator) Ensure(ctx context.Context, client *s3.S3, objectKey string, spec Spec) (string, error) {
+	key := g.Key(objectKey, spec)
+
+	exists, err := client.ObjectExists(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	if exists {
+		return key, nil
+	}
+
+	_, err, _ = g.group.Do(client.Target()+":"+key, func() (interface{}, error) {
+		return nil, g.generate(ctx, client, objectKey, key, spec)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// generate renders a thumbnail from the original object and stores it under key
+func (g *Generator) generate(ctx context.Context, client *s3.S3, objectKey, key string, spec Spec) error {
+	src, err := client.GetFile(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	data, err := render(src, g.maxSourceSize, spec, ContentType(objectKey))
+	if err != nil {
+		return err
+	}
+
+	return client.UploadFile(ctx, bytes.NewReader(data), key, s3.UploadOptions{ContentType: ContentType(objectKey)})
+}
+
+// Regenerate drops the stored thumbnails of a changed object and generates specs again,
+// in the background so the request that changed it does not wait
+func (g *Generator) Regenerate(ctx context.Context, client *s3.S3, objectKey string, specs []Spec) {
+	g.background(ctx, func(ctx context.Context) {
+		log := logger.FromContext(ctx)
+		if err := client.DeleteFolder(ctx, g.folder(objectKey)); err != nil {
+			log.Warn("Failed to drop thumbnails", "file", objectKey, "error", err)
+		}
+
+		for _, spec := range specs {
+			if _, err := g.Ensure(ctx, client, objectKey, spec); err != nil {
+				log.Warn("Failed to generate thumbnail", "file", objectKey, "width", spec.Width, "height", spec.Height, "error", err)
+				return
+			}
+		}
+	})
+}
+
+// Remove drops the stored thumbnails of a deleted or moved object in the background
+func (g *Generator) Remove(ctx context.Context, client *s3.S3, objectKey string) {
+	g.Regenerate(ctx, client, objectKey, nil)
+}
+
+// RemoveFolder drops the stored thumbnails of all objects of a deleted folder in the background
+func (g *Generator) RemoveFolder(ctx context.Context, client *s3.S3, folderPath string) {
+	if !strings.HasSuffix(folderPath, "/") {
+		folderPath += "/"
+	}
+
+	g.background(ctx, func(ctx context.Context) {
+		if err := client.DeleteFolder(ctx, g.prefix+folderPath); err != nil {
+			logger.FromContext(ctx).Warn("Failed to drop thumbnails", "prefix", folderPath, "error", err)
+		}
+	})
+}
+
+// background runs work detached from the request, Close waits for it
+func (g *Generator) background(ctx context.Context, work func(context.Context)) {
+	g.workers.Add(1)
+	go func() {
+		defer g.workers.Done()
+
+		ctx, cancel := context.WithTimeout(logger.WithContext(tracing.Detach(ctx), logger.FromContext(ctx)), backgroundTimeout)
+		defer cancel()
+
+		work(ctx)
+	}()
+}
+
+// Close waits for the thumbnails being generated in the background
+func (g *Generator) Close() {
+	g.workers.Wait()
+}
@@ -0,0 +1,23 @@
+package thumbnail
+
+import (
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Spec describes one thumbnail of an image
+type Spec struct {
+	Width  int
+	Height int
+	Fit    string // contain, cover or fill
+}
+
+// Generator creates thumbnails and stores them below a hidden prefix of the bucket,
+// so every size is only generated once
+type Generator struct {
+	prefix        string
+	maxSourceSize int64              // in bytes, larger images are not read
+	group         singleflight.Group // one generation per thumbnail, concurrent requests wait for it
+	workers       sync.WaitGroup
+}
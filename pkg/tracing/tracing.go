@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// ServiceName is reported on every span
+const ServiceName = "file-management-service"
+
+// Setup installs the global tracer provider and the W3C trace context propagator.
+// The OTLP exporter is configured through the standard OTEL_EXPORTER_OTLP_* variables,
+// the file exporter writes one JSON span per line to filePath for offline debugging.
+// The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, exporterName string, filePath string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+
+	switch exporterName {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case ExporterFile:
+		if err = os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			return nil, err
+		}
+
+		file, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", exporterName)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span as a child of the span in ctx
+func Start(ctx context.Context, tracerName, spanName string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, spanName, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Detach returns a context that is not cancelled with ctx but keeps its trace,
+// for background work started by a request
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
@@ -0,0 +1,56 @@
+package routes
+
+import "time"
+
+// how long /readyz waits for HeadBucket
+const readinessTimeout = 2 * time.Second
+
+// routes that are never rate limited, so probes and scrapes keep working under load
+var unlimitedRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// routes that never require an API key
+var publicRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// routes that always require an API key, they are refused while no API keys are configured
+var keyOnlyRoutes = map[string]bool{
+	"/audit":               true,
+	"/webhooks/deliveries": true,
+}
+
+// APIKeyHeader carries the API key when API keys are configured
+const APIKeyHeader = "X-API-Key"
+
+// permissions a route needs on its storage target, checked against the target's access policy
+var routePermissions = map[string][]string{
+	"/upload":            {"write"},
+	"/upload-multiple":   {"write"},
+	"/create-folder":     {"write"},
+	"/download":          {"read"},
+	"/thumbnail":         {"read"},
+	"/list":              {"read"},
+	"/list-folders":      {"read"},
+	"/delete":            {"delete"},
+	"/delete-folder":     {"delete"},
+	"/move":              {"write", "delete"},
+	"/events":            {"read"},
+	"/dedup/report":      {"read"},
+	"/metadata":          {"read"},
+	"/metadata/update":   {"write"},
+	"/duplicates":        {"read"},
+	"/duplicates/delete": {"delete"},
+}
+
+// live event feed settings
+const (
+	feedHeartbeat     = 15 * time.Second // comment lines that keep idle connections open
+	feedRetry         = 3 * time.Second  // reconnect delay suggested to clients
+	lastEventIDHeader = "Last-Event-ID"
+)
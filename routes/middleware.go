@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"file-management-service/config"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/audit"
+	"file-management-service/pkg/metrics"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter limits requests per client IP with the limits of the current configuration
+func RateLimiter(configStore *config.Store) echo.MiddlewareFunc {
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Skipper: SkipRateLimit,
+		Store:   &rateLimiterStore{configStore: configStore},
+		IdentifierExtractor: func(ctx echo.Context) (string, error) {
+			id := ctx.RealIP()
+			return id, nil
+		},
+		ErrorHandler: func(context echo.Context, err error) error {
+			return apperror.Forbidden("unable to identify the client")
+		},
+		DenyHandler: func(context echo.Context, identifier string, err error) error {
+			metrics.RateLimitRejected()
+			return apperror.New(http.StatusTooManyRequests, apperror.CodeRateLimited, "too many requests")
+		},
+	})
+}
+
+// rateLimiterStore rebuilds the memory store when the limits change on reload,
+// every client starts with a full burst again after that
+type rateLimiterStore struct {
+	configStore *config.Store
+	mu          sync.Mutex
+	limits      middleware.RateLimiterMemoryStoreConfig
+	store       *middleware.RateLimiterMemoryStore
+}
+
+func (s *rateLimiterStore) Allow(identifier string) (bool, error) {
+	current := s.configStore.Get()
+	limits := middleware.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(current.RateLimit),
+		Burst:     current.RateLimitBurst,
+		ExpiresIn: time.Duration(current.RateLimitExpiry) * time.Second,
+	}
+
+	s.mu.Lock()
+	if s.store == nil || limits != s.limits {
+		s.limits = limits
+		s.store = middleware.NewRateLimiterMemoryStoreWithConfig(limits)
+	}
+	store := s.store
+	s.mu.Unlock()
+
+	return store.Allow(identifier)
+}
+
+// CORS allows the origins of the current configuration, * allows every origin
+func CORS(configStore *config.Store) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: func(origin string) (bool, error) {
+			for _, allowed := range configStore.Get().CORSOrigins {
+				if allowed == "*" || allowed == origin {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		},
+	})
+}
+
+// BodyLimit caps request bodies at MAX_UPLOAD_SIZE of the current configuration, see limitBody
+func BodyLimit(configStore *config.Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := limitBody(c, int64(configStore.Get().MaxUploadSize)<<20); err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// APIKeyAuth requires a known X-API-Key header once API keys are configured, routes in
+// keyOnlyRoutes are refused until then. The name of the key becomes the actor in the audit log.
+func APIKeyAuth(configStore *config.Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			keys := configStore.Get().APIKeys
+			if len(keys) == 0 && keyOnlyRoutes[c.Path()] {
+				return apperror.Forbidden(c.Path() + " is only available with API keys configured in API_KEYS")
+			}
+
+			if len(keys) == 0 || publicRoutes[c.Path()] {
+				return next(c)
+			}
+
+			given := c.Request().Header.Get(APIKeyHeader)
+			if given == "" {
+				return apperror.Unauthorized("an API key is required in the " + APIKeyHeader + " header")
+			}
+
+			for _, entry := range keys {
+				name, key, _ := strings.Cut(entry, ":")
+				if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+					c.Set(audit.ActorKey, name)
+					return next(c)
+				}
+			}
+
+			return apperror.Unauthorized("invalid API key")
+		}
+	}
+}
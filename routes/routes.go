@@ -1,72 +1,178 @@
 package routes
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"file-management-service/config"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/audit"
 	"file-management-service/pkg/cache"
+	"file-management-service/pkg/dedup"
+	"file-management-service/pkg/duplicates"
+	"file-management-service/pkg/events"
+	"file-management-service/pkg/logger"
+	"file-management-service/pkg/metrics"
+	"file-management-service/pkg/pipeline"
 	"file-management-service/pkg/s3"
+	"file-management-service/pkg/thumbnail"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+// Services are the long lived dependencies the handlers share
+type Services struct {
+	Config     *config.Store // read on every request so reloads apply right away
+	Cache      cache.Cache
+	ListCache  *s3.ListingCache
+	AuditLog   *audit.Logger
+	Events     *events.Bus
+	Webhooks   *events.Dispatcher
+	Feed       *events.Feed
+	Thumbnails *thumbnail.Generator
+	Dedup      *dedup.Index // references of deduplicated keys, shared by the clients of all handlers
+	Duplicates *duplicates.Finder
+	Ready      *atomic.Bool // cleared once the server starts shutting down so /readyz takes it out of rotation
+}
+
 // RegisterRoutes registers all the routes for the application
-func RegisterRoutes(e *echo.Echo, config *config.Config, cache *cache.URLCache) {
+func RegisterRoutes(e *echo.Echo, services Services) {
+	configStore, cache, listCache, bus := services.Config, services.Cache, services.ListCache, services.Events
+	thumbnails, dedupIndex := services.Thumbnails, services.Dedup
+
 	// Define route for uploading images
 	e.POST("/upload", func(c echo.Context) error {
-		return uploadFileHandler(c, config)
+		return uploadFileHandler(c, configStore.Get(), dedupIndex, cache, listCache, bus, thumbnails)
 	})
 
 	// Define route for uploading multiple images
 	e.POST("/upload-multiple", func(c echo.Context) error {
-		return uploadMultipleFilesHandler(c, config)
+		return uploadMultipleFilesHandler(c, configStore.Get(), dedupIndex, cache, listCache, bus, thumbnails)
 	})
 
 	// Define route for serving files
 	e.GET("/download", func(c echo.Context) error {
-		return downloadFileHandler(c, config, cache)
+		return downloadFileHandler(c, configStore.Get(), dedupIndex, cache)
+	})
+
+	// Thumbnail of an image, generated on first request
+	e.GET("/thumbnail", func(c echo.Context) error {
+		return thumbnailHandler(c, configStore.Get(), dedupIndex, cache, thumbnails)
 	})
 
 	// Delete File
 	e.DELETE("/delete", func(c echo.Context) error {
-		return deleteFileHandler(c, config, cache)
+		return deleteFileHandler(c, configStore.Get(), dedupIndex, cache, listCache, bus, thumbnails)
 	})
 
 	// Delete File
 	e.DELETE("/delete-folder", func(c echo.Context) error {
-		return deleteFolderHandler(c, config)
+		return deleteFolderHandler(c, configStore.Get(), dedupIndex, cache, listCache, bus, thumbnails)
 	})
 
 	// List files within current folder
 	e.GET("/list", func(c echo.Context) error {
-		return listFilesHandler(c, config, cache)
+		return listFilesHandler(c, configStore.Get(), dedupIndex, cache, listCache)
 	})
 
 	// list all folders within current folder
 	e.GET("/list-folders", func(c echo.Context) error {
-		return listAllFoldersHandler(c, config)
+		return listAllFoldersHandler(c, configStore.Get(), dedupIndex)
+	})
+
+	// Move a file to a new key
+	e.POST("/move", func(c echo.Context) error {
+		return moveFileHandler(c, configStore.Get(), dedupIndex, cache, listCache, bus, thumbnails)
 	})
 
 	e.POST("/create-folder", func(c echo.Context) error {
-		return createFolderHandler(c, config)
+		return createFolderHandler(c, configStore.Get(), dedupIndex, listCache, bus)
+	})
+
+	// Live feed of file events below a prefix
+	e.GET("/events", func(c echo.Context) error {
+		return eventsHandler(c, configStore.Get(), services.Feed)
+	})
+
+	// Prometheus metrics
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	// Search the audit trail
+	e.GET("/audit", func(c echo.Context) error {
+		return auditLogHandler(c, services.AuditLog)
+	})
+
+	// Search the webhook delivery log
+	e.GET("/webhooks/deliveries", func(c echo.Context) error {
+		return webhookDeliveriesHandler(c, services.Webhooks)
+	})
+
+	// Space saved by deduplicating uploads
+	e.GET("/dedup/report", func(c echo.Context) error {
+		return dedupReportHandler(c, configStore.Get(), dedupIndex)
+	})
+
+	// User metadata and tags of a file
+	e.GET("/metadata", func(c echo.Context) error {
+		return metadataHandler(c, configStore.Get(), dedupIndex)
+	})
+
+	// Replace the user metadata or tags of a file
+	e.POST("/metadata/update", func(c echo.Context) error {
+		return updateMetadataHandler(c, configStore.Get(), dedupIndex, listCache, bus)
+	})
+
+	// Scan a prefix for duplicate files in the background
+	e.POST("/duplicates", func(c echo.Context) error {
+		return startDuplicateScanHandler(c, configStore.Get(), dedupIndex, services.Duplicates)
 	})
 
-	// Define route for testing the server
-	e.GET("/ping", ping)
+	// Duplicate scan reports, a single one by id or the latest ones
+	e.GET("/duplicates", func(c echo.Context) error {
+		return duplicateReportHandler(c, configStore.Get(), dedupIndex, services.Duplicates)
+	})
+
+	// Delete all but one copy of every duplicate set of a report
+	e.POST("/duplicates/delete", func(c echo.Context) error {
+		return deleteDuplicatesHandler(c, configStore.Get(), dedupIndex, cache, listCache, bus, thumbnails, services.Duplicates)
+	})
+
+	// Cache hit, miss and eviction counters
+	e.GET("/cache-stats", func(c echo.Context) error {
+		return cacheStatsHandler(c, cache, listCache)
+	})
+
+	// Liveness probe, the process is up and serving requests
+	e.GET("/healthz", healthzHandler)
+
+	// Readiness probe, the bucket is reachable and the server is not shutting down
+	e.GET("/readyz", func(c echo.Context) error {
+		return readyzHandler(c, configStore.Get(), services.Ready)
+	})
 }
 
 // Handler to create folder
 // createFolderHandler is a handler function for creating a folder in S3
-func createFolderHandler(c echo.Context, config *config.Config) error {
+func createFolderHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, listCache *s3.ListingCache, bus *events.Bus) error {
 
 	folderName := c.QueryParam("path")
 
 	if folderName == "" {
-		response := s3.GetFailureResponse(errors.New("folder path is required and should end with /"))
-		return c.JSON(http.StatusBadRequest, response)
+		return failure(c, apperror.BadRequest("folder path is required and should end with /"))
 	}
 
 	if string(folderName[len(folderName)-1]) != "/" {
@@ -74,58 +180,60 @@ func createFolderHandler(c echo.Context, config *config.Config) error {
 	}
 
 	// Create a new S3 client using your desired bucket name and region
-	client, err := s3.NewClient(config)
+	client, err := newClient(c, config, dedupIndex)
 	if err != nil {
 		// Handle error creating S3 client
-		response := s3.GetFailureResponse(errors.New("failed to create S3 client"))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, folderName); err != nil {
+		return failure(c, err)
 	}
 
 	// Call the CreateFolder function to create the folder
-	err = client.CreateFolder(folderName)
+	err = client.CreateFolder(c.Request().Context(), folderName)
 	if err != nil {
 		// Handle error creating folder
-		response := s3.GetFailureResponse(errors.New("failed to create folder"))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, fmt.Errorf("failed to create folder: %w", err))
 	}
+	listCache.InvalidateFolder(client.Target(), folderName)
+	publish(c, bus, events.Event{Type: events.FolderCreated, Target: client.Target(), Key: folderName})
+
 	response := s3.GetSuccessResponse("Folder created successfully")
 	return c.JSON(http.StatusOK, response)
 }
 
 // Handler for image upload
-func uploadFileHandler(c echo.Context, config *config.Config) error {
+func uploadFileHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache, bus *events.Bus, thumbnails *thumbnail.Generator) error {
+	if err := parseUploadForm(c, config); err != nil {
+		return failure(c, err)
+	}
+
 	folderPath := c.FormValue("path")
 	file, err := c.FormFile("file")
 
 	if err != nil {
 		// Handle the error and return an error response
-		errorMessage := fmt.Sprintf("Failed to retrieve uploaded file: %s", err.Error())
-		response := s3.GetFailureResponse(errors.New(errorMessage))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, apperror.BadRequest(fmt.Sprintf("Failed to retrieve uploaded file: %s", err.Error())))
 	}
 
 	// Open the file
 	src, err := file.Open()
 	if err != nil {
 		// Handle the error and return an error response
-		errorMessage := fmt.Sprintf("Failed to open uploaded file: %s", err.Error())
-		response := s3.GetFailureResponse(errors.New(errorMessage))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, apperror.Internal("Failed to open uploaded file", err))
 	}
 	defer func() {
 		if closeErr := src.Close(); closeErr != nil {
-			// Handle the error (optional)
-			fmt.Println("Failed to close uploaded file:", closeErr)
+			logger.FromContext(c.Request().Context()).Warn("Failed to close uploaded file", "file", file.Filename, "error", closeErr)
 		}
 	}()
 
 	// Create a new S3 client
-	client, err := s3.NewClient(config)
+	client, err := newClient(c, config, dedupIndex)
 	if err != nil {
 		// Handle the error and return an error response
-		errorMessage := fmt.Sprintf("Failed to create S3 client: %s", err.Error())
-		response := s3.GetFailureResponse(errors.New(errorMessage))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
 	// Use the file name as it is as the object key
@@ -139,14 +247,37 @@ func uploadFileHandler(c echo.Context, config *config.Config) error {
 		}
 	}
 
-	// Upload the file to S3
-	err = client.UploadFile(src, objectKey)
+	audit.SetKeys(c, objectKey)
+	audit.AddBytes(c, file.Size)
+
+	if err := checkKeys(client, objectKey); err != nil {
+		return failure(c, err)
+	}
+
+	if err := checkRequestSize(c, config, file.Size, objectKey); err != nil {
+		return failure(c, err)
+	}
+
+	expected, err := clientChecksums(c, "")
 	if err != nil {
-		// Handle the error and return an error response
-		errorMessage := fmt.Sprintf("Failed to upload file to S3: %s", err.Error())
-		response := s3.GetFailureResponse(errors.New(errorMessage))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	fileLabels, err := clientLabels(c, "")
+	if err != nil {
+		return failure(c, err)
+	}
+
+	// Upload the file to S3 through the stages configured for the key, they may reject or change it
+	upload, err := storeUpload(c, config, client, src, file, objectKey, expected, fileLabels)
+	s3.ForgetDownloads(cache, client.Target(), objectKey)
+	if err != nil {
+		return failure(c, err)
 	}
+	listCache.InvalidateObject(client.Target(), objectKey)
+	refreshThumbnails(c, config, client, thumbnails, objectKey)
+	metrics.AddUploadedBytes(upload.Size)
+	publish(c, bus, events.Event{Type: events.ObjectCreated, Target: client.Target(), Key: objectKey, Size: upload.Size})
 
 	// Return a success response
 	successMessage := fmt.Sprintf("File uploaded successfully with object key: %s", objectKey)
@@ -156,63 +287,96 @@ func uploadFileHandler(c echo.Context, config *config.Config) error {
 }
 
 // Handler to upload multiple images
-func uploadMultipleFilesHandler(c echo.Context, config *config.Config) error {
+func uploadMultipleFilesHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache, bus *events.Bus, thumbnails *thumbnail.Generator) error {
+	if err := parseUploadForm(c, config); err != nil {
+		return failure(c, err)
+	}
+
 	// Get the count of uploaded files
 	fileCount, err := strconv.Atoi(c.FormValue("fileCount"))
 	if err != nil {
 		// Handle the error and return an error response
-		errorMessage := fmt.Sprintf("Failed to retrieve file count: %s", err.Error())
-		response := s3.GetFailureResponse(errors.New(errorMessage))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, apperror.BadRequest(fmt.Sprintf("Failed to retrieve file count: %s", err.Error())))
+	}
+
+	if config.MaxUploadFiles > 0 && fileCount > config.MaxUploadFiles {
+		return failure(c, apperror.BadRequest(fmt.Sprintf("At most %d files can be uploaded at once", config.MaxUploadFiles)))
 	}
 
 	// Create a new S3 client
-	client, err := s3.NewClient(config)
+	client, err := newClient(c, config, dedupIndex)
 	if err != nil {
 		// Handle the error and return an error response
-		errorMessage := fmt.Sprintf("Failed to create S3 client: %s", err.Error())
-		response := s3.GetFailureResponse(errors.New(errorMessage))
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
-	// Loop through the files and upload each file to S3
-	for i := 0; i < fileCount; i++ {
-		// Get the file from the request
-		file, err := c.FormFile(fmt.Sprintf("file%d", i))
+	// Get the files from the request, the request size is checked against every key before storing any
+	// along with their labels, so invalid labels reject the request before any file is stored
+	files := make([]*multipart.FileHeader, fileCount)
+	fileLabels := make([]labels, fileCount)
+	keys := make([]string, fileCount)
+	var totalSize int64
+	for i := range files {
+		files[i], err = c.FormFile(fmt.Sprintf("file%d", i))
 		if err != nil {
 			// Handle the error and return an error response
-			errorMessage := fmt.Sprintf("Failed to retrieve uploaded file: %s", err.Error())
-			response := s3.GetFailureResponse(errors.New(errorMessage))
-			return c.JSON(http.StatusInternalServerError, response)
+			return failure(c, apperror.BadRequest(fmt.Sprintf("Failed to retrieve uploaded file: %s", err.Error())))
 		}
+		keys[i] = files[i].Filename
+		totalSize += files[i].Size
+
+		if fileLabels[i], err = clientLabels(c, strconv.Itoa(i)); err != nil {
+			return failure(c, err)
+		}
+	}
+
+	if err := checkKeys(client, keys...); err != nil {
+		return failure(c, err)
+	}
+
+	if err := checkRequestSize(c, config, totalSize, keys...); err != nil {
+		return failure(c, err)
+	}
+
+	// Loop through the files and upload each file to S3
+	var objectKeys []string
+	for i := range files {
+		file := files[i]
 
 		// Open the file
 		src, err := file.Open()
 		if err != nil {
 			// Handle the error and return an error response
-			errorMessage := fmt.Sprintf("Failed to open uploaded file: %s", err.Error())
-			response := s3.GetFailureResponse(errors.New(errorMessage))
-			return c.JSON(http.StatusInternalServerError, response)
+			return failure(c, apperror.Internal("Failed to open uploaded file", err))
 		}
 		defer func() {
 			if closeErr := src.Close(); closeErr != nil {
-				// Handle the error (optional)
-				fmt.Println("Failed to close uploaded file:", closeErr)
+				logger.FromContext(c.Request().Context()).Warn("Failed to close uploaded file", "file", file.Filename, "error", closeErr)
 			}
 		}()
 
 		// Use the file name as it is as the object key
 		objectKey := file.Filename
 
-		// Upload the file to S3
-		err = client.UploadFile(src, objectKey)
+		objectKeys = append(objectKeys, objectKey)
+		audit.SetKeys(c, objectKeys...)
+		audit.AddBytes(c, file.Size)
+
+		expected, err := clientChecksums(c, strconv.Itoa(i))
 		if err != nil {
-			// Handle the error and return an error response
-			errorMessage := fmt.Sprintf("Failed to upload file to S3: %s", err.Error())
-			response := s3.GetFailureResponse(errors.New(errorMessage))
-			return c.JSON(http.StatusInternalServerError, response)
+			return failure(c, err)
+		}
 
+		// Upload the file to S3 through the stages configured for the key, they may reject or change it
+		upload, err := storeUpload(c, config, client, src, file, objectKey, expected, fileLabels[i])
+		s3.ForgetDownloads(cache, client.Target(), objectKey)
+		if err != nil {
+			return failure(c, err)
 		}
+		listCache.InvalidateObject(client.Target(), objectKey)
+		refreshThumbnails(c, config, client, thumbnails, objectKey)
+		metrics.AddUploadedBytes(upload.Size)
+		publish(c, bus, events.Event{Type: events.ObjectCreated, Target: client.Target(), Key: objectKey, Size: upload.Size})
 	}
 
 	// Return a success response
@@ -223,7 +387,7 @@ func uploadMultipleFilesHandler(c echo.Context, config *config.Config) error {
 }
 
 // List all files and folders within a folder
-func listFilesHandler(c echo.Context, config *config.Config, cache *cache.URLCache) error {
+func listFilesHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache) error {
 
 	// bool
 	isFolder, err := strconv.ParseBool(c.QueryParam("isFolder"))
@@ -242,147 +406,1173 @@ func listFilesHandler(c echo.Context, config *config.Config, cache *cache.URLCac
 		pageSize = config.PaginationPageSize
 	}
 
+	// Extra data per object, e.g. include=links for signed download URLs
+	include := parseInclude(c.QueryParam("include"))
+
 	// Create a new S3 client
-	client, err := s3.NewClient(config) // Update with your desired region
+	client, err := newClient(c, config, dedupIndex)
 
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, asFolder(folderPath)); err != nil {
+		return failure(c, err)
+	}
+
+	tagFilter, err := parseTagFilter(c.QueryParams()["tag"])
+	if err != nil {
+		return failure(c, err)
+	}
+
+	options := s3.ListOptions{
+		PageToken:        nextPageToken,
+		PageSize:         pageSize,
+		FoldersOnly:      isFolder,
+		IncludeLinks:     include["links"],
+		IncludeChecksums: include["checksums"],
+		IncludeMetadata:  include["metadata"],
+		IncludeTags:      include["tags"],
+		TagFilter:        tagFilter,
 	}
 
 	// List all the files and folders within the nested folder
-	objects, err := client.ListFiles(folderPath, nextPageToken, pageSize, isFolder, cache)
+	objects, err := client.ListFiles(c.Request().Context(), folderPath, options, cache, listCache)
 
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	if include["thumbnails"] {
+		addThumbnails(*objects.Files, config.Thumbnails(), client.Target())
 	}
 
 	response := s3.GetListFolderSuccessResponse(objects)
 	return c.JSON(http.StatusOK, response)
 }
 
-func listAllFilesHandler(c echo.Context, config *config.Config) error {
+func listAllFilesHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index) error {
 	// Create a new S3 client
-	client, err := s3.NewClient(config) // Update with your desired region
+	client, err := newClient(c, config, dedupIndex)
 
 	folderPath := c.QueryParam("path")
 
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, asFolder(folderPath)); err != nil {
+		return failure(c, err)
 	}
 
 	// List all the files and folders within the nested folder
-	objects, err := client.ListAllFiles(folderPath)
+	objects, err := client.ListAllFiles(c.Request().Context(), folderPath)
 
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
 	return c.JSON(http.StatusOK, objects)
 }
 
-func listAllFoldersHandler(c echo.Context, config *config.Config) error {
+func listAllFoldersHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index) error {
 	// Create a new S3 client
-	client, err := s3.NewClient(config) // Update with your desired region
+	client, err := newClient(c, config, dedupIndex)
 	folderPath := c.QueryParam("path")
 
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
-	// List all the files and folders within the nested folder
-	objects := client.ListAllFolders(folderPath)
+	if err := checkKeys(client, asFolder(folderPath)); err != nil {
+		return failure(c, err)
+	}
+
+	// List all the folders within the nested folder
+	objects, err := client.ListAllFolders(c.Request().Context(), folderPath)
+	if err != nil {
+		return failure(c, err)
+	}
 
 	return c.JSON(http.StatusOK, objects)
 }
 
 // Handler for downloading a file
-func downloadFileHandler(c echo.Context, config *config.Config, cache *cache.URLCache) error {
+func downloadFileHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache) error {
 	key := c.QueryParam("path")
 
+	if key == "" {
+		return failure(c, apperror.BadRequest("path is required"))
+	}
+
 	// Create a new S3 client
-	client, err := s3.NewClient(config) // Update with your desired region
+	client, err := newClient(c, config, dedupIndex)
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, key); err != nil {
+		return failure(c, err)
 	}
 
-	url, err := client.GenerateDownloadLink(key, cache)
+	// Optional per-request link settings, expiry is in seconds and capped by the config
+	options := s3.DownloadLinkOptions{
+		Disposition: c.QueryParam("disposition"),
+		FileName:    c.QueryParam("fileName"),
+		ContentType: c.QueryParam("contentType"),
+	}
+
+	if expiresIn := c.QueryParam("expiresIn"); expiresIn != "" {
+		seconds, err := strconv.Atoi(expiresIn)
+		if err != nil || seconds <= 0 {
+			return failure(c, apperror.BadRequest("expiresIn must be a positive number of seconds"))
+		}
+		options.Expiry = time.Duration(seconds) * time.Second
+	}
+
+	if options.Disposition != "" && options.Disposition != "inline" && options.Disposition != "attachment" {
+		return failure(c, apperror.BadRequest("disposition must be either inline or attachment"))
+	}
+
+	// Presigning does not check the key, so the file is looked up along with its stored checksums
+	// for the client to verify the download. Both are cached with the link.
+	download, err := client.DownloadLink(c.Request().Context(), key, options, cache)
+	if err != nil && apperror.From(err).Status == http.StatusNotFound {
+		return failure(c, apperror.NotFound(fmt.Sprintf("file not found: %s", key)))
+	}
 
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, s3.GetFailureResponse(err))
+		return failure(c, err)
 	}
 
 	// Get the fileName, ignoring folders in prefix.
 	fileName := filepath.Base(key)
 
 	if fileName != "" {
+		data := map[string]string{
+			"url":      download.URL,
+			"fileName": fileName,
+		}
+
+		// files uploaded before checksums were stored have none
+		if download.MD5 != "" {
+			data[s3.MetaMD5] = download.MD5
+		}
+		if download.SHA256 != "" {
+			data[s3.MetaSHA256] = download.SHA256
+		}
+
 		return c.JSON(http.StatusOK,
 			s3.SuccessResponse{
 				Status:       "Success",
 				ResponseCode: http.StatusOK,
-				Data: map[string]string{
-					"url":      url,
-					"fileName": fileName,
-				},
+				Data:         data,
 			})
 	}
 
-	return c.JSON(http.StatusInternalServerError, s3.GetFailureResponse(err))
+	return failure(c, apperror.BadRequest("path must point to a file"))
+}
+
+// thumbnailHandler answers with a signed URL for a thumbnail of an image, generating it first
+// when needed. width and height default to the first configured size, with redirect=true the
+// client is sent to the URL directly, e.g. for img tags.
+func thumbnailHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, thumbnails *thumbnail.Generator) error {
+	key := c.QueryParam("path")
+
+	if key == "" {
+		return failure(c, apperror.BadRequest("path is required"))
+	}
+
+	if !thumbnail.Supported(key) {
+		return failure(c, apperror.UnsupportedMedia("thumbnails are only generated for JPEG, PNG, GIF and WebP images"))
+	}
+
+	spec, err := thumbnailSpec(c, config)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, key); err != nil {
+		return failure(c, err)
+	}
+
+	thumbnailKey, err := thumbnails.Ensure(c.Request().Context(), client, key, spec)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	options := s3.DownloadLinkOptions{
+		Disposition: "inline",
+		ContentType: thumbnail.ContentType(key),
+	}
+
+	url, err := client.GenerateDownloadLink(c.Request().Context(), thumbnailKey, options, cache)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	if redirect, _ := strconv.ParseBool(c.QueryParam("redirect")); redirect {
+		return c.Redirect(http.StatusFound, url)
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data: map[string]interface{}{
+			"url":    url,
+			"width":  spec.Width,
+			"height": spec.Height,
+			"fit":    spec.Fit,
+		},
+	})
 }
 
-func deleteFileHandler(c echo.Context, config *config.Config, cache *cache.URLCache) error {
+func deleteFileHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache, bus *events.Bus, thumbnails *thumbnail.Generator) error {
 	// bucket := c.QueryParam("bucket")
 	path := c.QueryParam("path")
 
+	if path == "" {
+		return failure(c, apperror.BadRequest("path is required"))
+	}
+
 	// Create a new S3 client
-	client, err := s3.NewClient(config) // Update with your desired region
+	client, err := newClient(c, config, dedupIndex)
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, path); err != nil {
+		return failure(c, err)
 	}
 
 	// Delete the file or folder from the S3 bucket
-	err = client.DeleteObject(path)
+	err = client.DeleteObject(c.Request().Context(), path)
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
+	listCache.InvalidateObject(client.Target(), path)
+	s3.ForgetDownloads(cache, client.Target(), path)
+	if thumbnail.Supported(path) {
+		thumbnails.Remove(c.Request().Context(), client, path)
+	}
+	publish(c, bus, events.Event{Type: events.ObjectDeleted, Target: client.Target(), Key: path})
+
 	// Return a success response
 	response := s3.GetSuccessResponse("File deleted successfully")
 	return c.JSON(http.StatusOK, response)
 }
 
-func deleteFolderHandler(c echo.Context, config *config.Config) error {
+func deleteFolderHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache, bus *events.Bus, thumbnails *thumbnail.Generator) error {
 	// bucket := c.QueryParam("bucket")
 	folderPath := c.QueryParam("path")
 
+	// an empty path would delete the whole bucket
+	if folderPath == "" {
+		return failure(c, apperror.BadRequest("path is required"))
+	}
+
 	// Create a new S3 client
-	client, err := s3.NewClient(config) // Update with your desired region
+	client, err := newClient(c, config, dedupIndex)
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
-	// Delete the file or folder from the S3 bucket
-	err = client.DeleteFolder(folderPath)
+	if err := checkFolder(client, folderPath); err != nil {
+		return failure(c, err)
+	}
+
+	// Delete the file or folder from the S3 bucket. A failure can leave it partly deleted,
+	// so the cached pages and links are dropped either way.
+	err = client.DeleteFolder(c.Request().Context(), folderPath)
+	listCache.InvalidateFolder(client.Target(), folderPath)
+	s3.ForgetDownloads(cache, client.Target(), folderPath)
 	if err != nil {
-		response := s3.GetFailureResponse(err)
-		return c.JSON(http.StatusInternalServerError, response)
+		return failure(c, err)
 	}
 
+	thumbnails.RemoveFolder(c.Request().Context(), client, folderPath)
+	publish(c, bus, events.Event{Type: events.FolderDeleted, Target: client.Target(), Key: folderPath})
+
 	// Return a success response
 	response := s3.GetSuccessResponse("Folder deleted successfully")
 	return c.JSON(http.StatusOK, response)
 }
 
-// ping is a simple handler to test the server
-func ping(c echo.Context) error {
-	response := map[string]string{"message": "pong"}
+// moveFileHandler moves a file from one key to another
+func moveFileHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache, bus *events.Bus, thumbnails *thumbnail.Generator) error {
+	from := c.QueryParam("from")
+	to := c.QueryParam("to")
+
+	if from == "" || to == "" {
+		return failure(c, apperror.BadRequest("from and to are required"))
+	}
+
+	// Create a new S3 client
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, from, to); err != nil {
+		return failure(c, err)
+	}
+
+	// never overwrite an existing file, the copy fails instead
+	err = client.MoveObject(c.Request().Context(), from, to)
+
+	// a failed delete leaves the copy behind
+	listCache.InvalidateObject(client.Target(), to)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	listCache.InvalidateObject(client.Target(), from)
+	s3.ForgetDownloads(cache, client.Target(), from)
+	if thumbnail.Supported(from) {
+		thumbnails.Remove(c.Request().Context(), client, from)
+	}
+	publish(c, bus, events.Event{Type: events.ObjectMoved, Target: client.Target(), Key: to, From: from})
+
+	// Return a success response
+	response := s3.GetSuccessResponse("File moved successfully")
+	return c.JSON(http.StatusOK, response)
+}
+
+// auditLogHandler searches the audit trail by actor, key prefix and time window
+func auditLogHandler(c echo.Context, auditLog *audit.Logger) error {
+	query := audit.Query{
+		Actor:  c.QueryParam("actor"),
+		Prefix: c.QueryParam("prefix"),
+		Limit:  100,
+	}
+
+	var err error
+	if from := c.QueryParam("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return failure(c, apperror.BadRequest("from must be a RFC 3339 timestamp"))
+		}
+	}
+
+	if to := c.QueryParam("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return failure(c, apperror.BadRequest("to must be a RFC 3339 timestamp"))
+		}
+	}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return failure(c, apperror.BadRequest("limit must be a positive number"))
+		}
+	}
+
+	entries, err := auditLog.Search(query)
+	if err != nil {
+		return failure(c, apperror.Internal("failed to read the audit log", err))
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data:         entries,
+	})
+}
+
+// eventsHandler streams the events of a target below prefix as server-sent events.
+// Clients resuming with Last-Event-ID get the events they missed first, or a reset event
+// when those are no longer known and the folder has to be listed again.
+func eventsHandler(c echo.Context, config *config.Config, feed *events.Feed) error {
+	target, err := requestTarget(c, config)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	prefix := c.QueryParam("prefix")
+
+	lastEventID := c.Request().Header.Get(lastEventIDHeader)
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("lastEventId")
+	}
+
+	backlog, complete, updates, cancel := feed.Subscribe(lastEventID)
+	defer cancel()
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set(echo.HeaderConnection, "keep-alive")
+	response.Header().Set("X-Accel-Buffering", "no") // keep proxies from buffering the stream
+	response.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(response, "retry: %d\n\n", feedRetry.Milliseconds())
+	if lastEventID != "" && !complete {
+		fmt.Fprint(response, "event: reset\ndata: {}\n\n")
+	}
+
+	matches := func(event events.Event) bool {
+		return event.Target == target.Name &&
+			(strings.HasPrefix(event.Key, prefix) || (event.From != "" && strings.HasPrefix(event.From, prefix)))
+	}
+
+	for _, event := range backlog {
+		if matches(event) {
+			writeEvent(response, event)
+		}
+	}
+	response.Flush()
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			fmt.Fprint(response, ": heartbeat\n\n")
+			response.Flush()
+		case event, ok := <-updates:
+			// too slow or shutting down, the client reconnects with its last event ID
+			if !ok {
+				return nil
+			}
+
+			if matches(event) {
+				writeEvent(response, event)
+				response.Flush()
+			}
+		}
+	}
+}
+
+// writeEvent writes an event in the server-sent events format
+func writeEvent(w io.Writer, event events.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// webhookDeliveriesHandler searches the webhook delivery log by event type, status and URL
+func webhookDeliveriesHandler(c echo.Context, webhooks *events.Dispatcher) error {
+	query := events.Query{
+		EventType: c.QueryParam("event"),
+		Status:    c.QueryParam("status"),
+		URL:       c.QueryParam("url"),
+		Limit:     100,
+	}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return failure(c, apperror.BadRequest("limit must be a positive number"))
+		}
+	}
+
+	deliveries, err := webhooks.Log().Search(query)
+	if err != nil {
+		return failure(c, apperror.Internal("failed to read the webhook delivery log", err))
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data: map[string]interface{}{
+			"pending":    webhooks.Pending(),
+			"deliveries": deliveries,
+		},
+	})
+}
+
+// dedupReportHandler sums up the space saved by deduplication in a target
+func dedupReportHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index) error {
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data: map[string]interface{}{
+			"enabled": config.DedupEnabled,
+			"target":  client.Target(),
+			"report":  client.DedupReport(),
+		},
+	})
+}
+
+// metadataHandler returns the user metadata and tags of a file
+func metadataHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index) error {
+	path := c.QueryParam("path")
+	if path == "" {
+		return failure(c, apperror.BadRequest("path is required"))
+	}
+
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, path); err != nil {
+		return failure(c, err)
+	}
+
+	ctx := c.Request().Context()
+	metadata, err := client.Metadata(ctx, path)
+	if err != nil && apperror.From(err).Status == http.StatusNotFound {
+		return failure(c, apperror.NotFound(fmt.Sprintf("file not found: %s", path)))
+	}
+
+	if err != nil {
+		return failure(c, err)
+	}
+
+	tags, err := client.Tags(ctx, path)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data: map[string]interface{}{
+			"path":     path,
+			"metadata": s3.UserMetadata(metadata),
+			"tags":     tags,
+		},
+	})
+}
+
+// updateMetadataHandler replaces the user metadata, the tags or both of a file with the ones in
+// the JSON body. A field left out keeps its current values, an empty object removes them.
+func updateMetadataHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, listCache *s3.ListingCache, bus *events.Bus) error {
+	path := c.QueryParam("path")
+	if path == "" {
+		return failure(c, apperror.BadRequest("path is required"))
+	}
+
+	var body struct {
+		Metadata map[string]string `json:"metadata"`
+		Tags     map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return failure(c, apperror.BadRequest("body must be a JSON object with metadata and tags objects of strings"))
+	}
+
+	if body.Metadata == nil && body.Tags == nil {
+		return failure(c, apperror.BadRequest("metadata or tags is required"))
+	}
+
+	metadata, err := s3.ValidateMetadata(body.Metadata)
+	if err != nil {
+		return failure(c, apperror.BadRequest(err.Error()))
+	}
+
+	if err := s3.ValidateTags(body.Tags); err != nil {
+		return failure(c, apperror.BadRequest(err.Error()))
+	}
+
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+	audit.SetKeys(c, path)
+
+	if err := checkKeys(client, path); err != nil {
+		return failure(c, err)
+	}
+
+	ctx := c.Request().Context()
+	if exists, err := client.ObjectExists(ctx, path); err != nil {
+		return failure(c, err)
+	} else if !exists {
+		return failure(c, apperror.NotFound(fmt.Sprintf("file not found: %s", path)))
+	}
+
+	if body.Metadata != nil {
+		if err := client.SetUserMetadata(ctx, path, metadata); err != nil {
+			return failure(c, err)
+		}
+	}
+
+	if body.Tags != nil {
+		if err := client.SetTags(ctx, path, body.Tags); err != nil {
+			// the metadata was replaced already, listings and subscribers must still learn about it
+			if body.Metadata != nil {
+				listCache.InvalidateObject(client.Target(), path)
+				publish(c, bus, events.Event{Type: events.ObjectUpdated, Target: client.Target(), Key: path})
+			}
+			return failure(c, err)
+		}
+	}
+
+	listCache.InvalidateObject(client.Target(), path)
+	publish(c, bus, events.Event{Type: events.ObjectUpdated, Target: client.Target(), Key: path})
+
+	response := s3.GetSuccessResponse("File metadata updated successfully")
 	return c.JSON(http.StatusOK, response)
 }
+
+// startDuplicateScanHandler starts scanning a prefix for duplicates, the report is fetched from GET /duplicates
+func startDuplicateScanHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, finder *duplicates.Finder) error {
+	hash := false
+	if value := c.QueryParam("hash"); value != "" {
+		var err error
+		if hash, err = strconv.ParseBool(value); err != nil {
+			return failure(c, apperror.BadRequest("hash must be true or false"))
+		}
+	}
+
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	if err := checkKeys(client, asFolder(c.QueryParam("path"))); err != nil {
+		return failure(c, err)
+	}
+
+	report := finder.Start(c.Request().Context(), client, c.QueryParam("path"), hash)
+
+	return c.JSON(http.StatusAccepted, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusAccepted,
+		Data: map[string]interface{}{
+			"report": report,
+		},
+	})
+}
+
+// duplicateReportHandler returns the report with the given id, or the latest reports of the target without their sets
+func duplicateReportHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, finder *duplicates.Finder) error {
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	id := c.QueryParam("id")
+	if id == "" {
+		return c.JSON(http.StatusOK, s3.SuccessResponse{
+			Status:       "Success",
+			ResponseCode: http.StatusOK,
+			Data: map[string]interface{}{
+				"reports": finder.List(client.Target()),
+			},
+		})
+	}
+
+	report, found := finder.Get(id)
+	if !found || report.Target != client.Target() {
+		return failure(c, apperror.NotFound(fmt.Sprintf("duplicate report not found: %s", id)))
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data: map[string]interface{}{
+			"report": report,
+		},
+	})
+}
+
+// deleteDuplicatesHandler keeps the oldest or newest copy of every duplicate set of a report and deletes the rest
+func deleteDuplicatesHandler(c echo.Context, config *config.Config, dedupIndex *dedup.Index, cache cache.Cache, listCache *s3.ListingCache, bus *events.Bus, thumbnails *thumbnail.Generator, finder *duplicates.Finder) error {
+	id := c.QueryParam("id")
+	if id == "" {
+		return failure(c, apperror.BadRequest("id is required"))
+	}
+
+	keep := c.QueryParam("keep")
+	if keep == "" {
+		keep = duplicates.KeepOldest
+	}
+	if keep != duplicates.KeepOldest && keep != duplicates.KeepNewest {
+		return failure(c, apperror.BadRequest("keep must be oldest or newest"))
+	}
+
+	client, err := newClient(c, config, dedupIndex)
+	if err != nil {
+		return failure(c, err)
+	}
+
+	ctx := c.Request().Context()
+	cleanup, err := finder.Cleanup(ctx, client, id, keep)
+
+	// whatever was deleted before a failure is gone, so it is reported either way
+	for _, key := range cleanup.Deleted {
+		listCache.InvalidateObject(client.Target(), key)
+		s3.ForgetDownloads(cache, client.Target(), key)
+		if thumbnail.Supported(key) {
+			thumbnails.Remove(ctx, client, key)
+		}
+		publish(c, bus, events.Event{Type: events.ObjectDeleted, Target: client.Target(), Key: key})
+	}
+	audit.SetKeys(c, cleanup.Deleted...)
+
+	if err != nil {
+		return failure(c, err)
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data: map[string]interface{}{
+			"deleted":    cleanup.Deleted,
+			"freedBytes": cleanup.FreedBytes,
+			"skipped":    cleanup.Skipped,
+		},
+	})
+}
+
+// cacheStatsHandler returns the counters of the URL and listing caches
+func cacheStatsHandler(c echo.Context, cache cache.Cache, listCache *s3.ListingCache) error {
+	stats := map[string]interface{}{
+		"urls": cache.Stats(),
+	}
+
+	if listCache != nil {
+		stats["listings"] = listCache.Stats()
+	}
+
+	return c.JSON(http.StatusOK, s3.SuccessResponse{
+		Status:       "Success",
+		ResponseCode: http.StatusOK,
+		Data:         stats,
+	})
+}
+
+// publish emits a file event with the actor and request ID of the request
+func publish(c echo.Context, bus *events.Bus, event events.Event) {
+	event.Actor = audit.Actor(c)
+	event.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	bus.Publish(event)
+}
+
+// newClient creates the S3 client for the target of the request, resolving deduplicated keys with dedupIndex
+func newClient(c echo.Context, config *config.Config, dedupIndex *dedup.Index) (*s3.S3, error) {
+	target, err := requestTarget(c, config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s3.NewClient(config, target)
+	if err != nil {
+		return nil, apperror.Internal("failed to create S3 client", err)
+	}
+
+	client.UseDedup(dedupIndex)
+
+	return client, nil
+}
+
+// requestTarget resolves the target named by the target parameter, the default target when
+// it is missing, after checking the target's access policy for the route
+func requestTarget(c echo.Context, config *config.Config) (config.Target, error) {
+	target, err := config.Target(c.FormValue("target"))
+	if err != nil {
+		return target, apperror.BadRequest(err.Error())
+	}
+	audit.SetTarget(c, target.Name)
+
+	actor, _ := c.Get(audit.ActorKey).(string)
+	for _, permission := range routePermissions[c.Path()] {
+		if !target.Allows(permission, actor) {
+			return target, apperror.Forbidden(fmt.Sprintf("%s access to target %s is not allowed", permission, target.Name))
+		}
+	}
+
+	return target, nil
+}
+
+// checkKeys refuses keys below the prefixes the service keeps for itself. Shared content, thumbnails,
+// quarantined and staged files are only reached through the service, never addressed by clients.
+func checkKeys(client *s3.S3, keys ...string) error {
+	for _, key := range keys {
+		if client.Hidden(key) {
+			return apperror.Forbidden(fmt.Sprintf("%s is reserved for the service", key))
+		}
+	}
+
+	return nil
+}
+
+// checkFolder is checkKeys for a folder about to be deleted, which must neither be below nor contain a
+// reserved prefix
+func checkFolder(client *s3.S3, folderPath string) error {
+	if folderPath = asFolder(folderPath); client.ContainsHidden(folderPath) {
+		return apperror.Forbidden(fmt.Sprintf("%s holds files reserved for the service", folderPath))
+	}
+
+	return nil
+}
+
+// asFolder adds the trailing slash of folder keys, the bucket root stays empty
+func asFolder(path string) string {
+	if path != "" && !strings.HasSuffix(path, "/") {
+		return path + "/"
+	}
+
+	return path
+}
+
+// failure sends the structured error response for err, with the status derived from the error
+func failure(c echo.Context, err error) error {
+	audit.SetError(c, err)
+
+	response := s3.GetFailureResponse(err)
+	response.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	if response.ResponseCode >= http.StatusInternalServerError {
+		logger.FromContext(c.Request().Context()).Error("Request failed", "error_code", response.ErrorCode, "error", err)
+	}
+
+	return c.JSON(response.ResponseCode, response)
+}
+
+// ErrorHandler sends errors raised outside of the handlers, e.g. unknown routes,
+// in the same format as the handlers do
+func ErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		code := apperror.CodeInternal
+		switch {
+		case httpErr.Code == http.StatusNotFound:
+			code = apperror.CodeNotFound
+		case httpErr.Code == http.StatusTooManyRequests:
+			code = apperror.CodeRateLimited
+		case httpErr.Code == http.StatusRequestEntityTooLarge:
+			code = apperror.CodeTooLarge
+		case httpErr.Code < http.StatusInternalServerError:
+			code = apperror.CodeValidationFailed
+		}
+
+		err = apperror.New(httpErr.Code, code, fmt.Sprint(httpErr.Message))
+	}
+
+	failure(c, err)
+}
+
+// parseInclude splits a comma separated include query parameter into a set
+func parseInclude(include string) map[string]bool {
+	values := map[string]bool{}
+	for _, value := range strings.Split(include, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values[value] = true
+		}
+	}
+
+	return values
+}
+
+// parseTagFilter reads tag filters of the form key=value, or key alone for any value
+func parseTagFilter(filters []string) (map[string]string, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	tags := map[string]string{}
+	for _, filter := range filters {
+		key, value, _ := strings.Cut(filter, "=")
+		if key == "" {
+			return nil, apperror.BadRequest("tag filters must be key=value or key")
+		}
+		tags[key] = value
+	}
+
+	return tags, nil
+}
+
+// SkipRateLimit keeps probes and metric scrapes out of the rate limiter
+func SkipRateLimit(c echo.Context) bool {
+	return unlimitedRoutes[c.Path()]
+}
+
+// healthzHandler answers as long as the process is able to serve requests
+func healthzHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, s3.GetSuccessResponse("ok"))
+}
+
+// readyzHandler checks that the bucket of every target can be reached with HeadBucket
+func readyzHandler(c echo.Context, config *config.Config, ready *atomic.Bool) error {
+	if !ready.Load() {
+		return failure(c, apperror.New(http.StatusServiceUnavailable, apperror.CodeUnavailable, "server is shutting down"))
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	for _, name := range config.TargetNames() {
+		target, err := config.Target(name)
+		if err != nil {
+			return failure(c, err)
+		}
+
+		client, err := s3.NewClient(config, target)
+		if err != nil {
+			return failure(c, err)
+		}
+
+		if err := client.HeadBucket(ctx); err != nil {
+			// an unreachable bucket always makes the service unready, whatever the AWS error was
+			appErr := apperror.From(err)
+			message := fmt.Sprintf("target %s: %s", name, appErr.Message)
+			return failure(c, apperror.New(http.StatusServiceUnavailable, appErr.Code, message))
+		}
+	}
+
+	return c.JSON(http.StatusOK, s3.GetSuccessResponse("ready"))
+}
+
+// thumbnailSpec reads the width, height and fit parameters of a thumbnail request.
+// A missing width or height leaves that side unbounded for contain.
+func thumbnailSpec(c echo.Context, config *config.Config) (thumbnail.Spec, error) {
+	spec := thumbnail.Spec{Fit: c.QueryParam("fit")}
+	if spec.Fit == "" {
+		spec.Fit = thumbnail.FitContain
+	}
+
+	if !thumbnail.ValidFit(spec.Fit) {
+		return spec, apperror.BadRequest("fit must be one of contain, cover or fill")
+	}
+
+	width, height := c.QueryParam("width"), c.QueryParam("height")
+	if width == "" && height == "" {
+		sizes := config.Thumbnails()
+		if len(sizes) == 0 {
+			return spec, apperror.BadRequest("width or height is required")
+		}
+		spec.Width, spec.Height = sizes[0].Width, sizes[0].Height
+		return spec, nil
+	}
+
+	if spec.Fit != thumbnail.FitContain && (width == "" || height == "") {
+		return spec, apperror.BadRequest(fmt.Sprintf("width and height are required for fit=%s", spec.Fit))
+	}
+
+	for _, side := range []struct {
+		value string
+		size  *int
+	}{{width, &spec.Width}, {height, &spec.Height}} {
+		if side.value == "" {
+			*side.size = config.ThumbnailMaxDimension
+			continue
+		}
+
+		size, err := strconv.Atoi(side.value)
+		if err != nil || size <= 0 || size > config.ThumbnailMaxDimension {
+			return spec, apperror.BadRequest(fmt.Sprintf("width and height must be between 1 and %d", config.ThumbnailMaxDimension))
+		}
+		*side.size = size
+	}
+
+	return spec, nil
+}
+
+// limitBody rejects a request announcing a body larger than limit bytes with 413 and fails reading more
+// than limit bytes of the body, zero means unlimited
+func limitBody(c echo.Context, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	if c.Request().ContentLength > limit {
+		return apperror.TooLarge(fmt.Sprintf("request is larger than the %d MB allowed", limit>>20))
+	}
+
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, limit)
+	return nil
+}
+
+// parseUploadForm reads the multipart form of an upload with the body capped at the largest size the
+// current configuration allows for the folder, the path query parameter or else any folder. The form
+// holds the folder, so the limit of the keys is checked again once it is read, see checkRequestSize.
+func parseUploadForm(c echo.Context, config *config.Config) error {
+	folderPath := c.QueryParam("path")
+	if err := limitBody(c, config.UploadLimit(asFolder(folderPath))); err != nil {
+		return err
+	}
+
+	_, err := c.MultipartForm()
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return apperror.TooLarge(fmt.Sprintf("request is larger than the %d MB allowed", tooLarge.Limit>>20))
+	}
+
+	if err != nil {
+		return apperror.BadRequest(fmt.Sprintf("Failed to read the upload form: %s", err))
+	}
+
+	return nil
+}
+
+// checkRequestSize rejects the request when it is larger than the upload policy of any of the keys allows.
+// size is the total of the files, for requests sent without a Content-Length.
+func checkRequestSize(c echo.Context, config *config.Config, size int64, objectKeys ...string) error {
+	size = max(size, c.Request().ContentLength)
+	for _, key := range objectKeys {
+		policy, found := config.PolicyFor(key)
+		if limit := policy.RequestLimit(); found && limit > 0 && size > limit {
+			return apperror.TooLarge(fmt.Sprintf("request is larger than the %d MB allowed for uploads below %q", policy.MaxRequestSize, policy.Prefix))
+		}
+	}
+
+	return nil
+}
+
+// clientChecksums reads the digests a client sent for a file, hex or base64 encoded. /upload takes the
+// X-Checksum-MD5 and X-Checksum-SHA256 headers or the md5 and sha256 form fields, /upload-multiple
+// the form fields suffixed with the file index, e.g. sha2560 for file0.
+func clientChecksums(c echo.Context, index string) (pipeline.Checksums, error) {
+	var checksums pipeline.Checksums
+	for _, field := range []struct {
+		name   string
+		size   int
+		target *string
+	}{
+		{"MD5", md5.Size, &checksums.MD5},
+		{"SHA256", sha256.Size, &checksums.SHA256},
+	} {
+		value := c.FormValue(strings.ToLower(field.name) + index)
+		if value == "" && index == "" {
+			value = c.Request().Header.Get("X-Checksum-" + field.name)
+		}
+
+		if value == "" {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(value)
+		if err != nil || len(decoded) != field.size {
+			decoded, err = base64.StdEncoding.DecodeString(value)
+		}
+
+		if err != nil || len(decoded) != field.size {
+			return checksums, apperror.BadRequest(fmt.Sprintf("%s checksum must be a hex or base64 encoded %d byte digest", field.name, field.size))
+		}
+
+		*field.target = hex.EncodeToString(decoded)
+	}
+
+	return checksums, nil
+}
+
+// labels are the user metadata and tags a client sets on an uploaded file
+type labels struct {
+	metadata map[string]string
+	tags     map[string]string
+}
+
+// clientLabels reads the metadata and tags form fields, JSON objects of strings. Files of
+// /upload-multiple take the fields with their index, e.g. tags0, and the plain ones otherwise.
+func clientLabels(c echo.Context, index string) (labels, error) {
+	var fileLabels labels
+	for _, field := range []struct {
+		name   string
+		target *map[string]string
+	}{
+		{"metadata", &fileLabels.metadata},
+		{"tags", &fileLabels.tags},
+	} {
+		value := c.FormValue(field.name + index)
+		if value == "" && index != "" {
+			value = c.FormValue(field.name)
+		}
+
+		if value == "" {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(value), field.target); err != nil {
+			return fileLabels, apperror.BadRequest(fmt.Sprintf("%s must be a JSON object of strings", field.name))
+		}
+	}
+
+	var err error
+	if fileLabels.metadata, err = s3.ValidateMetadata(fileLabels.metadata); err != nil {
+		return fileLabels, apperror.BadRequest(err.Error())
+	}
+
+	if err := s3.ValidateTags(fileLabels.tags); err != nil {
+		return fileLabels, apperror.BadRequest(err.Error())
+	}
+
+	return fileLabels, nil
+}
+
+// storeUpload stores an uploaded file through the pipeline configured for its key
+func storeUpload(c echo.Context, config *config.Config, client *s3.S3, src io.ReadSeeker, file *multipart.FileHeader, objectKey string, expected pipeline.Checksums, fileLabels labels) (*pipeline.Upload, error) {
+	stages, err := pipeline.For(config, objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &pipeline.Upload{
+		Key:         objectKey,
+		Client:      client,
+		Body:        src,
+		Size:        file.Size,
+		ContentType: file.Header.Get(echo.HeaderContentType),
+		Metadata:    fileLabels.metadata,
+		Tags:        fileLabels.tags,
+		Expected:    expected,
+	}
+
+	if err := stages.Store(c.Request().Context(), upload); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// refreshThumbnails replaces the thumbnails of an uploaded image. They are generated right away
+// with THUMBNAIL_ON_UPLOAD, otherwise the old ones are only dropped.
+func refreshThumbnails(c echo.Context, config *config.Config, client *s3.S3, thumbnails *thumbnail.Generator, objectKey string) {
+	if !thumbnail.Supported(objectKey) {
+		return
+	}
+
+	var specs []thumbnail.Spec
+	if config.ThumbnailOnUpload {
+		for _, size := range config.Thumbnails() {
+			specs = append(specs, thumbnail.Spec{Width: size.Width, Height: size.Height, Fit: thumbnail.FitContain})
+		}
+	}
+
+	thumbnails.Regenerate(c.Request().Context(), client, objectKey, specs)
+}
+
+// addThumbnails links the configured thumbnail sizes of the listed images.
+// The links go through /thumbnail, so thumbnails that do not exist yet are generated on first use.
+func addThumbnails(objects []s3.ObjectDetails, sizes []config.ThumbnailSize, target string) {
+	for i := range objects {
+		if objects[i].IsFolder || !thumbnail.Supported(objects[i].Name) {
+			continue
+		}
+
+		objects[i].Thumbnails = map[string]string{}
+		for _, size := range sizes {
+			query := url.Values{
+				"path":     {objects[i].Name},
+				"width":    {strconv.Itoa(size.Width)},
+				"height":   {strconv.Itoa(size.Height)},
+				"target":   {target},
+				"redirect": {"true"},
+			}
+
+			objects[i].Thumbnails[size.String()] = "/thumbnail?" + query.Encode()
+		}
+	}
+}
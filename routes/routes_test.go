@@ -0,0 +1,186 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"file-management-service/config"
+	"file-management-service/pkg/apperror"
+	"file-management-service/pkg/cache"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newServer registers the routes with a bucket at an address nothing listens on, requests that
+// reach the bucket fail with a server error. flags are added to the configuration.
+func newServer(t *testing.T, flags ...string) (*echo.Echo, *config.Store) {
+	args := append([]string{
+		"--bucket-name=b", "--region=us-east-1", "--s3-endpoint=http://127.0.0.1:1", "--s3-force-path-style=true",
+		"--aws-access-key-id=key", "--aws-secret-access-key=secret",
+	}, flags...)
+	cfg, options, err := config.LoadConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := config.NewStore(cfg, options, args)
+
+	e := echo.New()
+	e.HTTPErrorHandler = ErrorHandler
+	e.Use(BodyLimit(store))
+	RegisterRoutes(e, Services{Config: store, Cache: cache.NewLRUCache(0, 0)})
+	return e, store
+}
+
+// upload builds an /upload request storing a file below folder
+func upload(t *testing.T, folder string) *http.Request {
+	return uploadOf(t, "/upload", folder, []byte("content"))
+}
+
+// uploadOf builds a request to url uploading content below folder
+func uploadOf(t *testing.T, url, folder string, content []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("path", folder)
+	file, err := form.CreateFormFile("file", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(content)
+	form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, url, &body)
+	request.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	return request
+}
+
+// clients cannot address the prefixes the service keeps for itself
+func TestReservedKeysAreRefused(t *testing.T) {
+	e, _ := newServer(t)
+
+	requests := []*http.Request{
+		upload(t, ".staging/"),
+		upload(t, ".quarantine"),
+		httptest.NewRequest(http.MethodGet, "/download?path=.quarantine/2024/a.txt", nil),
+		httptest.NewRequest(http.MethodGet, "/download?path=.staging/id/a.txt", nil),
+		httptest.NewRequest(http.MethodGet, "/thumbnail?path=.thumbnails/a.jpg", nil),
+		httptest.NewRequest(http.MethodPost, "/move?from=.quarantine/a.txt&to=public/a.txt", nil),
+		httptest.NewRequest(http.MethodPost, "/move?from=a.txt&to=.staging/a.txt", nil),
+		httptest.NewRequest(http.MethodDelete, "/delete?path=.quarantine/a.txt", nil),
+		httptest.NewRequest(http.MethodDelete, "/delete-folder?path=.quarantine", nil),
+		httptest.NewRequest(http.MethodPost, "/create-folder?path=.staging/new", nil),
+		httptest.NewRequest(http.MethodGet, "/list?path=.quarantine", nil),
+		httptest.NewRequest(http.MethodGet, "/list-folders?path=.staging/", nil),
+		upload(t, ".blobs/"),
+		httptest.NewRequest(http.MethodGet, "/download?path=.blobs/0a1b2c", nil),
+		httptest.NewRequest(http.MethodDelete, "/delete?path=.blobs/0a1b2c", nil),
+		httptest.NewRequest(http.MethodDelete, "/delete-folder?path=.blobs/", nil),
+		httptest.NewRequest(http.MethodPost, "/move?from=a.txt&to=.blobs/0a1b2c", nil),
+		httptest.NewRequest(http.MethodPost, "/duplicates?path=.quarantine", nil),
+		httptest.NewRequest(http.MethodGet, "/metadata?path=.quarantine/a.txt", nil),
+		httptest.NewRequest(http.MethodPost, "/metadata/update?path=.staging/a.txt", strings.NewReader(`{"tags":{"project":"apollo"}}`)),
+	}
+
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "reserved") {
+			t.Errorf("%s %s: got %d %s, want 403", request.Method, request.URL, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func TestParseTagFilter(t *testing.T) {
+	for _, test := range []struct {
+		filters []string
+		want    map[string]string
+	}{
+		{nil, nil},
+		{[]string{"project=apollo"}, map[string]string{"project": "apollo"}},
+		{[]string{"project=apollo", "status"}, map[string]string{"project": "apollo", "status": ""}},
+		{[]string{"status="}, map[string]string{"status": ""}},
+		{[]string{"expr=a=b"}, map[string]string{"expr": "a=b"}},
+		{[]string{"project=apollo", "project=gemini"}, map[string]string{"project": "gemini"}},
+	} {
+		got, err := parseTagFilter(test.filters)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseTagFilter(%q) = %v, %v, want %v", test.filters, got, err, test.want)
+		}
+	}
+
+	for _, filters := range [][]string{{""}, {"=apollo"}, {"project=apollo", "=x"}} {
+		_, err := parseTagFilter(filters)
+
+		var appErr *apperror.Error
+		if !errors.As(err, &appErr) || appErr.Status != http.StatusBadRequest {
+			t.Errorf("parseTagFilter(%q) = %v, want a bad request", filters, err)
+		}
+	}
+}
+
+// oversized uploads are rejected while the form is read, before any file is buffered or stored
+func TestUploadSizeIsLimitedBeforeParsing(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 2<<20)
+
+	for name, test := range map[string]struct {
+		flags    []string
+		url      string
+		announce bool // send the Content-Length
+	}{
+		"MAX_UPLOAD_SIZE announced": {[]string{"--max-upload-size=1"}, "/upload", true},
+		"MAX_UPLOAD_SIZE streamed":  {[]string{"--max-upload-size=1"}, "/upload", false},
+		"policy of the folder":      {[]string{`--upload-policies=[{"prefix":"photos/","maxRequestSize":1}]`}, "/upload?path=photos", false},
+		"policy of every folder":    {[]string{`--upload-policies=[{"prefix":"","maxRequestSize":1}]`}, "/upload", false},
+	} {
+		e, _ := newServer(t, test.flags...)
+
+		request := uploadOf(t, test.url, "photos", content)
+		if !test.announce {
+			request.ContentLength = -1
+		}
+
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: got %d %s, want 413", name, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func TestUploadSizeFollowsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"maxUploadSize": 0}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, store := newServer(t, "--config="+path)
+	content := bytes.Repeat([]byte("x"), 2<<20)
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, uploadOf(t, "/upload", "docs", content))
+	if recorder.Code == http.StatusRequestEntityTooLarge {
+		t.Fatalf("rejected without a limit: %s", recorder.Body)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"maxUploadSize": 1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+	e.ServeHTTP(recorder, uploadOf(t, "/upload", "docs", content))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("after lowering MAX_UPLOAD_SIZE: got %d %s, want 413", recorder.Code, recorder.Body)
+	}
+}